@@ -0,0 +1,154 @@
+package account
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// AccountStore - the storage of customer accounts used by an account manager.
+// A store decides how long customer accounts live: the memory store forgets them once the program exits
+// while the file store keeps them across runs and restarts.
+type AccountStore interface {
+	// get - return the account of the given customer, creating it if it does not exist.
+	get(customerID identifier) *customerAccount
+	// commit - log the decision made for the given transaction before it is applied to the given account, and post
+	// the given ledger entry if the transaction is accepted, or nil if it is declined. Entries are posted in the order
+	// of the log. It is called with the account and the wallets of the transaction locked, and it returns a function
+	// that waits until the decision is durable, which is called once the wallets are unlocked so that concurrent
+	// decisions can share a sync. The transaction must not be applied if an error is returned by either.
+	commit(a *customerAccount, t *loadTransaction, entry *ledgerEntry) (func() error, error)
+	// ledger - return the ledger of the accepted transactions of all the customers.
+	ledger() *ledger
+	// saveCheckpoint - record the state of the accounts in the given checkpoint, unless the store persists it itself.
+	// It is called once all the commits are done.
+	saveCheckpoint(c *checkpoint) error
+	// loadCheckpoint - restore the state of the accounts recorded in the given checkpoint, or check that the store is
+	// still in the state it was in when the checkpoint was written. It is called before any commit.
+	loadCheckpoint(c *checkpoint) error
+	// Close - flush and release the resources held by the store.
+	Close() error
+}
+
+// memoryAccountStore - an account store that keeps customer accounts in memory only.
+type memoryAccountStore struct {
+	accounts map[identifier]*customerAccount
+	mutex    *sync.RWMutex
+	balances *ledger
+}
+
+// NewMemoryAccountStore - create an account store that keeps customer accounts in memory only.
+func NewMemoryAccountStore() AccountStore {
+	return newMemoryAccountStore()
+}
+
+func newMemoryAccountStore() *memoryAccountStore {
+	return &memoryAccountStore{
+		accounts: make(map[identifier]*customerAccount, 0),
+		mutex:    &sync.RWMutex{},
+		balances: newLedger(),
+	}
+}
+
+func (s *memoryAccountStore) get(customerID identifier) *customerAccount {
+	s.mutex.RLock()
+	account := s.accounts[customerID]
+	s.mutex.RUnlock()
+	if account != nil {
+		return account
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.accounts[customerID] == nil {
+		s.accounts[customerID] = newCustomerAccount(customerID)
+	}
+	return s.accounts[customerID]
+}
+
+func (s *memoryAccountStore) commit(a *customerAccount, t *loadTransaction, entry *ledgerEntry) (func() error, error) {
+	if entry != nil {
+		s.balances.post(entry, 0)
+	}
+	return durable, nil
+}
+
+// durable - the wait for a decision that is durable as soon as it is made, or that is never persisted.
+func durable() error {
+	return nil
+}
+
+func (s *memoryAccountStore) ledger() *ledger {
+	return s.balances
+}
+
+func (s *memoryAccountStore) Close() error {
+	return nil
+}
+
+// all - return all the accounts in the store.
+func (s *memoryAccountStore) all() []*customerAccount {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	accounts := make([]*customerAccount, 0, len(s.accounts))
+	for _, account := range s.accounts {
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
+
+// encodeAccounts - encode all the accounts and the ledger in a snapshot that reflects at least all the decisions up to
+// the given sequence number. Every account is encoded while it is locked, so it is consistent with its own `Seq`.
+func (s *memoryAccountStore) encodeAccounts(seq uint64) (*accountSnapshot, error) {
+	snapshot := &accountSnapshot{Seq: seq}
+	for _, account := range s.all() {
+		account.mutex.Lock()
+		data, err := json.Marshal(account)
+		account.mutex.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("error encoding account %s: %s", account.CustomerID.String(), err.Error())
+		}
+		snapshot.Accounts = append(snapshot.Accounts, data)
+	}
+	snapshot.Ledger = s.balances.snapshot()
+	return snapshot, nil
+}
+
+// restoreAccounts - restore the accounts and the ledger encoded in the given snapshot.
+func (s *memoryAccountStore) restoreAccounts(snapshot *accountSnapshot) error {
+	for _, accountData := range snapshot.Accounts {
+		account := newCustomerAccount("")
+		if err := json.Unmarshal(accountData, account); err != nil {
+			return err
+		}
+		s.accounts[account.CustomerID] = account
+	}
+	if snapshot.Ledger != nil {
+		s.balances.restore(snapshot.Ledger)
+	}
+	return nil
+}
+
+// saveCheckpoint - record all the accounts in the checkpoint, as they are forgotten once the program exits.
+func (s *memoryAccountStore) saveCheckpoint(c *checkpoint) error {
+	snapshot, err := s.encodeAccounts(0)
+	if err != nil {
+		return err
+	}
+	c.Accounts = snapshot
+	return nil
+}
+
+// loadCheckpoint - restore the accounts recorded in the checkpoint.
+func (s *memoryAccountStore) loadCheckpoint(c *checkpoint) error {
+	if c.Accounts == nil {
+		return fmt.Errorf("the checkpoint holds no accounts, as they were kept in an account store directory")
+	}
+	if len(s.accounts) > 0 {
+		return fmt.Errorf("the account store already holds accounts")
+	}
+	if err := s.restoreAccounts(c.Accounts); err != nil {
+		return fmt.Errorf("error decoding the accounts of the checkpoint: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,365 @@
+package account
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// genesisHash - the previous hash of the first record of an audit log.
+var genesisHash = strings.Repeat("0", sha256.Size*2)
+
+// auditRecord - a decision in the audit log: the transaction, what the customer's account looked like when the
+// decision was made, the outcome of every rule checked and the decision itself.
+type auditRecord struct {
+	Seq         uint64           `json:"seq"`       // The position of the record in the audit log, starting from 1.
+	PrevHash    string           `json:"prev_hash"` // The hash of the previous record.
+	RecordedAt  time.Time        `json:"recorded_at"`
+	Transaction *loadTransaction `json:"transaction"`
+	Accepted    bool             `json:"accepted"`
+	Outcome     resultOutcome    `json:"outcome,omitempty"`
+	ReasonCode  reasonCode       `json:"reason_code,omitempty"`
+	Message     string           `json:"message,omitempty"`
+	Aggregates  *auditAggregates `json:"aggregates,omitempty"` // Omitted for invalid and duplicate transactions.
+	Checks      []auditCheck     `json:"checks,omitempty"`     // The rules checked, in order, until one declines.
+}
+
+// auditAggregates - the aggregates of a customer's account seen when a decision is made. Periods are the calendar
+// periods of the transaction, except for reversals.
+type auditAggregates struct {
+	Balance         string        `json:"balance"`
+	Periods         []auditPeriod `json:"periods,omitempty"`
+	CoolingOffUntil *time.Time    `json:"cooling_off_until,omitempty"`
+}
+
+// auditPeriod - the accepted transactions of the same type in a calendar period of the transaction.
+type auditPeriod struct {
+	Period rulePeriod      `json:"period"`
+	Key    transactionDate `json:"key"`
+	Amount string          `json:"amount"`
+	Count  uint            `json:"count"`
+}
+
+// auditCheck - the outcome of a rule checked for a transaction.
+type auditCheck struct {
+	Rule       string     `json:"rule"`
+	Passed     bool       `json:"passed"`
+	ReasonCode reasonCode `json:"reason_code,omitempty"`
+	Message    string     `json:"message,omitempty"`
+}
+
+// auditEntry - a line of the audit log. The hash is the SHA-256 of the record's bytes, which include the hash of the
+// previous record, so that modifying, removing or reordering records breaks the chain.
+type auditEntry struct {
+	Record json.RawMessage `json:"record"`
+	Hash   string          `json:"hash"`
+}
+
+// newAuditRecord - create the audit record of the given transaction, whose decision is not made yet.
+// The methods of a nil record record nothing, so that transactions are only observed if there is an audit log.
+func newAuditRecord(t *loadTransaction) *auditRecord {
+	return &auditRecord{Transaction: t}
+}
+
+// observeAccount - record the aggregates of the given account that the transaction is checked against, i.e. the ones
+// of the given calendar periods. The caller must hold the lock of the account.
+func (r *auditRecord) observeAccount(a *customerAccount, t *loadTransaction, periods []rulePeriod) {
+	if r == nil {
+		return
+	}
+	r.Aggregates = &auditAggregates{}
+	if t.Type == transactionTypeReversal {
+		return
+	}
+	counters := a.counters(t.Type)
+	r.Aggregates.CoolingOffUntil = counters.CoolingOffUntil
+	for _, period := range periods {
+		key := t.periodKey(period)
+		r.Aggregates.Periods = append(r.Aggregates.Periods, auditPeriod{
+			Period: period,
+			Key:    key,
+			Amount: counters.loadedFunds(period)[key].String(),
+			Count:  counters.loadedTime(period)[key],
+		})
+	}
+}
+
+// observeBalance - record the balance of the customer's wallet that the transaction is checked against.
+func (r *auditRecord) observeBalance(balance money) {
+	if r == nil || r.Aggregates == nil {
+		return
+	}
+	r.Aggregates.Balance = balance.String()
+}
+
+// observeCheck - record the outcome of the given rule.
+func (r *auditRecord) observeCheck(rule string, err error) {
+	if r == nil {
+		return
+	}
+	check := auditCheck{Rule: rule, Passed: err == nil}
+	if err != nil {
+		check.ReasonCode = reasonCodeOf(err)
+		check.Message = err.Error()
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// observeResult - record the decision.
+func (r *auditRecord) observeResult(result *loadTransactionResult) {
+	if r == nil {
+		return
+	}
+	r.Accepted = result.Accepted
+	r.Outcome = result.Outcome
+	if result.Error != nil {
+		r.ReasonCode = reasonCodeOf(result.Error)
+		r.Message = result.Error.Error()
+	}
+}
+
+/****************************************************************************************/
+
+// AuditLog - a tamper-evident, append-only log of every decision. Each record is chained to the previous one by its
+// hash, so that VerifyAuditLog detects any record that is modified, removed or inserted. A record is synced to disk
+// before it is appended, so an audited decision survives an OS crash or a power loss.
+type AuditLog struct {
+	file     *os.File
+	size     int64
+	seq      uint64
+	lastHash string
+	failed   error // The error of a failed sync, after which no record is appended anymore.
+	mutex    *sync.Mutex
+	now      func() time.Time
+
+	syncedSeq uint64 // The sequence number of the last record synced to disk.
+	syncMutex sync.Mutex
+}
+
+// OpenAuditLog - open the audit log in the given file, creating it if it does not exist. New records are chained to
+// the last record of the file. An incomplete record at the end of the file, left by a crash in the middle of a write,
+// is removed.
+// Params:
+//	path: The file of the audit log.
+// Returns:
+//	*AuditLog: The audit log, which needs to be closed after use.
+//	error: Any error that occurred during reading the file.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	summary, err := readAuditLog(path, false)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading audit log %s: %s", path, err.Error())
+	}
+	if summary.incomplete {
+		log.Printf("removing the incomplete record at the end of audit log %s", path)
+		if err := os.Truncate(path, summary.size); err != nil {
+			return nil, fmt.Errorf("error truncating audit log %s: %s", path, err.Error())
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error openning audit log %s: %s", path, err.Error())
+	}
+	return &AuditLog{
+		file:      file,
+		size:      summary.size,
+		seq:       summary.records,
+		lastHash:  summary.head,
+		mutex:     &sync.Mutex{},
+		now:       time.Now,
+		syncedSeq: summary.records,
+	}, nil
+}
+
+// append - chain the given record to the last one and append it to the log. It returns once the record is synced to
+// disk, which concurrent appends share.
+func (l *AuditLog) append(record *auditRecord) error {
+	seq, err := l.write(record)
+	if err != nil {
+		return err
+	}
+	return l.sync(seq)
+}
+
+// write - chain the given record to the last one and write it to the log, and return its sequence number.
+func (l *AuditLog) write(record *auditRecord) (uint64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.failed != nil {
+		return 0, l.failed
+	}
+
+	record.Seq = l.seq + 1
+	record.PrevHash = l.lastHash
+	record.RecordedAt = l.now().UTC()
+	data, err := json.Marshal(record)
+	if err != nil {
+		return 0, fmt.Errorf("error encoding audit record: %s", err.Error())
+	}
+	hash := hashAuditRecord(data)
+	line, err := json.Marshal(&auditEntry{Record: data, Hash: hash})
+	if err != nil {
+		return 0, fmt.Errorf("error encoding audit record: %s", err.Error())
+	}
+	line = append(line, '\n')
+	if _, err := l.file.Write(line); err != nil {
+		// Remove the partially written record so that it is not followed by other records.
+		_ = l.file.Truncate(l.size)
+		return 0, fmt.Errorf("error writing audit log: %s", err.Error())
+	}
+	l.size += int64(len(line))
+	l.seq++
+	l.lastHash = hash
+	return l.seq, nil
+}
+
+// sync - wait until the log is synced to disk up to the record with the given sequence number. The routine that gets
+// to sync first syncs all the records written so far, while the others wait for it, so that concurrent appends share
+// a sync. Once a sync fails, it is unknown which records are on disk, so no record is appended anymore.
+func (l *AuditLog) sync(seq uint64) error {
+	l.syncMutex.Lock()
+	defer l.syncMutex.Unlock()
+	if l.syncedSeq >= seq {
+		return nil
+	}
+
+	// Let the routines that are ready to write a record do it first, so that they share this sync.
+	runtime.Gosched()
+	l.mutex.Lock()
+	lastSeq, err := l.seq, l.failed
+	l.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if l.failed == nil {
+			l.failed = fmt.Errorf("error syncing audit log: %s", err.Error())
+		}
+		return l.failed
+	}
+	l.syncedSeq = lastSeq
+	return nil
+}
+
+// Close - flush the audit log to the disk and close it.
+func (l *AuditLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	err := l.file.Sync()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error closing audit log: %s", err.Error())
+	}
+	return nil
+}
+
+// Head - return the number of records in the audit log and the hash of the last one.
+func (l *AuditLog) Head() *AuditLogSummary {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return &AuditLogSummary{Records: l.seq, Head: l.lastHash}
+}
+
+func hashAuditRecord(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditLogSummary - the result of verifying an audit log.
+type AuditLogSummary struct {
+	// Records - the number of records in the log.
+	Records uint64
+	// Head - the hash of the last record. Keeping it elsewhere allows to detect that records are removed from the end
+	// of the log, which the log cannot tell by itself.
+	Head string
+}
+
+// VerifyAuditLog - check that every record of the given audit log is intact and chained to the previous one, with
+// no gap in their sequence numbers.
+// Params:
+//	path: The file of the audit log.
+// Returns:
+//	*AuditLogSummary: The number of records and the hash of the last one if the log is intact.
+//	error: The first modification or gap found, or any error that occurred during reading the file.
+func VerifyAuditLog(path string) (*AuditLogSummary, error) {
+	summary, err := readAuditLog(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLogSummary{Records: summary.records, Head: summary.head}, nil
+}
+
+// auditLogSummary - what is read from an audit log.
+type auditLogSummary struct {
+	records    uint64
+	head       string
+	size       int64 // The size of the complete records.
+	incomplete bool  // Whether the log ends with an incomplete record.
+}
+
+// readAuditLog - read the audit log in the given file and verify the chain of its records. When strict, a log that
+// ends with an incomplete record is not valid, otherwise the incomplete record is ignored.
+func readAuditLog(path string, strict bool) (*auditLogSummary, error) {
+	summary := &auditLogSummary{head: genesisHash}
+	file, err := os.Open(path)
+	if err != nil {
+		return summary, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	r := bufio.NewReader(file)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) != 0 {
+				if strict {
+					return nil, fmt.Errorf("line %d: incomplete record", lineNumber)
+				}
+				summary.incomplete = true
+			}
+			return summary, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entry := &auditEntry{}
+		if err := json.Unmarshal(bytes.TrimSpace(line), entry); err != nil {
+			return nil, fmt.Errorf("line %d: corrupted record: %s", lineNumber, err.Error())
+		}
+		if hashAuditRecord(entry.Record) != entry.Hash {
+			return nil, fmt.Errorf("line %d: the record has been modified: its hash does not match", lineNumber)
+		}
+		record := &auditRecord{}
+		if err := json.Unmarshal(entry.Record, record); err != nil {
+			return nil, fmt.Errorf("line %d: corrupted record: %s", lineNumber, err.Error())
+		}
+		if record.Seq != summary.records+1 {
+			return nil, fmt.Errorf("line %d: expected record #%d but found record #%d: records are missing or reordered",
+				lineNumber, summary.records+1, record.Seq)
+		}
+		if record.PrevHash != summary.head {
+			return nil, fmt.Errorf("line %d: record #%d is not chained to the previous record", lineNumber, record.Seq)
+		}
+
+		summary.records++
+		summary.head = entry.Hash
+		summary.size += int64(len(line))
+	}
+}
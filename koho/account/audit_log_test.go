@@ -0,0 +1,264 @@
+package account
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestAuditLog(t *testing.T, path string) *AuditLog {
+	auditLog, err := OpenAuditLog(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return auditLog
+}
+
+// readTestAuditRecords - read the records of the given audit log by transaction ID.
+func readTestAuditRecords(t *testing.T, path string) map[identifier]*auditRecord {
+	data, err := ioutil.ReadFile(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	records := make(map[identifier]*auditRecord, 0)
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		entry := &auditEntry{}
+		record := &auditRecord{}
+		if !assert.NoError(t, json.Unmarshal(line, entry)) || !assert.NoError(t, json.Unmarshal(entry.Record, record)) {
+			t.FailNow()
+		}
+		records[record.Transaction.ID] = record
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	dir := newTestStoreDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	path := filepath.Join(dir, "audit.log")
+	auditLog := openTestAuditLog(t, path)
+	runManager(t, NewManager(WithAuditLog(auditLog), WithWorkers(2)), []string{
+		`{"id":"1","customer_id":"1","load_amount":"$3000.00","time":"2000-01-03T00:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$3000.00","time":"2000-01-03T01:00:00Z"}`,
+		`{"id":"1","customer_id":"1","load_amount":"$3000.00","time":"2000-01-03T00:00:00Z"}`,
+		`{"id":"3","customer_id":"2","load_amount":"$1O.00","time":"2000-01-03T00:00:00Z"}`,
+		`{"id":"4","customer_id":"1","type":"withdrawal","load_amount":"$100.00","time":"2000-01-04T00:00:00Z"}`,
+	})
+	assert.Equal(t, uint64(5), auditLog.Head().Records)
+	assert.NoError(t, auditLog.Close())
+
+	records := readTestAuditRecords(t, path)
+	assert.Len(t, records, 4)
+
+	// The aggregates that a transaction is checked against are the ones before the transaction.
+	record := records["2"]
+	assert.False(t, record.Accepted)
+	assert.Equal(t, reasonDailyAmount, record.ReasonCode)
+	assert.Equal(t, "$3000.00", record.Aggregates.Balance)
+	assert.Contains(t, record.Aggregates.Periods,
+		auditPeriod{Period: rulePeriodDay, Key: "2000-1-3", Amount: "$3000.00", Count: 1})
+	assert.Equal(t, []auditCheck{{
+		Rule:       "rule #1",
+		ReasonCode: reasonDailyAmount,
+		Message:    record.Message,
+	}}, record.Checks)
+
+	// Duplicates and invalid transactions are audited without being checked.
+	record = records["1"]
+	assert.True(t, record.Accepted)
+	assert.Equal(t, outcomeDuplicate, record.Outcome)
+	assert.Nil(t, record.Aggregates)
+	assert.Empty(t, record.Checks)
+
+	record = records["3"]
+	assert.False(t, record.Accepted)
+	assert.Equal(t, reasonInvalidInput, record.ReasonCode)
+	assert.Nil(t, record.Aggregates)
+
+	record = records["4"]
+	assert.True(t, record.Accepted)
+	assert.Equal(t, transactionTypeWithdrawal, record.Transaction.Type)
+	assert.Equal(t, "$3000.00", record.Aggregates.Balance)
+	for _, check := range record.Checks {
+		assert.True(t, check.Passed)
+	}
+
+	summary, err := VerifyAuditLog(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), summary.Records)
+}
+
+func TestAuditLogAcrossRuns(t *testing.T) {
+	dir := newTestStoreDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	path := filepath.Join(dir, "audit.log")
+	auditLog := openTestAuditLog(t, path)
+	runManager(t, NewManager(WithAuditLog(auditLog)), []string{
+		`{"id":"1","customer_id":"1","load_amount":"$100.00","time":"2000-01-03T00:00:00Z"}`,
+	})
+	head := auditLog.Head()
+	assert.NoError(t, auditLog.Close())
+
+	// Crash in the middle of writing a record: the incomplete record is removed when the log is opened again.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = file.WriteString(`{"record":{"seq":2,"prev_hash":"`)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	_, err = VerifyAuditLog(path)
+	assert.EqualError(t, err, "line 2: incomplete record")
+
+	// The next run continues the chain of the previous run.
+	auditLog = openTestAuditLog(t, path)
+	assert.Equal(t, head, auditLog.Head())
+	runManager(t, NewManager(WithAuditLog(auditLog)), []string{
+		`{"id":"2","customer_id":"1","load_amount":"$100.00","time":"2000-01-03T01:00:00Z"}`,
+	})
+	assert.NoError(t, auditLog.Close())
+
+	records := readTestAuditRecords(t, path)
+	assert.Equal(t, uint64(2), records["2"].Seq)
+	assert.Equal(t, head.Head, records["2"].PrevHash)
+	summary, err := VerifyAuditLog(path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), summary.Records)
+}
+
+func TestAuditLogSync(t *testing.T) {
+	dir := newTestStoreDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// Concurrent appends return once their records are synced.
+	auditLog := openTestAuditLog(t, filepath.Join(dir, "audit.log"))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			transaction := &loadTransaction{ID: identifier(fmt.Sprintf("%d", i)), CustomerID: "1"}
+			assert.NoError(t, auditLog.append(newAuditRecord(transaction)))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(10), auditLog.syncedSeq)
+	assert.NoError(t, auditLog.Close())
+
+	// Once a sync fails, no record is appended anymore, as it is unknown which records are on disk.
+	reader, writer, err := os.Pipe()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	auditLog = openTestAuditLog(t, filepath.Join(dir, "audit.log"))
+	_ = auditLog.file.Close()
+	auditLog.file = writer
+	err = auditLog.append(newAuditRecord(&loadTransaction{ID: "11", CustomerID: "1"}))
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "error syncing audit log: "), err.Error())
+	}
+	assert.Equal(t, err, auditLog.append(newAuditRecord(&loadTransaction{ID: "12", CustomerID: "1"})))
+	assert.Equal(t, uint64(11), auditLog.Head().Records)
+	_ = auditLog.Close()
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	dir := newTestStoreDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	path := filepath.Join(dir, "audit.log")
+	auditLog := openTestAuditLog(t, path)
+	runManager(t, NewManager(WithAuditLog(auditLog), WithWorkers(1)), []string{
+		`{"id":"1","customer_id":"1","load_amount":"$100.00","time":"2000-01-03T00:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$200.00","time":"2000-01-03T01:00:00Z"}`,
+		`{"id":"3","customer_id":"1","load_amount":"$300.00","time":"2000-01-03T02:00:00Z"}`,
+	})
+	assert.NoError(t, auditLog.Close())
+	data, err := ioutil.ReadFile(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))[:3]
+
+	// rehash - replace the hash of the given line by the hash of its record, as if its record was forged.
+	rehash := func(line []byte) []byte {
+		entry := &auditEntry{}
+		assert.NoError(t, json.Unmarshal(line, entry))
+		entry.Hash = hashAuditRecord(entry.Record)
+		forged, err := json.Marshal(entry)
+		assert.NoError(t, err)
+		return append(forged, '\n')
+	}
+	join := func(lines ...[]byte) []byte {
+		return bytes.Join(lines, nil)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{
+			name: "intact",
+			data: data,
+		},
+		{
+			name: "modified record",
+			data: join(lines[0], bytes.Replace(lines[1], []byte("$200.00"), []byte("$900.00"), 1), lines[2]),
+			err:  "line 2: the record has been modified: its hash does not match",
+		},
+		{
+			name: "modified and rehashed record",
+			data: join(lines[0], rehash(bytes.Replace(lines[1], []byte("$200.00"), []byte("$900.00"), 1)), lines[2]),
+			err:  "line 3: record #3 is not chained to the previous record",
+		},
+		{
+			name: "removed record",
+			data: join(lines[0], lines[2]),
+			err:  "line 2: expected record #2 but found record #3: records are missing or reordered",
+		},
+		{
+			name: "reordered records",
+			data: join(lines[1], lines[0], lines[2]),
+			err:  "line 1: expected record #1 but found record #2: records are missing or reordered",
+		},
+		{
+			name: "corrupted record",
+			data: join(lines[0], []byte("garbage\n"), lines[2]),
+			err:  "line 2: corrupted record: invalid character 'g' looking for beginning of value",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.NoError(t, ioutil.WriteFile(path, test.data, 0644))
+			summary, err := VerifyAuditLog(path)
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(3), summary.Records)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package account
+
+import (
+	"time"
+)
+
+// burstChecker - check whether given transaction is part of a burst: more transactions or more funds than allowed
+// within a short window. A burst can start a cooling-off period, during which every transaction of the same type is
+// declined, whatever its amount.
+type burstChecker struct {
+	window     time.Duration
+	maxFunds   money // No limit if 0.
+	maxTimes   uint  // No limit if 0.
+	coolingOff time.Duration
+	message    string
+}
+
+func newBurstChecker(window time.Duration, maxFunds money, maxTimes uint, coolingOff time.Duration,
+	message string) *burstChecker {
+	return &burstChecker{
+		window:     window,
+		maxFunds:   maxFunds,
+		maxTimes:   maxTimes,
+		coolingOff: coolingOff,
+		message:    message,
+	}
+}
+
+func (c *burstChecker) check(a *customerAccount, t *loadTransaction) error {
+	counters := a.counters(t.Type)
+	if counters.coolingOff(t.Time) {
+		return newDeclineError(reasonCoolingOff, "cooling off after a burst of %ss until %s",
+			t.Type, counters.CoolingOffUntil.Format(time.RFC3339))
+	}
+
+	funds, times := counters.maxWindowTotals(t, c.window)
+	if (c.maxFunds > 0 && funds > c.maxFunds) || (c.maxTimes > 0 && times > c.maxTimes) {
+		if c.coolingOff > 0 {
+			t.tripCoolingOff(t.Time.Add(c.coolingOff))
+		}
+		return newDeclineError(reasonBurst, "%s around %s", c.message, t.Time.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// tripCoolingOff - make the transaction start a cooling-off period that lasts until the given time.
+// The longest cooling-off period wins if several bursts are detected.
+func (t *loadTransaction) tripCoolingOff(until time.Time) {
+	if t.coolingOffUntil == nil || until.After(*t.coolingOffUntil) {
+		t.coolingOffUntil = &until
+	}
+}
+
+// coolOff - start the cooling-off period tripped by the given transaction, if it tripped one, whether the transaction
+// is accepted or not.
+func (a *customerAccount) coolOff(t *loadTransaction) {
+	if t.coolingOffUntil == nil {
+		return
+	}
+	counters := a.counters(t.Type)
+	if counters.CoolingOffUntil == nil || t.coolingOffUntil.After(*counters.CoolingOffUntil) {
+		from, until := t.Time, *t.coolingOffUntil
+		counters.CoolingOffFrom = &from
+		counters.CoolingOffUntil = &until
+	}
+}
+
+// coolingOff - tell whether the given time is in the cooling-off period. A transaction older than the burst that
+// started the period, e.g. a late one, is not part of it.
+func (a *activityCounters) coolingOff(at time.Time) bool {
+	if a.CoolingOffUntil == nil || !at.Before(*a.CoolingOffUntil) {
+		return false
+	}
+	return a.CoolingOffFrom == nil || !at.Before(*a.CoolingOffFrom)
+}
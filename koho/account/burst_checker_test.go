@@ -0,0 +1,127 @@
+package account
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBurstChecker(t *testing.T) {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	history := []loadRecord{
+		{Time: start, Amount: 10000},
+		{Time: start.Add(10 * time.Second), Amount: 10000},
+		{Time: start.Add(20 * time.Second), Amount: 10000},
+	}
+	testCases := []struct {
+		caseName        string
+		transaction     *loadTransaction
+		coolingOffUntil *time.Time
+		err             error
+	}{
+		{
+			caseName:        "A fourth load within 90 seconds is a burst",
+			transaction:     &loadTransaction{Time: start.Add(80 * time.Second), loadAmount: 100},
+			coolingOffUntil: timePtr(start.Add(80*time.Second + time.Hour)),
+			err: newDeclineError(reasonBurst,
+				"exceeds maximum burst (3 transactions or $500.00) in any 1m30s around 2000-01-01T00:01:20Z"),
+		},
+		{
+			caseName:    "A load 90 seconds after the first load is in a new window",
+			transaction: &loadTransaction{Time: start.Add(90 * time.Second), loadAmount: 100},
+		},
+		{
+			caseName:        "A load that exceeds the amount of a burst",
+			transaction:     &loadTransaction{Time: start.Add(time.Hour), loadAmount: 50001},
+			coolingOffUntil: timePtr(start.Add(2 * time.Hour)),
+			err: newDeclineError(reasonBurst,
+				"exceeds maximum burst (3 transactions or $500.00) in any 1m30s around 2000-01-01T01:00:00Z"),
+		},
+	}
+
+	checker := newBurstChecker(90*time.Second, 50000, 3, time.Hour,
+		"exceeds maximum burst (3 transactions or $500.00) in any 1m30s")
+	for _, c := range testCases {
+		err := checker.check(&customerAccount{activityCounters: activityCounters{History: history}}, c.transaction)
+		assert.Equal(t, c.err, err, c.caseName)
+		assert.Equal(t, c.coolingOffUntil, c.transaction.coolingOffUntil, c.caseName)
+	}
+
+	// Any transaction is declined from the burst until the end of the cooling-off period, but not the transactions
+	// before the burst.
+	a := &customerAccount{activityCounters: activityCounters{
+		CoolingOffFrom:  timePtr(start.Add(10 * time.Minute)),
+		CoolingOffUntil: timePtr(start.Add(time.Hour)),
+	}}
+	for _, at := range []time.Duration{10 * time.Minute, 30 * time.Minute} {
+		err := checker.check(a, &loadTransaction{Type: transactionTypeLoad, Time: start.Add(at)})
+		assert.Equal(t, newDeclineError(reasonCoolingOff,
+			"cooling off after a burst of loads until 2000-01-01T01:00:00Z"), err, at.String())
+	}
+	assert.NoError(t, checker.check(a, &loadTransaction{Type: transactionTypeLoad, Time: start}))
+	assert.NoError(t, checker.check(a, &loadTransaction{Type: transactionTypeLoad, Time: start.Add(time.Hour)}))
+}
+
+func TestProcessBursts(t *testing.T) {
+	dir := newTestStoreDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	rules, err := parseRules([]byte(`
+rules:
+  - kind: burst
+    window: 90s
+    count: 3
+    cooling_off: 1h
+    message: too many loads at once
+`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	options := []ManagerOption{WithRules(rules), WithOutputFormat(OutputFormatDetailed), WithWorkers(1)}
+
+	store := openTestStore(t, dir, 0)
+	output := runManager(t, NewManager(append(options, WithAccountStore(store))...), []string{
+		`{"id":"1","customer_id":"1","load_amount":"$10.00","time":"2000-01-03T00:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$10.00","time":"2000-01-03T00:00:10Z"}`,
+		`{"id":"3","customer_id":"1","load_amount":"$10.00","time":"2000-01-03T00:00:20Z"}`,
+		`{"id":"4","customer_id":"1","load_amount":"$10.00","time":"2000-01-03T00:00:30Z"}`,
+		`{"id":"5","customer_id":"1","load_amount":"$10.00","time":"2000-01-03T00:05:00Z"}`,
+		`{"id":"6","customer_id":"1","type":"withdrawal","load_amount":"$10.00","time":"2000-01-03T00:06:00Z"}`,
+		`{"id":"7","customer_id":"2","load_amount":"$10.00","time":"2000-01-03T00:07:00Z"}`,
+	})
+	assert.Equal(t, []string{
+		`{"id":"1","customer_id":"1","accepted":true,"balance":"$10.00"}`,
+		`{"id":"2","customer_id":"1","accepted":true,"balance":"$20.00"}`,
+		`{"id":"3","customer_id":"1","accepted":true,"balance":"$30.00"}`,
+		`{"id":"4","customer_id":"1","accepted":false,"reason_code":"BURST",` +
+			`"message":"too many loads at once around 2000-01-03T00:00:30Z","balance":"$30.00"}`,
+		`{"id":"5","customer_id":"1","accepted":false,"reason_code":"COOLING_OFF",` +
+			`"message":"cooling off after a burst of loads until 2000-01-03T01:00:30Z","balance":"$30.00"}`,
+		`{"id":"6","customer_id":"1","type":"withdrawal","accepted":true,"balance":"$20.00"}`,
+		`{"id":"7","customer_id":"2","accepted":true,"balance":"$10.00"}`,
+	}, output)
+
+	// The cooling-off period survives a crash, as it is replayed from the log, and a restart.
+	store = openTestStore(t, dir, 0)
+	assert.Equal(t, timePtr(time.Date(2000, 1, 3, 1, 0, 30, 0, time.UTC)), store.get("1").CoolingOffUntil)
+	assert.NoError(t, store.Close())
+	store = openTestStore(t, dir, 0)
+	output = runManager(t, NewManager(append(options, WithAccountStore(store))...), []string{
+		`{"id":"8","customer_id":"1","load_amount":"$10.00","time":"2000-01-03T00:59:00Z"}`,
+		`{"id":"9","customer_id":"1","load_amount":"$10.00","time":"2000-01-03T01:00:30Z"}`,
+	})
+	assert.Equal(t, []string{
+		`{"id":"8","customer_id":"1","accepted":false,"reason_code":"COOLING_OFF",` +
+			`"message":"cooling off after a burst of loads until 2000-01-03T01:00:30Z","balance":"$20.00"}`,
+		`{"id":"9","customer_id":"1","accepted":true,"balance":"$30.00"}`,
+	}, output)
+	assert.NoError(t, store.Close())
+}
+
+func timePtr(v time.Time) *time.Time {
+	return &v
+}
@@ -0,0 +1,150 @@
+package account
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// checkpoint - the position of an interrupted run in its input file, and the state needed to resume the run from there
+// without deciding any transaction twice or skipping one.
+type checkpoint struct {
+	InputFile string           `json:"input_file"`
+	Records   int              `json:"records"`             // The number of records of the input file decided so far.
+	Invalid   int              `json:"invalid"`             // The number of invalid records among them.
+	StoreSeq  uint64           `json:"store_seq,omitempty"` // The last decision persisted by a file account store.
+	Accounts  *accountSnapshot `json:"accounts,omitempty"`  // The accounts of a memory account store.
+
+	// The lateness watermarks of the customers seen lately, if some lateness is allowed.
+	Watermarks map[identifier]*watermarkState `json:"watermarks,omitempty"`
+}
+
+// InterruptedError - the processing of an input file is cancelled before its end. The results of the records read
+// so far are written, and so is the checkpoint to resume from if the manager has a checkpoint file.
+type InterruptedError struct {
+	Records int   // The number of records of the input file decided.
+	Err     error // The error of the cancelled context.
+}
+
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("interrupted after %d records: %s", e.Records, e.Err.Error())
+}
+
+// loadCheckpoint - read the manager's checkpoint, which must have been written for the given input file, and restore
+// the accounts recorded in it.
+func (m *ManagerDefault) loadCheckpoint(inputFile string) (*checkpoint, error) {
+	if m.checkpointFile == "" {
+		return nil, fmt.Errorf("no checkpoint file is given")
+	}
+	c, err := readCheckpoint(m.checkpointFile)
+	if err != nil {
+		return nil, err
+	}
+	if c.InputFile != inputFile {
+		return nil, fmt.Errorf("the checkpoint was written for the input file %s", c.InputFile)
+	}
+	if err := m.accountStore.loadCheckpoint(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// saveCheckpoint - write the manager's checkpoint after the given number of records of the given input file are
+// decided, along with the watermarks of the given lateness buffer unless it is nil. It is called once all the
+// decisions are committed.
+func (m *ManagerDefault) saveCheckpoint(inputFile string, records, invalid int, lateness *latenessBuffer) error {
+	c := &checkpoint{InputFile: inputFile, Records: records, Invalid: invalid}
+	if lateness != nil {
+		c.Watermarks = lateness.watermarks()
+	}
+	if err := m.accountStore.saveCheckpoint(c); err != nil {
+		return err
+	}
+	return writeCheckpoint(m.checkpointFile, c)
+}
+
+// removeCheckpoint - remove the manager's checkpoint once the given input file is processed, or once its checkpoint
+// cannot be trusted anymore. A checkpoint written for another input file is kept, so that it can still be resumed.
+func (m *ManagerDefault) removeCheckpoint(inputFile string) error {
+	if !m.resume {
+		// The checkpoint was not resumed from, so it is only removed if it was written for the same input file.
+		if c, err := readCheckpoint(m.checkpointFile); err != nil || c.InputFile != inputFile {
+			return nil
+		}
+	}
+	if err := os.Remove(m.checkpointFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// createOutputFile - create the given output file, or open it to append to it if the processing is resumed.
+func createOutputFile(outputFile string, resume bool) (*os.File, error) {
+	if !resume {
+		return os.Create(outputFile)
+	}
+	return os.OpenFile(outputFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// readCheckpoint - read the checkpoint in the given file.
+func readCheckpoint(checkpointFile string) (*checkpoint, error) {
+	data, err := ioutil.ReadFile(checkpointFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &checkpoint{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("error decoding checkpoint: %s", err.Error())
+	}
+	return c, nil
+}
+
+// writeCheckpoint - write the given checkpoint atomically by writing it to a temporary file and renaming it.
+func writeCheckpoint(checkpointFile string, c *checkpoint) error {
+	file, err := os.Create(checkpointFile + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(file).Encode(c)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(checkpointFile+".tmp", checkpointFile)
+}
+
+// countingTransactionReader - a reader of transactions that counts the records it reads, whether they are valid
+// transactions or not.
+type countingTransactionReader struct {
+	transactionReader
+	records int
+}
+
+func (r *countingTransactionReader) next() (*loadTransaction, error) {
+	transaction, err := r.transactionReader.next()
+	if _, invalid := err.(*invalidRecordError); err == nil || invalid {
+		r.records++
+	}
+	return transaction, err
+}
+
+// skipRecords - read and ignore the given number of records, which were decided before a checkpoint.
+func skipRecords(transactions transactionReader, records int) error {
+	for i := 0; i < records; i++ {
+		_, err := transactions.next()
+		if err == io.EOF {
+			return fmt.Errorf("the input has %d records, but %d were decided before the checkpoint", i, records)
+		}
+		if _, invalid := err.(*invalidRecordError); err != nil && !invalid {
+			return err
+		}
+	}
+	return nil
+}
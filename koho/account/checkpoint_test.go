@@ -0,0 +1,349 @@
+package account
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessResumeFromCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "koho-checkpoint-test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	defer func(stdin *os.File) {
+		os.Stdin = stdin
+	}(os.Stdin)
+
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$4000.00","time":"2000-01-01T00:00:00Z"}`,
+		`{"id":"2","customer_id":"2","load_amount":"$1.00",`,
+		`{"id":"3","customer_id":"2","load_amount":"$100.00","time":"2000-01-01T00:02:00Z"}`,
+		`{"id":"4","customer_id":"1","load_amount":"$500.00","time":"2000-01-01T00:03:00Z"}`,
+		`{"id":"5","customer_id":"1","load_amount":"$1000.00","time":"2000-01-01T00:04:00Z"}`,
+		`{"id":"6","customer_id":"2","type":"withdrawal","load_amount":"$50.00","time":"2000-01-01T00:05:00Z"}`,
+		`{"id":"7","customer_id":"3","load_amount":"4000.00","time":"2000-01-01T00:06:00Z"}`,
+		`{"id":"8","customer_id":"1","load_amount":"$500.00","time":"2000-01-01T00:07:00Z"}`,
+	}
+	inputFile := filepath.Join(dir, "input.txt")
+	if !assert.NoError(t, ioutil.WriteFile(inputFile, []byte(strings.Join(input, "\n")), 0644)) {
+		t.FailNow()
+	}
+
+	testCases := []struct {
+		caseName   string
+		outputFile string
+		stateDir   bool // Whether the accounts are kept in a state directory rather than in memory.
+	}{
+		{
+			caseName:   "Accounts in memory",
+			outputFile: "output.txt",
+		},
+		{
+			caseName:   "Accounts in a state directory",
+			outputFile: "output.txt",
+			stateDir:   true,
+		},
+		{
+			caseName:   "CSV output",
+			outputFile: "output.csv",
+		},
+	}
+
+	for _, c := range testCases {
+		caseDir := filepath.Join(dir, strings.Replace(c.caseName, " ", "-", -1))
+		if !assert.NoError(t, os.Mkdir(caseDir, 0755), c.caseName) {
+			continue
+		}
+		checkpointFile := filepath.Join(caseDir, "checkpoint.json")
+		openStore := func() AccountStore {
+			if !c.stateDir {
+				return NewMemoryAccountStore()
+			}
+			store, err := OpenFileAccountStore(filepath.Join(caseDir, "state"), DefaultSnapshotInterval)
+			assert.NoError(t, err, c.caseName)
+			return store
+		}
+		newManager := func(outputDir string, store AccountStore, resume bool) *ManagerDefault {
+			return NewManager(WithWorkers(2), WithAccountStore(store), WithMaxInvalidRecords(1),
+				WithDeadLetterFile(filepath.Join(outputDir, "dead_letters.txt")),
+				WithCheckpointFile(checkpointFile), WithResume(resume))
+		}
+
+		// The results of an uninterrupted run.
+		baselineDir := filepath.Join(caseDir, "baseline")
+		if !assert.NoError(t, os.Mkdir(baselineDir, 0755), c.caseName) {
+			continue
+		}
+		err := newManager(baselineDir, NewMemoryAccountStore(), false).ProcessLoadTransactions(context.Background(),
+			inputFile, filepath.Join(baselineDir, c.outputFile))
+		assert.Equal(t, &InvalidRecordsError{Invalid: 2, Max: 1}, err, c.caseName)
+
+		// Cancel the processing while the input is being read from the standard input. At most one more record is
+		// read once it is cancelled, so that the run never gets to the end of the input.
+		stdin, writer, err := os.Pipe()
+		if !assert.NoError(t, err, c.caseName) {
+			continue
+		}
+		os.Stdin = stdin
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			_, _ = writer.WriteString(strings.Join(input[:4], "\n") + "\n")
+			cancel()
+			_, _ = writer.WriteString(strings.Join(input[4:], "\n"))
+			_ = writer.Close()
+		}()
+		store := openStore()
+		err = newManager(caseDir, store, false).ProcessLoadTransactions(ctx, StdinInput,
+			filepath.Join(caseDir, c.outputFile))
+		_ = stdin.Close()
+		assert.NoError(t, store.Close(), c.caseName)
+		interruptedErr, ok := err.(*InterruptedError)
+		if !assert.True(t, ok, "%s: %v", c.caseName, err) {
+			continue
+		}
+		assert.True(t, interruptedErr.Records <= 5, c.caseName)
+		assert.FileExists(t, checkpointFile, c.caseName)
+
+		// Resume the processing with the whole input, as if the program was run again.
+		stdin, err = os.Open(inputFile)
+		if !assert.NoError(t, err, c.caseName) {
+			continue
+		}
+		os.Stdin = stdin
+		store = openStore()
+		err = newManager(caseDir, store, true).ProcessLoadTransactions(context.Background(), StdinInput,
+			filepath.Join(caseDir, c.outputFile))
+		_ = stdin.Close()
+		assert.NoError(t, store.Close(), c.caseName)
+		assert.Equal(t, &InvalidRecordsError{Invalid: 2, Max: 1}, err, c.caseName)
+		assert.NoFileExists(t, checkpointFile, c.caseName)
+
+		// No result is duplicated or lost.
+		for _, file := range []string{c.outputFile, "dead_letters.txt"} {
+			expected, err := ioutil.ReadFile(filepath.Join(baselineDir, file))
+			assert.NoError(t, err, c.caseName)
+			actual, err := ioutil.ReadFile(filepath.Join(caseDir, file))
+			assert.NoError(t, err, c.caseName)
+			assert.Equal(t, string(expected), string(actual), "%s: %s", c.caseName, file)
+		}
+	}
+}
+
+func TestProcessResumeFromCheckpointWithLateness(t *testing.T) {
+	dir, err := ioutil.TempDir("", "koho-checkpoint-test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	defer func(stdin *os.File) {
+		os.Stdin = stdin
+	}(os.Stdin)
+
+	// Transactions 6 and 7 are late whether or not the processing is interrupted before them.
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$100.00","time":"2000-01-01T10:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$100.00","time":"2000-01-01T11:30:00Z"}`,
+		`{"id":"3","customer_id":"2","load_amount":"$100.00","time":"2000-01-01T10:00:00Z"}`,
+		`{"id":"4","customer_id":"2","load_amount":"$100.00","time":"2000-01-01T10:10:00Z"}`,
+		`{"id":"5","customer_id":"1","load_amount":"$100.00","time":"2000-01-01T11:40:00Z"}`,
+		`{"id":"6","customer_id":"1","load_amount":"$100.00","time":"2000-01-01T10:20:00Z"}`,
+		`{"id":"7","customer_id":"2","load_amount":"$100.00","time":"2000-01-01T09:00:00Z"}`,
+		`{"id":"8","customer_id":"2","load_amount":"$100.00","time":"2000-01-01T10:30:00Z"}`,
+	}
+	inputFile := filepath.Join(dir, "input.txt")
+	if !assert.NoError(t, ioutil.WriteFile(inputFile, []byte(strings.Join(input, "\n")), 0644)) {
+		t.FailNow()
+	}
+	checkpointFile := filepath.Join(dir, "checkpoint.json")
+	newManager := func(resume bool) *ManagerDefault {
+		return NewManager(WithWorkers(2), WithLateness(time.Hour, LateDecline), WithCheckpointFile(checkpointFile),
+			WithResume(resume))
+	}
+
+	// The results of an uninterrupted run.
+	baselineFile := filepath.Join(dir, "baseline.txt")
+	assert.NoError(t, newManager(false).ProcessLoadTransactions(context.Background(), inputFile, baselineFile))
+
+	// Cancel the processing after the first 4 records are written to the standard input.
+	stdin, writer, err := os.Pipe()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	os.Stdin = stdin
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_, _ = writer.WriteString(strings.Join(input[:4], "\n") + "\n")
+		cancel()
+		_, _ = writer.WriteString(strings.Join(input[4:], "\n"))
+		_ = writer.Close()
+	}()
+	outputFile := filepath.Join(dir, "output.txt")
+	err = newManager(false).ProcessLoadTransactions(ctx, StdinInput, outputFile)
+	_ = stdin.Close()
+	interruptedErr, ok := err.(*InterruptedError)
+	if !assert.True(t, ok, "%v", err) {
+		t.FailNow()
+	}
+	assert.True(t, interruptedErr.Records <= 5)
+
+	// The checkpoint remembers the watermarks of the customers read before the interruption.
+	saved, err := newManager(true).loadCheckpoint(StdinInput)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if interruptedErr.Records > 0 {
+		assert.Contains(t, saved.Watermarks, identifier("1"))
+	}
+
+	// Resume the processing with the whole input, which declines the late transactions exactly like the uninterrupted
+	// run.
+	stdin, err = os.Open(inputFile)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	os.Stdin = stdin
+	err = newManager(true).ProcessLoadTransactions(context.Background(), StdinInput, outputFile)
+	_ = stdin.Close()
+	assert.NoError(t, err)
+
+	expected, err := ioutil.ReadFile(baselineFile)
+	assert.NoError(t, err)
+	actual, err := ioutil.ReadFile(outputFile)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+	assert.Contains(t, string(actual), `{"id":"6","customer_id":"1","accepted":false,"outcome":"late"}`)
+	assert.Contains(t, string(actual), `{"id":"7","customer_id":"2","accepted":false,"outcome":"late"}`)
+}
+
+func TestResumeFromCheckpointErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "koho-checkpoint-test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	inputFile := filepath.Join(dir, "input.txt")
+	outputFile := filepath.Join(dir, "output.txt")
+	checkpointFile := filepath.Join(dir, "checkpoint.json")
+	input := `{"id":"1","customer_id":"1","load_amount":"$1.00","time":"2000-01-01T00:00:00Z"}`
+	if !assert.NoError(t, ioutil.WriteFile(inputFile, []byte(input), 0644)) {
+		t.FailNow()
+	}
+
+	testCases := []struct {
+		caseName   string
+		checkpoint *checkpoint // Nil if there is no checkpoint.
+		err        string
+	}{
+		{
+			caseName: "No checkpoint",
+			err:      "error resuming from checkpoint " + checkpointFile + ": open " + checkpointFile,
+		},
+		{
+			caseName:   "Another input file",
+			checkpoint: &checkpoint{InputFile: "other.txt", Accounts: &accountSnapshot{}},
+			err: "error resuming from checkpoint " + checkpointFile +
+				": the checkpoint was written for the input file other.txt",
+		},
+		{
+			caseName:   "Accounts not in memory",
+			checkpoint: &checkpoint{InputFile: inputFile, StoreSeq: 3},
+			err: "error resuming from checkpoint " + checkpointFile +
+				": the checkpoint holds no accounts, as they were kept in an account store directory",
+		},
+		{
+			caseName:   "More records than the input",
+			checkpoint: &checkpoint{InputFile: inputFile, Records: 2, Accounts: &accountSnapshot{}},
+			err: "error resuming from checkpoint " + checkpointFile +
+				": the input has 1 records, but 2 were decided before the checkpoint",
+		},
+	}
+
+	for _, c := range testCases {
+		_ = os.Remove(checkpointFile)
+		if c.checkpoint != nil && !assert.NoError(t, writeCheckpoint(checkpointFile, c.checkpoint), c.caseName) {
+			continue
+		}
+		err := NewManager(WithCheckpointFile(checkpointFile), WithResume(true)).ProcessLoadTransactions(
+			context.Background(), inputFile, outputFile)
+		if assert.Error(t, err, c.caseName) {
+			assert.True(t, strings.HasPrefix(err.Error(), c.err), "%s: %s", c.caseName, err.Error())
+		}
+	}
+}
+
+func TestRemoveCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "koho-checkpoint-test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	inputFile := filepath.Join(dir, "input.txt")
+	otherFile := filepath.Join(dir, "other.txt")
+	outputFile := filepath.Join(dir, "output.txt")
+	checkpointFile := filepath.Join(dir, "checkpoint.json")
+	input := `{"id":"1","customer_id":"1","load_amount":"$1.00","time":"2000-01-01T00:00:00Z"}`
+	for _, file := range []string{inputFile, otherFile} {
+		if !assert.NoError(t, ioutil.WriteFile(file, []byte(input), 0644)) {
+			t.FailNow()
+		}
+	}
+
+	testCases := []struct {
+		caseName   string
+		checkpoint *checkpoint
+		inputFile  string
+		resume     bool
+		removed    bool
+	}{
+		{
+			caseName:   "Checkpoint of the input file",
+			checkpoint: &checkpoint{InputFile: inputFile, Accounts: &accountSnapshot{}},
+			inputFile:  inputFile,
+			removed:    true,
+		},
+		{
+			caseName:   "Checkpoint resumed from",
+			checkpoint: &checkpoint{InputFile: inputFile, Accounts: &accountSnapshot{}},
+			inputFile:  inputFile,
+			resume:     true,
+			removed:    true,
+		},
+		{
+			caseName:   "Checkpoint of another input file",
+			checkpoint: &checkpoint{InputFile: otherFile, Accounts: &accountSnapshot{}},
+			inputFile:  inputFile,
+		},
+	}
+
+	for _, c := range testCases {
+		if !assert.NoError(t, writeCheckpoint(checkpointFile, c.checkpoint), c.caseName) {
+			continue
+		}
+		err := NewManager(WithCheckpointFile(checkpointFile), WithResume(c.resume)).ProcessLoadTransactions(
+			context.Background(), c.inputFile, outputFile)
+		assert.NoError(t, err, c.caseName)
+		if c.removed {
+			assert.NoFileExists(t, checkpointFile, c.caseName)
+		} else {
+			assert.FileExists(t, checkpointFile, c.caseName)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !darwin && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!freebsd,!linux,!netbsd,!openbsd
+
+package account
+
+import "time"
+
+// cpuTime - the CPU time of the process is not available on this platform.
+func cpuTime() (time.Duration, bool) {
+	return 0, false
+}
@@ -0,0 +1,18 @@
+//go:build darwin || freebsd || linux || netbsd || openbsd
+// +build darwin freebsd linux netbsd openbsd
+
+package account
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuTime - return the user and system CPU time consumed by the process so far.
+func cpuTime() (time.Duration, bool) {
+	usage := syscall.Rusage{}
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, false
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()), true
+}
@@ -0,0 +1,114 @@
+package account
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Customers - the profiles of customers, e.g. the time zones their daily and weekly limits are based on and the tiers
+// that rule expressions can refer to.
+type Customers struct {
+	profiles map[identifier]*customerProfile
+}
+
+// customerProfile - the profile of a customer.
+type customerProfile struct {
+	location *time.Location
+	tier     string
+}
+
+// customersConfig - the YAML document that describes the profiles of customers, indexed by customer IDs.
+type customersConfig struct {
+	Customers map[string]customerConfig `yaml:"customers"`
+}
+
+// customerConfig - the YAML description of a customer's profile.
+type customerConfig struct {
+	TimeZone string `yaml:"time_zone"`
+	Tier     string `yaml:"tier"`
+}
+
+// LoadCustomers - load the profiles of customers from the given YAML file.
+// Params:
+//	customersFile: The YAML file that describes the profiles of customers.
+// Returns:
+//	*Customers: The profiles described in the file.
+//	error: Any error that occurred during reading or validating the file.
+func LoadCustomers(customersFile string) (*Customers, error) {
+	data, err := ioutil.ReadFile(customersFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading customers file %s: %s", customersFile, err.Error())
+	}
+
+	customers, err := parseCustomers(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid customers file %s: %s", customersFile, err.Error())
+	}
+	return customers, nil
+}
+
+// parseCustomers - parse and validate the given YAML customers document.
+func parseCustomers(data []byte) (*Customers, error) {
+	config := customersConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&config); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	customers := &Customers{
+		profiles: make(map[identifier]*customerProfile, len(config.Customers)),
+	}
+	for customerID, customerConfig := range config.Customers {
+		profile := &customerProfile{tier: customerConfig.Tier}
+		if customerConfig.TimeZone != "" {
+			location, err := loadLocation(customerConfig.TimeZone)
+			if err != nil {
+				return nil, fmt.Errorf("customer %s: %s", customerID, err.Error())
+			}
+			profile.location = location
+		}
+		customers.profiles[identifier(customerID)] = profile
+	}
+
+	return customers, nil
+}
+
+// location - return the time zone of the given customer, or nil if the customer does not have one.
+func (c *Customers) location(customerID identifier) *time.Location {
+	if c == nil || c.profiles[customerID] == nil {
+		return nil
+	}
+	return c.profiles[customerID].location
+}
+
+// tier - return the tier of the given customer, or an empty string if the customer does not have one.
+func (c *Customers) tier(customerID identifier) string {
+	if c == nil || c.profiles[customerID] == nil {
+		return ""
+	}
+	return c.profiles[customerID].tier
+}
+
+// LoadTimeZone - load the time zone with the given IANA name, e.g. "America/Toronto".
+func LoadTimeZone(name string) (*time.Location, error) {
+	return loadLocation(name)
+}
+
+func loadLocation(name string) (*time.Location, error) {
+	// `time.LoadLocation` treats an empty name as UTC and "Local" as the time zone of the machine,
+	// neither of which is an IANA time zone.
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("invalid time zone %q", name)
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %s", name, err.Error())
+	}
+	return location, nil
+}
@@ -0,0 +1,60 @@
+package account
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCustomers(t *testing.T) {
+	customers, err := parseCustomers([]byte(`
+customers:
+  "1":
+    time_zone: America/Toronto
+    tier: basic
+  "2": {}
+`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, "America/Toronto", customers.location("1").String())
+	assert.Nil(t, customers.location("2"))
+	assert.Nil(t, customers.location("3"))
+	assert.Equal(t, "basic", customers.tier("1"))
+	assert.Equal(t, "", customers.tier("2"))
+
+	_, err = parseCustomers([]byte(`customers: {"1": {time_zone: Mars/Olympus_Mons}}`))
+	assert.EqualError(t, err, `customer 1: invalid time zone "Mars/Olympus_Mons": unknown time zone Mars/Olympus_Mons`)
+
+	_, err = parseCustomers([]byte(`customers: {"1": {tz: UTC}}`))
+	assert.Error(t, err)
+}
+
+func TestCustomerTimeZones(t *testing.T) {
+	toronto, err := time.LoadLocation("America/Toronto")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	customers, err := parseCustomers([]byte(`customers: {"2": {time_zone: Asia/Tokyo}}`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// The loads at 7pm and 9pm in Toronto are on different days in UTC, and on the same day in Toronto.
+	// Customer 2 is in Tokyo, where the loads are on the same day as well.
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$3000.00","time":"2021-03-15T23:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$3000.00","time":"2021-03-16T01:00:00Z"}`,
+		`{"id":"3","customer_id":"2","load_amount":"$3000.00","time":"2021-03-15T23:00:00Z"}`,
+		`{"id":"4","customer_id":"2","load_amount":"$3000.00","time":"2021-03-16T01:00:00Z"}`,
+	}
+
+	results := decodeResults(t, runManager(t, NewManager(), input))
+	assert.True(t, results["2"].Accepted)
+	assert.True(t, results["4"].Accepted)
+
+	results = decodeResults(t, runManager(t, NewManager(WithTimeZone(toronto), WithCustomers(customers)), input))
+	assert.False(t, results["2"].Accepted)
+	assert.False(t, results["4"].Accepted)
+}
@@ -2,8 +2,7 @@ package account
 
 import (
 	"fmt"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,48 +15,210 @@ func (c identifier) String() string {
 
 // customerAccount - Customer's customerAccount
 type customerAccount struct {
-	CustomerID        identifier
-	DailyLoadedFunds  map[transactionDate]float64
-	WeeklyLoadedFunds map[transactionDate]float64
+	CustomerID       identifier
+	Seq              uint64            // The sequence number of the last transaction persisted to the account store.
+	activityCounters                   // The counters of loads.
+	Withdrawals      *activityCounters `json:",omitempty"`
+	Transfers        *activityCounters `json:",omitempty"`
+	Transactions     map[identifier]*transactionRecord
+	mutex            *sync.Mutex
+	forgetAfter      time.Time // The time of the transactions after which processed transactions are looked up to forget.
+}
+
+// activityCounters - the statistics of a customer's accepted transactions of a type.
+// The field names come from loads, the first type of transactions, and are kept so that persisted accounts
+// can still be read.
+type activityCounters struct {
+	DailyLoadedFunds  map[transactionDate]money
+	WeeklyLoadedFunds map[transactionDate]money
 	DailyLoadedTime   map[transactionDate]uint
+	WeeklyLoadedTime  map[transactionDate]uint
+	History           []loadRecord // The recent accepted transactions ordered by time, for rolling-window limits.
+
+	// The counters of the other calendar periods, e.g. months, indexed by period.
+	PeriodLoadedFunds map[rulePeriod]map[transactionDate]money `json:",omitempty"`
+	PeriodLoadedTime  map[rulePeriod]map[transactionDate]uint  `json:",omitempty"`
+
+	// The cooling-off period started by the last burst of transactions, if there is one. It starts at the time of
+	// the transaction that tripped it, and has no start if it was persisted before cooling-off periods had starts.
+	CoolingOffFrom  *time.Time `json:",omitempty"`
+	CoolingOffUntil *time.Time `json:",omitempty"`
+}
+
+// newCustomerAccount - create an empty account for the given customer.
+func newCustomerAccount(customerID identifier) *customerAccount {
+	return &customerAccount{
+		CustomerID:       customerID,
+		activityCounters: *newActivityCounters(),
+		Transactions:     make(map[identifier]*transactionRecord, 0),
+		mutex:            &sync.Mutex{},
+	}
+}
+
+func newActivityCounters() *activityCounters {
+	return &activityCounters{
+		DailyLoadedFunds:  make(map[transactionDate]money, 0),
+		WeeklyLoadedFunds: make(map[transactionDate]money, 0),
+		DailyLoadedTime:   make(map[transactionDate]uint, 0),
+		WeeklyLoadedTime:  make(map[transactionDate]uint, 0),
+	}
+}
+
+// counters - return the counters of the given type of transactions. The caller must hold the lock of the account.
+func (a *customerAccount) counters(transactionType transactionType) *activityCounters {
+	switch transactionType {
+	case transactionTypeWithdrawal:
+		if a.Withdrawals == nil {
+			a.Withdrawals = newActivityCounters()
+		}
+		return a.Withdrawals
+	case transactionTypeTransfer:
+		if a.Transfers == nil {
+			a.Transfers = newActivityCounters()
+		}
+		return a.Transfers
+	default:
+		return &a.activityCounters
+	}
+}
+
+// remember - record the decision made for the given transaction, so that its duplicates can be detected until it is
+// forgotten.
+func (a *customerAccount) remember(t *loadTransaction, accepted bool) {
+	if t.ID == "" {
+		return
+	}
+	record := &transactionRecord{Fingerprint: t.fingerprint(), Accepted: accepted, Time: &t.Time}
+	if accepted && t.Type != transactionTypeReversal {
+		// Keep what a reversal needs to roll the transaction back.
+		record.Type = t.Type
+		record.RecipientID = t.RecipientID
+		record.Amount = t.loadAmount
+		record.Date = t.currentDate
+		record.Week = t.mondayDateOfCurrentWeek
+	}
+	a.Transactions[t.ID] = record
+}
+
+// apply - update the account with the given accepted transaction, which is counted in the given calendar periods.
+func (a *customerAccount) apply(t *loadTransaction, periods []rulePeriod) {
+	if t.Type == transactionTypeReversal {
+		a.revert(t.original)
+		return
+	}
+	counters := a.counters(t.Type)
+	for _, period := range periods {
+		counters.count(period, t)
+	}
+	counters.addHistory(t)
 }
 
 /****************************************************************************************/
 
-// loadTransaction - a transaction to load funds
-//
+// transactionType - the type of a transaction, each of which has its own velocity limits.
+type transactionType string
+
+const (
+	// transactionTypeLoad - funds are loaded into the customer's account.
+	transactionTypeLoad transactionType = "load"
+	// transactionTypeWithdrawal - funds are withdrawn from the customer's account.
+	transactionTypeWithdrawal transactionType = "withdrawal"
+	// transactionTypeTransfer - funds are transferred from the customer's account to another customer's account.
+	transactionTypeTransfer transactionType = "transfer"
+	// transactionTypeReversal - an accepted transaction of the customer is rolled back, e.g. by a chargeback.
+	transactionTypeReversal transactionType = "reversal"
+)
+
+// loadTransaction - a transaction to load, withdraw or transfer funds. A transaction without a type is a load.
+// The amount of every type of transactions is given in `load_amount`, which is the field of the KOHO format,
+// except reversals, whose amount is the amount of their original transactions.
 type loadTransaction struct {
-	ID                      identifier `json:"id"`
-	CustomerID              identifier `json:"customer_id"`
-	LoadAmount              string     `json:"load_amount"`
-	LoadAmountFloat         float64
-	Time                    time.Time `json:"time"`
+	ID                      identifier      `json:"id"`
+	CustomerID              identifier      `json:"customer_id"`
+	Type                    transactionType `json:"type,omitempty"`
+	RecipientID             identifier      `json:"recipient_id,omitempty"` // The recipient of a transfer.
+	OriginalID              identifier      `json:"original_id,omitempty"`  // The transaction rolled back by a reversal.
+	LoadAmount              string          `json:"load_amount"`
+	Time                    time.Time       `json:"time"`
+	seq                     uint64          // The position of the transaction in the input, starting from 0.
+	loadAmount              money
+	location                *time.Location
 	currentDate             transactionDate
 	mondayDateOfCurrentWeek transactionDate
+	localTime               time.Time          // The time in the time zone that calendar periods are based on.
+	original                *transactionRecord // The transaction rolled back by a reversal, once it is found.
+	customerTier            string             // The tier of the customer, for rule expressions.
+	coolingOffUntil         *time.Time         // The end of the cooling-off period started by the transaction.
+	late                    bool               // The transaction arrived after the lateness watermark passed its time.
+	record                  inputRecord        // The record of the input that the transaction is read from.
 }
 
-func (t *loadTransaction) transformAndValidate() error {
+// transformAndValidate - validate the transaction and derive the fields used by checkers from it.
+// The current date and week are derived in the given time zone, or in the offset of the transaction's time if
+// the given time zone is nil.
+func (t *loadTransaction) transformAndValidate(location *time.Location) error {
 	if t.ID == "" {
 		return fmt.Errorf("transaction's ID is empty")
 	}
 	if t.CustomerID == "" {
 		return fmt.Errorf("transaction's customer ID is empty")
 	}
-	if t.LoadAmount == "" {
-		return fmt.Errorf("transaction's load amount is empty")
+	switch t.Type {
+	case "":
+		t.Type = transactionTypeLoad
+	case transactionTypeLoad, transactionTypeWithdrawal, transactionTypeTransfer, transactionTypeReversal:
+	default:
+		return fmt.Errorf("transaction's type %q is not valid: must be one of %q, %q, %q, %q",
+			t.Type, transactionTypeLoad, transactionTypeWithdrawal, transactionTypeTransfer, transactionTypeReversal)
+	}
+	if t.Type == transactionTypeTransfer {
+		if t.RecipientID == "" {
+			return fmt.Errorf("transfer's recipient ID is empty")
+		}
+		if t.RecipientID == t.CustomerID {
+			return fmt.Errorf("transfer's recipient is the customer themselves")
+		}
+	} else if t.RecipientID != "" {
+		return fmt.Errorf("transaction's recipient ID is not allowed for %q transactions", t.Type)
+	}
+	if t.Type == transactionTypeReversal {
+		if t.OriginalID == "" {
+			return fmt.Errorf("reversal's original ID is empty")
+		}
+		if t.OriginalID == t.ID {
+			return fmt.Errorf("reversal's original ID is the reversal itself")
+		}
+		if t.LoadAmount != "" {
+			return fmt.Errorf("reversal's load amount is not allowed: the amount of the original transaction is reversed")
+		}
+	} else {
+		if t.OriginalID != "" {
+			return fmt.Errorf("transaction's original ID is not allowed for %q transactions", t.Type)
+		}
+		if t.LoadAmount == "" {
+			return fmt.Errorf("transaction's load amount is empty")
+		}
 	}
 	if t.Time.IsZero() {
 		return fmt.Errorf("transaction's time is empty")
 	}
 
-	// Convert money from string format to a float.
-	var err error
-	t.LoadAmountFloat, err = strconv.ParseFloat(strings.TrimSpace(t.LoadAmount[1:]), 64)
-	if err != nil {
-		return fmt.Errorf("transaction's load amount is not a valid number")
+	// Convert money from string format to exact cents.
+	if t.Type != transactionTypeReversal {
+		var err error
+		t.loadAmount, err = parseMoney(t.LoadAmount)
+		if err != nil {
+			return fmt.Errorf("transaction's load amount is not valid: %s", err.Error())
+		}
 	}
-	t.currentDate = dateFromTime(t.Time)
-	t.mondayDateOfCurrentWeek = mondayDateFromTime(t.Time)
+	localTime := t.Time
+	if location != nil {
+		localTime = t.Time.In(location)
+	}
+	t.location = location
+	t.localTime = localTime
+	t.currentDate = dateFromTime(localTime)
+	t.mondayDateOfCurrentWeek = mondayDateFromTime(localTime)
 
 	return nil
 }
@@ -95,41 +256,33 @@ type transactionChecker interface {
 	check(a *customerAccount, t *loadTransaction) error
 }
 
-// dailyLoadFundsChecker - check whether given transaction hit daily load fund limit.
-type dailyLoadFundsChecker struct{}
-
-func (c *dailyLoadFundsChecker) check(a *customerAccount, t *loadTransaction) error {
-	if (a.DailyLoadedFunds[t.currentDate] + t.LoadAmountFloat) > float64(5000) {
-		return fmt.Errorf("exceeds maximum daily load funds ($5,000) on date %s", t.currentDate.String())
-	}
-	return nil
+type loadTransactionResult struct {
+	ID         identifier      `json:"id"`
+	CustomerID identifier      `json:"customer_id"`
+	Type       transactionType `json:"type,omitempty"` // Omitted for loads, so that the KOHO format does not change.
+	OriginalID identifier      `json:"original_id,omitempty"`
+	Accepted   bool            `json:"accepted"`
+	Outcome    resultOutcome   `json:"outcome,omitempty"`
+	Error      error           `json:"-"`
+	dropped    bool            // The result is not written to the output file.
+	headroom   *headroom       // The remaining headroom after the decision, only reported in the detailed format.
+	balance    string          // The customer's balance after the decision, only reported in the detailed format.
+	seq        uint64          // The position of the transaction in the input.
 }
 
-// weeklyFundsChecker - check whether given transaction hit weekly load fund limit.
-type weeklyFundsChecker struct{}
-
-func (c *weeklyFundsChecker) check(a *customerAccount, t *loadTransaction) error {
-	if (a.WeeklyLoadedFunds[t.mondayDateOfCurrentWeek] + t.LoadAmountFloat) > float64(20000) {
-		return fmt.Errorf("exceeds maximum daily load funds ($20,000) on week which monday is %s",
-			t.mondayDateOfCurrentWeek.String())
+// newResult - create an empty result for the transaction.
+func (t *loadTransaction) newResult() *loadTransactionResult {
+	result := &loadTransactionResult{
+		ID:         t.ID,
+		CustomerID: t.CustomerID,
+		OriginalID: t.OriginalID,
+		seq:        t.seq,
 	}
-	return nil
-}
-
-// dailyLoadTimeChecker - check whether given transaction hit daily load time limit.
-type dailyLoadTimeChecker struct{}
-
-func (c *dailyLoadTimeChecker) check(a *customerAccount, t *loadTransaction) error {
-
-	if (a.DailyLoadedTime[t.currentDate] + 1) > 3 {
-		return fmt.Errorf("exceeds maximum daily load time (3) on date %s", t.currentDate.String())
+	if t.Type != transactionTypeLoad {
+		result.Type = t.Type
 	}
-	return nil
-}
-
-type loadTransactionResult struct {
-	ID         identifier `json:"id"`
-	CustomerID identifier `json:"customer_id"`
-	Accepted   bool       `json:"accepted"`
-	Error      error      `json:"-"`
+	if t.late {
+		result.Outcome = outcomeLate
+	}
+	return result
 }
@@ -3,6 +3,7 @@ package account
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -20,13 +21,15 @@ func TestDailyLoadFundsChecker(t *testing.T) {
 			caseName: "The transaction does not exceed daily load fund limit",
 			customerAccount: &customerAccount{
 				CustomerID: customerID,
-				DailyLoadedFunds: map[transactionDate]float64{
-					date: float64(0),
+				activityCounters: activityCounters{
+					DailyLoadedFunds: map[transactionDate]money{
+						date: 0,
+					},
 				},
 			},
 			transaction: &loadTransaction{
-				ID:              "transaction-0",
-				LoadAmountFloat: 555.55,
+				ID:         "transaction-0",
+				loadAmount: 55555,
 			},
 			err: nil,
 		},
@@ -34,22 +37,218 @@ func TestDailyLoadFundsChecker(t *testing.T) {
 			caseName: "The transaction exceeds daily load fund limit",
 			customerAccount: &customerAccount{
 				CustomerID: customerID,
-				DailyLoadedFunds: map[transactionDate]float64{
-					date: 4000.54,
+				activityCounters: activityCounters{
+					DailyLoadedFunds: map[transactionDate]money{
+						date: 400054,
+					},
 				},
 			},
 			transaction: &loadTransaction{
-				ID:              "transaction-1",
-				LoadAmountFloat: 999.47,
-				currentDate:     date,
+				ID:          "transaction-1",
+				loadAmount:  99947,
+				currentDate: date,
 			},
-			err: fmt.Errorf("exceeds maximum daily load funds ($5,000) on date %s", date.String()),
+			err: newDeclineError(reasonDailyAmount, "exceeds maximum daily load funds ($5,000) on date %s", date.String()),
+		},
+		{
+			caseName: "The transaction reaches daily load fund limit exactly",
+			customerAccount: &customerAccount{
+				CustomerID: customerID,
+				activityCounters: activityCounters{
+					DailyLoadedFunds: map[transactionDate]money{
+						date: 400054,
+					},
+				},
+			},
+			transaction: &loadTransaction{
+				ID:          "transaction-2",
+				loadAmount:  99946,
+				currentDate: date,
+			},
+			err: nil,
 		},
 	}
 
-	checker := &dailyLoadFundsChecker{}
+	checker := newPeriodFundsChecker(rulePeriodDay, 500000, "exceeds maximum daily load funds ($5,000)")
 	for _, c := range testCases {
 		err := checker.check(c.customerAccount, c.transaction)
 		assert.Equal(t, c.err, err)
 	}
 }
+
+func TestTransactionDatesInTimeZone(t *testing.T) {
+	toronto, err := time.LoadLocation("America/Toronto")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	testCases := []struct {
+		caseName                string
+		time                    string
+		location                *time.Location
+		currentDate             transactionDate
+		mondayDateOfCurrentWeek transactionDate
+	}{
+		{
+			caseName:                "Without a time zone, the offset of the time is used",
+			time:                    "2021-03-15T03:30:00Z",
+			currentDate:             "2021-3-15",
+			mondayDateOfCurrentWeek: "2021-3-15",
+		},
+		{
+			caseName:                "Sunday evening in Toronto is Monday in UTC",
+			time:                    "2021-03-15T03:30:00Z",
+			location:                toronto,
+			currentDate:             "2021-3-14",
+			mondayDateOfCurrentWeek: "2021-3-8",
+		},
+		{
+			caseName:                "Before switching to daylight saving time, Toronto is UTC-5",
+			time:                    "2021-03-14T04:59:59Z",
+			location:                toronto,
+			currentDate:             "2021-3-13",
+			mondayDateOfCurrentWeek: "2021-3-8",
+		},
+		{
+			caseName:                "Midnight of the day switching to daylight saving time",
+			time:                    "2021-03-14T05:00:00Z",
+			location:                toronto,
+			currentDate:             "2021-3-14",
+			mondayDateOfCurrentWeek: "2021-3-8",
+		},
+		{
+			caseName:                "After switching to daylight saving time, Toronto is UTC-4",
+			time:                    "2021-03-15T03:59:59Z",
+			location:                toronto,
+			currentDate:             "2021-3-14",
+			mondayDateOfCurrentWeek: "2021-3-8",
+		},
+		{
+			caseName:                "Midnight of the day after switching to daylight saving time",
+			time:                    "2021-03-15T04:00:00Z",
+			location:                toronto,
+			currentDate:             "2021-3-15",
+			mondayDateOfCurrentWeek: "2021-3-15",
+		},
+		{
+			caseName:                "Before switching back to standard time, Toronto is UTC-4",
+			time:                    "2021-11-07T03:59:59Z",
+			location:                toronto,
+			currentDate:             "2021-11-6",
+			mondayDateOfCurrentWeek: "2021-11-1",
+		},
+		{
+			caseName:                "The repeated hour of the day switching back to standard time",
+			time:                    "2021-11-07T06:30:00Z",
+			location:                toronto,
+			currentDate:             "2021-11-7",
+			mondayDateOfCurrentWeek: "2021-11-1",
+		},
+		{
+			caseName:                "After switching back to standard time, Toronto is UTC-5",
+			time:                    "2021-11-08T04:59:59Z",
+			location:                toronto,
+			currentDate:             "2021-11-7",
+			mondayDateOfCurrentWeek: "2021-11-1",
+		},
+		{
+			caseName:                "Midnight of the day after switching back to standard time",
+			time:                    "2021-11-08T05:00:00Z",
+			location:                toronto,
+			currentDate:             "2021-11-8",
+			mondayDateOfCurrentWeek: "2021-11-8",
+		},
+	}
+
+	for _, c := range testCases {
+		transactionTime, err := time.Parse(time.RFC3339, c.time)
+		if !assert.NoError(t, err, c.caseName) {
+			continue
+		}
+		transaction := &loadTransaction{ID: "1", CustomerID: "1", LoadAmount: "$1.00", Time: transactionTime}
+		assert.NoError(t, transaction.transformAndValidate(c.location), c.caseName)
+		assert.Equal(t, c.currentDate, transaction.currentDate, c.caseName)
+		assert.Equal(t, c.mondayDateOfCurrentWeek, transaction.mondayDateOfCurrentWeek, c.caseName)
+	}
+}
+
+func TestTransformAndValidateTransactionTypes(t *testing.T) {
+	testCases := []struct {
+		caseName    string
+		transaction *loadTransaction
+		err         error
+	}{
+		{
+			caseName:    "A transaction without a type is a load",
+			transaction: &loadTransaction{},
+		},
+		{
+			caseName:    "A withdrawal",
+			transaction: &loadTransaction{Type: transactionTypeWithdrawal},
+		},
+		{
+			caseName:    "A transfer",
+			transaction: &loadTransaction{Type: transactionTypeTransfer, RecipientID: "2"},
+		},
+		{
+			caseName:    "An unknown type",
+			transaction: &loadTransaction{Type: "deposit"},
+			err: fmt.Errorf(`transaction's type "deposit" is not valid: ` +
+				`must be one of "load", "withdrawal", "transfer", "reversal"`),
+		},
+		{
+			caseName:    "A transfer without a recipient",
+			transaction: &loadTransaction{Type: transactionTypeTransfer},
+			err:         fmt.Errorf("transfer's recipient ID is empty"),
+		},
+		{
+			caseName:    "A transfer to the customer themselves",
+			transaction: &loadTransaction{Type: transactionTypeTransfer, RecipientID: "1"},
+			err:         fmt.Errorf("transfer's recipient is the customer themselves"),
+		},
+		{
+			caseName:    "A load with a recipient",
+			transaction: &loadTransaction{Type: transactionTypeLoad, RecipientID: "2"},
+			err:         fmt.Errorf(`transaction's recipient ID is not allowed for "load" transactions`),
+		},
+		{
+			caseName:    "A reversal",
+			transaction: &loadTransaction{Type: transactionTypeReversal, OriginalID: "0"},
+		},
+		{
+			caseName:    "A reversal without an original",
+			transaction: &loadTransaction{Type: transactionTypeReversal},
+			err:         fmt.Errorf("reversal's original ID is empty"),
+		},
+		{
+			caseName:    "A reversal of itself",
+			transaction: &loadTransaction{Type: transactionTypeReversal, OriginalID: "1"},
+			err:         fmt.Errorf("reversal's original ID is the reversal itself"),
+		},
+		{
+			caseName:    "A reversal with a load amount",
+			transaction: &loadTransaction{Type: transactionTypeReversal, OriginalID: "0", LoadAmount: "$1.00"},
+			err: fmt.Errorf("reversal's load amount is not allowed: " +
+				"the amount of the original transaction is reversed"),
+		},
+		{
+			caseName:    "A withdrawal with an original",
+			transaction: &loadTransaction{Type: transactionTypeWithdrawal, OriginalID: "0"},
+			err:         fmt.Errorf(`transaction's original ID is not allowed for "withdrawal" transactions`),
+		},
+	}
+
+	for _, c := range testCases {
+		c.transaction.ID = "1"
+		c.transaction.CustomerID = "1"
+		if c.transaction.Type != transactionTypeReversal {
+			c.transaction.LoadAmount = "$1.00"
+		}
+		c.transaction.Time = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		err := c.transaction.transformAndValidate(nil)
+		assert.Equal(t, c.err, err, c.caseName)
+		if err == nil {
+			assert.NotEmpty(t, c.transaction.Type, c.caseName)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package account
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+)
+
+// deadLetter - a record of the input that is not a valid transaction, as it is written to the dead-letter file.
+type deadLetter struct {
+	Line   int    `json:"line"`
+	Record string `json:"record"`
+	Error  string `json:"error"`
+}
+
+// deadLetterWriter - a writer of the records of the input that are not valid transactions, one JSON object per line.
+// It counts the invalid records whether it writes them anywhere or not.
+type deadLetterWriter struct {
+	enc     *json.Encoder // Nil if invalid records are only counted.
+	invalid int
+}
+
+// newDeadLetterWriter - create a writer of dead letters to the given output, which can be nil to only count them.
+func newDeadLetterWriter(output io.Writer) *deadLetterWriter {
+	w := &deadLetterWriter{}
+	if output != nil {
+		w.enc = json.NewEncoder(output)
+	}
+	return w
+}
+
+// write - write the record of the given transaction, which is invalid for the given reason.
+func (w *deadLetterWriter) write(t *loadTransaction, reason error) {
+	w.invalid++
+	if w.enc == nil {
+		return
+	}
+	letter := &deadLetter{Line: t.record.line, Record: t.record.raw, Error: reason.Error()}
+	if err := w.enc.Encode(letter); err != nil {
+		log.Printf("error writing the record on line %d to the dead-letter file: %s", t.record.line, err.Error())
+	}
+}
+
+// InvalidRecordsError - the input has more records that are not valid transactions than allowed. It is returned
+// once all the transactions of the input are processed and their results are written.
+type InvalidRecordsError struct {
+	Invalid int // The number of invalid records.
+	Max     int // The maximum number of invalid records allowed.
+}
+
+func (e *InvalidRecordsError) Error() string {
+	return fmt.Sprintf("%d invalid records exceed the maximum of %d", e.Invalid, e.Max)
+}
@@ -0,0 +1,82 @@
+package account
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "koho-dead-letter-test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	inputFile := filepath.Join(dir, "input.txt")
+	outputFile := filepath.Join(dir, "output.txt")
+	deadLetterFile := filepath.Join(dir, "dead_letters.txt")
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$4000.00","time":"2000-01-01T00:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$4000.00",`,
+		``,
+		`{"id":"3","customer_id":"1","load_amount":"4000.00","time":"2000-01-01T00:02:00Z"}`,
+		`{"id":"4","customer_id":"1","load_amount":"$1000.00","time":"2000-01-01T00:03:00Z"}`,
+	}
+	if !assert.NoError(t, ioutil.WriteFile(inputFile, []byte(strings.Join(input, "\n")), 0644)) {
+		t.FailNow()
+	}
+
+	testCases := []struct {
+		caseName   string
+		maxInvalid int
+		err        error
+	}{
+		{
+			caseName:   "No limit of invalid records",
+			maxInvalid: -1,
+		},
+		{
+			caseName:   "Invalid records within the limit",
+			maxInvalid: 2,
+		},
+		{
+			caseName:   "Invalid records over the limit",
+			maxInvalid: 1,
+			err:        &InvalidRecordsError{Invalid: 2, Max: 1},
+		},
+	}
+
+	for _, c := range testCases {
+		m := NewManager(WithDeadLetterFile(deadLetterFile), WithMaxInvalidRecords(c.maxInvalid))
+		assert.Equal(t, c.err, m.ProcessLoadTransactions(context.Background(), inputFile, outputFile), c.caseName)
+
+		// Invalid records are declined in the output whether the limit is exceeded or not, and they are not counted
+		// towards the daily limit of the customer.
+		output, err := ioutil.ReadFile(outputFile)
+		assert.NoError(t, err, c.caseName)
+		assert.Equal(t, []string{
+			`{"id":"1","customer_id":"1","accepted":true}`,
+			`{"id":"","customer_id":"","accepted":false}`,
+			`{"id":"3","customer_id":"1","accepted":false}`,
+			`{"id":"4","customer_id":"1","accepted":true}`,
+		}, strings.Split(strings.TrimSpace(string(output)), "\n"), c.caseName)
+
+		deadLetters, err := ioutil.ReadFile(deadLetterFile)
+		assert.NoError(t, err, c.caseName)
+		assert.Equal(t, []string{
+			`{"line":2,"record":"{\"id\":\"2\",\"customer_id\":\"1\",\"load_amount\":\"$4000.00\",",` +
+				`"error":"unexpected end of JSON input"}`,
+			`{"line":4,"record":"{\"id\":\"3\",\"customer_id\":\"1\",\"load_amount\":\"4000.00\",` +
+				`\"time\":\"2000-01-01T00:02:00Z\"}","error":"transaction's load amount is not valid: ` +
+				`money \"4000.00\" must start with '$'"}`,
+		}, strings.Split(strings.TrimSpace(string(deadLetters)), "\n"), c.caseName)
+	}
+}
@@ -0,0 +1,140 @@
+package account
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// defaultDuplicateRetention - the default period that an account remembers processed transaction IDs for.
+	defaultDuplicateRetention = 30 * 24 * time.Hour
+	// defaultReversalWindow - the default period after an accepted transaction during which it can be reversed.
+	defaultReversalWindow = 120 * 24 * time.Hour
+	// forgetInterval - how often, in transaction time, an account looks for the processed transactions to forget.
+	forgetInterval = 24 * time.Hour
+)
+
+// DuplicatePolicy - what to do with a transaction whose ID has already been processed for the same customer.
+// A duplicate is never checked against the velocity limits nor counted in the customer's account.
+type DuplicatePolicy string
+
+const (
+	// DuplicateReplay - report the decision made for the original transaction again.
+	DuplicateReplay DuplicatePolicy = "replay"
+	// DuplicateDecline - report the duplicate as declined.
+	DuplicateDecline DuplicatePolicy = "decline"
+	// DuplicateDrop - do not write any result for the duplicate to the output file.
+	DuplicateDrop DuplicatePolicy = "drop"
+)
+
+// ParseDuplicatePolicy - parse the given duplicate policy name.
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(s); policy {
+	case DuplicateReplay, DuplicateDecline, DuplicateDrop:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid duplicate policy %q: must be one of %q, %q, %q",
+			s, DuplicateReplay, DuplicateDecline, DuplicateDrop)
+	}
+}
+
+// resultOutcome - tells how a transaction result was produced when it is not a regular decision.
+type resultOutcome string
+
+const (
+	// outcomeDuplicate - the transaction is identical to a transaction processed before.
+	outcomeDuplicate resultOutcome = "duplicate"
+	// outcomeConflict - the transaction has the ID of a transaction processed before but a different payload.
+	outcomeConflict resultOutcome = "conflict"
+)
+
+// transactionRecord - what an account remembers about a processed transaction.
+// The other fields of an accepted transaction are kept for rolling it back until the end of its reversal window,
+// and are empty for a reversal.
+type transactionRecord struct {
+	Fingerprint string          `json:"fingerprint"`
+	Accepted    bool            `json:"accepted"`
+	Type        transactionType `json:"type,omitempty"`
+	RecipientID identifier      `json:"recipient_id,omitempty"`
+	Amount      money           `json:"amount,omitempty"`
+	Date        transactionDate `json:"date,omitempty"`
+	Week        transactionDate `json:"week,omitempty"`
+	Time        *time.Time      `json:"time,omitempty"` // Nil if the record was persisted before records had times.
+	Reversed    bool            `json:"reversed,omitempty"`
+}
+
+// forget - forget the processed transactions that are out of both the duplicate retention and the reversal window
+// at the given time, as well as what is kept for rolling back the ones out of the reversal window only. It scans
+// the transactions at most once per `forgetInterval` of transaction time. The caller must hold the lock of the account.
+func (a *customerAccount) forget(now time.Time, duplicateRetention, reversalWindow time.Duration) {
+	if now.Before(a.forgetAfter) {
+		return
+	}
+	a.forgetAfter = now.Add(forgetInterval)
+
+	for id, record := range a.Transactions {
+		if record.Time == nil {
+			// A record persisted without a time is remembered for the whole retention from now on.
+			recorded := now
+			record.Time = &recorded
+			continue
+		}
+		age := now.Sub(*record.Time)
+		if age > duplicateRetention && age > reversalWindow {
+			delete(a.Transactions, id)
+		} else if age > reversalWindow && record.Type != "" {
+			*record = transactionRecord{Fingerprint: record.Fingerprint, Accepted: record.Accepted, Time: record.Time}
+		}
+	}
+}
+
+// fingerprint - identify the payload of the transaction, so that an identical duplicate can be told from
+// a conflicting one. The fingerprint of a load does not include its type, so that it matches the fingerprints
+// persisted before transactions had types.
+func (t *loadTransaction) fingerprint() string {
+	fingerprint := fmt.Sprintf("%s|%s", t.LoadAmount, t.Time.UTC().Format(time.RFC3339Nano))
+	if t.Type == transactionTypeTransfer {
+		fingerprint = fmt.Sprintf("%s|%s|%s", t.Type, t.RecipientID, fingerprint)
+	} else if t.Type == transactionTypeReversal {
+		fingerprint = fmt.Sprintf("%s|%s|%s", t.Type, t.OriginalID, fingerprint)
+	} else if t.Type != transactionTypeLoad {
+		fingerprint = fmt.Sprintf("%s|%s", t.Type, fingerprint)
+	}
+	return fingerprint
+}
+
+// checkDuplicate - check whether the given transaction has been processed for the customer.
+// Params:
+//	a: The account of the customer who owns the transaction.
+//	t: The transaction that needs to be checked.
+// Returns:
+//	*loadTransactionResult: The result of the transaction if it is a duplicate, otherwise nil.
+func (m *ManagerDefault) checkDuplicate(a *customerAccount, t *loadTransaction) *loadTransactionResult {
+	record := a.Transactions[t.ID]
+	if record == nil || record.Time != nil && t.Time.Sub(*record.Time) > m.duplicateRetention {
+		return nil
+	}
+
+	result := t.newResult()
+	result.Outcome = outcomeDuplicate
+	policy := m.identicalDuplicatePolicy
+	if record.Fingerprint != t.fingerprint() {
+		result.Outcome = outcomeConflict
+		policy = m.conflictingDuplicatePolicy
+	}
+
+	switch policy {
+	case DuplicateReplay:
+		result.Accepted = record.Accepted
+	case DuplicateDrop:
+		result.dropped = true
+	}
+	if !result.Accepted {
+		code := reasonDuplicate
+		if result.Outcome == outcomeConflict {
+			code = reasonConflict
+		}
+		result.Error = newDeclineError(code, "transaction ID %s has been processed (%s)", t.ID.String(), result.Outcome)
+	}
+	return result
+}
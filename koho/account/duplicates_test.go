@@ -0,0 +1,157 @@
+package account
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDuplicateTransactions(t *testing.T) {
+	// Transactions of a single customer, so results are written in the input order.
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$1000.00","time":"2000-01-03T01:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$4500.00","time":"2000-01-03T02:00:00Z"}`,
+		`{"id":"1","customer_id":"1","load_amount":"$1000.00","time":"2000-01-03T01:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$4500.00","time":"2000-01-03T02:00:00Z"}`,
+		`{"id":"1","customer_id":"1","load_amount":"$1.00","time":"2000-01-03T01:00:00Z"}`,
+		`{"id":"3","customer_id":"1","load_amount":"$1000.00","time":"2000-01-03T03:00:00Z"}`,
+		`{"id":"4","customer_id":"1","load_amount":"$1000.00","time":"2000-01-03T04:00:00Z"}`,
+		`{"id":"5","customer_id":"1","load_amount":"$1000.00","time":"2000-01-03T05:00:00Z"}`,
+	}
+
+	testCases := []struct {
+		caseName    string
+		identical   DuplicatePolicy
+		conflicting DuplicatePolicy
+		output      []string
+	}{
+		{
+			caseName:    "Replay identical duplicates and decline conflicting ones",
+			identical:   DuplicateReplay,
+			conflicting: DuplicateDecline,
+			output: []string{
+				`{"id":"1","customer_id":"1","accepted":true}`,
+				`{"id":"2","customer_id":"1","accepted":false}`,
+				`{"id":"1","customer_id":"1","accepted":true,"outcome":"duplicate"}`,
+				`{"id":"2","customer_id":"1","accepted":false,"outcome":"duplicate"}`,
+				`{"id":"1","customer_id":"1","accepted":false,"outcome":"conflict"}`,
+				`{"id":"3","customer_id":"1","accepted":true}`,
+				`{"id":"4","customer_id":"1","accepted":true}`,
+				`{"id":"5","customer_id":"1","accepted":false}`,
+			},
+		},
+		{
+			caseName:    "Decline identical duplicates and drop conflicting ones",
+			identical:   DuplicateDecline,
+			conflicting: DuplicateDrop,
+			output: []string{
+				`{"id":"1","customer_id":"1","accepted":true}`,
+				`{"id":"2","customer_id":"1","accepted":false}`,
+				`{"id":"1","customer_id":"1","accepted":false,"outcome":"duplicate"}`,
+				`{"id":"2","customer_id":"1","accepted":false,"outcome":"duplicate"}`,
+				`{"id":"3","customer_id":"1","accepted":true}`,
+				`{"id":"4","customer_id":"1","accepted":true}`,
+				`{"id":"5","customer_id":"1","accepted":false}`,
+			},
+		},
+		{
+			caseName:    "Drop identical duplicates and replay conflicting ones",
+			identical:   DuplicateDrop,
+			conflicting: DuplicateReplay,
+			output: []string{
+				`{"id":"1","customer_id":"1","accepted":true}`,
+				`{"id":"2","customer_id":"1","accepted":false}`,
+				`{"id":"1","customer_id":"1","accepted":true,"outcome":"conflict"}`,
+				`{"id":"3","customer_id":"1","accepted":true}`,
+				`{"id":"4","customer_id":"1","accepted":true}`,
+				`{"id":"5","customer_id":"1","accepted":false}`,
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		output := runManager(t, NewManager(WithDuplicatePolicies(c.identical, c.conflicting)), input)
+		assert.Equal(t, c.output, output, c.caseName)
+	}
+}
+
+func TestConflictingTransactionOfFixture(t *testing.T) {
+	// Customer 562 reuses the ID 6928 of a declined load for another load 25 days later in input.txt, which is
+	// declined as a conflict rather than checked against the limits.
+	input := []string{
+		`{"id":"6928","customer_id":"562","load_amount":"$5255.16","time":"2000-01-05T14:27:36Z"}`,
+		`{"id":"6928","customer_id":"562","load_amount":"$3164.98","time":"2000-01-30T05:37:32Z"}`,
+	}
+	assert.Equal(t, []string{
+		`{"id":"6928","customer_id":"562","accepted":false}`,
+		`{"id":"6928","customer_id":"562","accepted":false,"outcome":"conflict"}`,
+	}, runManager(t, NewManager(), input))
+
+	// It is a new transaction once the ID is forgotten.
+	assert.Equal(t, []string{
+		`{"id":"6928","customer_id":"562","accepted":false}`,
+		`{"id":"6928","customer_id":"562","accepted":true}`,
+	}, runManager(t, NewManager(WithDuplicateRetention(24*time.Hour)), input))
+}
+
+func TestDuplicateRetentionAndReversalWindow(t *testing.T) {
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$100.00","time":"2000-01-03T00:00:00Z"}`,
+		`{"id":"2","customer_id":"1","type":"reversal","original_id":"1","time":"2000-01-04T01:00:00Z"}`,
+		`{"id":"1","customer_id":"1","load_amount":"$200.00","time":"2000-01-04T02:00:00Z"}`,
+		`{"id":"1","customer_id":"1","load_amount":"$300.00","time":"2000-01-06T00:00:00Z"}`,
+	}
+	m := NewManager(WithDuplicateRetention(48*time.Hour), WithReversalWindow(24*time.Hour),
+		WithOutputFormat(OutputFormatDetailed), WithWorkers(1))
+	assert.Equal(t, []string{
+		`{"id":"1","customer_id":"1","accepted":true,"headroom":` +
+			`{"daily_amount":"$4900.00","weekly_amount":"$19900.00","daily_count":2},"balance":"$100.00"}`,
+		`{"id":"2","customer_id":"1","type":"reversal","original_id":"1","accepted":false,` +
+			`"reason_code":"UNKNOWN_ORIGINAL","message":"transaction 1 is too old to reverse: it was processed at ` +
+			`2000-01-03T00:00:00Z","balance":"$100.00"}`,
+		`{"id":"1","customer_id":"1","accepted":false,"outcome":"conflict","reason_code":"CONFLICT",` +
+			`"message":"transaction ID 1 has been processed (conflict)","headroom":` +
+			`{"daily_amount":"$5000.00","weekly_amount":"$19900.00","daily_count":3},"balance":"$100.00"}`,
+		`{"id":"1","customer_id":"1","accepted":true,"headroom":` +
+			`{"daily_amount":"$4700.00","weekly_amount":"$19600.00","daily_count":2},"balance":"$400.00"}`,
+	}, runManager(t, m, input))
+
+	// Processed transactions are forgotten once they are out of both periods, and what is kept for rolling back
+	// a transaction is forgotten once it is out of the reversal window.
+	start := time.Date(2000, 1, 3, 0, 0, 0, 0, time.UTC)
+	a := newCustomerAccount("1")
+	a.remember(&loadTransaction{ID: "1", Type: transactionTypeLoad, Time: start, loadAmount: 100}, true)
+	a.remember(&loadTransaction{ID: "2", Type: transactionTypeLoad, Time: start.Add(2 * time.Hour)}, false)
+	a.Transactions["3"] = &transactionRecord{Fingerprint: "legacy", Accepted: true}
+
+	a.forget(start.Add(25*time.Hour), 48*time.Hour, 24*time.Hour)
+	assert.Equal(t, &transactionRecord{Fingerprint: a.Transactions["1"].Fingerprint, Accepted: true,
+		Time: timePtr(start)}, a.Transactions["1"])
+	assert.Equal(t, timePtr(start.Add(25*time.Hour)), a.Transactions["3"].Time)
+	assert.Len(t, a.Transactions, 3)
+
+	a.forget(start.Add(48*time.Hour+30*time.Minute), 48*time.Hour, 24*time.Hour)
+	assert.Len(t, a.Transactions, 3, "forgotten at most once a day")
+	a.forget(start.Add(51*time.Hour), 48*time.Hour, 24*time.Hour)
+	assert.Equal(t, []identifier{"3"}, transactionIDs(a))
+}
+
+// transactionIDs - return the IDs of the transactions remembered by the given account, in any order.
+func transactionIDs(a *customerAccount) []identifier {
+	ids := make([]identifier, 0, len(a.Transactions))
+	for id := range a.Transactions {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestParseDuplicatePolicy(t *testing.T) {
+	policy, err := ParseDuplicatePolicy("drop")
+	assert.NoError(t, err)
+	assert.Equal(t, DuplicateDrop, policy)
+
+	_, err = ParseDuplicatePolicy("ignore")
+	assert.Equal(t, fmt.Errorf(`invalid duplicate policy "ignore": must be one of "replay", "decline", "drop"`), err)
+}
@@ -0,0 +1,734 @@
+package account
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rule expressions are a small language for velocity limits that are not built in, e.g.
+// `sum(amount, day) + amount > 5000 && customer.tier == "basic"`. An expression is type checked when the rules
+// are loaded and can only read the transaction and the aggregates of the customer's account, so it cannot change
+// anything nor run for long: there are no loops, and the length and nesting depth of an expression are limited.
+
+const (
+	// maxExpressionLength - the maximum number of characters in an expression.
+	maxExpressionLength = 1000
+	// maxExpressionDepth - the maximum nesting depth of an expression.
+	maxExpressionDepth = 32
+)
+
+// exprType - the type of the value of an expression.
+type exprType int
+
+const (
+	exprNumber exprType = iota
+	exprString
+	exprBool
+	exprPeriod
+)
+
+func (t exprType) String() string {
+	switch t {
+	case exprNumber:
+		return "number"
+	case exprString:
+		return "string"
+	case exprBool:
+		return "boolean"
+	default:
+		return "period"
+	}
+}
+
+// exprValue - the value of an expression. Numbers are fixed-point with two decimals, like money, so amounts
+// are exact.
+type exprValue struct {
+	num int64
+	str string
+	b   bool
+}
+
+// exprEnv - what an expression is evaluated against.
+type exprEnv struct {
+	a *customerAccount
+	t *loadTransaction
+}
+
+// exprVariable - a name that an expression can read.
+type exprVariable struct {
+	typ exprType
+	get func(env *exprEnv) exprValue
+}
+
+// exprVariables - the names that an expression can read.
+var exprVariables = map[string]exprVariable{
+	"amount": {exprNumber, func(env *exprEnv) exprValue {
+		return exprValue{num: int64(env.t.loadAmount)}
+	}},
+	"type": {exprString, func(env *exprEnv) exprValue {
+		return exprValue{str: string(env.t.Type)}
+	}},
+	"recipient": {exprString, func(env *exprEnv) exprValue {
+		return exprValue{str: env.t.RecipientID.String()}
+	}},
+	"hour": {exprNumber, func(env *exprEnv) exprValue {
+		return exprValue{num: int64(env.t.localTime.Hour()) * 100}
+	}},
+	"weekday": {exprString, func(env *exprEnv) exprValue {
+		return exprValue{str: strings.ToLower(env.t.localTime.Weekday().String())}
+	}},
+	"customer.id": {exprString, func(env *exprEnv) exprValue {
+		return exprValue{str: env.t.CustomerID.String()}
+	}},
+	"customer.tier": {exprString, func(env *exprEnv) exprValue {
+		return exprValue{str: env.t.customerTier}
+	}},
+}
+
+// exprPeriods - the calendar periods that aggregates can be taken over.
+var exprPeriods = map[string]rulePeriod{
+	"day":     rulePeriodDay,
+	"week":    rulePeriodWeek,
+	"month":   rulePeriodMonth,
+	"quarter": rulePeriodQuarter,
+	"year":    rulePeriodYear,
+}
+
+// exprError - an error at the given column of an expression.
+func exprError(pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("column %d: %s", pos+1, fmt.Sprintf(format, args...))
+}
+
+/****************************************************************************************/
+
+// exprToken - a token of an expression.
+type exprToken struct {
+	kind exprTokenKind
+	text string
+	pos  int
+}
+
+type exprTokenKind int
+
+const (
+	tokenEOF exprTokenKind = iota
+	tokenNumber
+	tokenString
+	tokenName
+	tokenOperator
+)
+
+// exprOperators - the operators and punctuation of expressions, longest first.
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "!", "(", ")", ","}
+
+// lexExpression - split the given expression into tokens.
+func lexExpression(src string) ([]exprToken, error) {
+	tokens := make([]exprToken, 0)
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokenNumber, text: src[start:i], pos: start})
+		case c == '"':
+			start := i
+			var text strings.Builder
+			for i++; ; i++ {
+				if i >= len(src) {
+					return nil, exprError(start, "string is not terminated")
+				}
+				if src[i] == '"' {
+					i++
+					break
+				}
+				if src[i] == '\\' && i+1 < len(src) && (src[i+1] == '"' || src[i+1] == '\\') {
+					i++
+				}
+				text.WriteByte(src[i])
+			}
+			tokens = append(tokens, exprToken{kind: tokenString, text: text.String(), pos: start})
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] == '.' || src[i] >= 'a' && src[i] <= 'z' ||
+				src[i] >= 'A' && src[i] <= 'Z' || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokenName, text: src[start:i], pos: start})
+		default:
+			operator := ""
+			for _, op := range exprOperators {
+				if strings.HasPrefix(src[i:], op) {
+					operator = op
+					break
+				}
+			}
+			if operator == "" {
+				return nil, exprError(i, "unexpected character %q", c)
+			}
+			tokens = append(tokens, exprToken{kind: tokenOperator, text: operator, pos: i})
+			i += len(operator)
+		}
+	}
+	return append(tokens, exprToken{kind: tokenEOF, pos: len(src)}), nil
+}
+
+// parseExprNumber - parse a number with at most two decimals into a fixed-point number.
+func parseExprNumber(token exprToken) (int64, error) {
+	parts := strings.Split(token.text, ".")
+	if len(parts) > 2 || len(parts) == 2 && (len(parts[1]) == 0 || len(parts[1]) > 2) {
+		return 0, exprError(token.pos, "invalid number %s: must have at most two decimals", token.text)
+	}
+	units, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, exprError(token.pos, "invalid number %s", token.text)
+	}
+	cents := int64(0)
+	if len(parts) == 2 {
+		fraction := parts[1]
+		if len(fraction) == 1 {
+			fraction += "0"
+		}
+		cents, _ = strconv.ParseInt(fraction, 10, 64)
+	}
+	if units > int64(maxMoney)/100 {
+		return 0, exprError(token.pos, "invalid number %s: must be at most %d", token.text, int64(maxMoney)/100)
+	}
+	return units*100 + cents, nil
+}
+
+// mulExprNumbers - multiply the given integers, or return false if the product overflows int64.
+func mulExprNumbers(x, y int64) (int64, bool) {
+	if x == 0 || y == 0 {
+		return 0, true
+	}
+	product := x * y
+	if product/y != x || x == -1 && y == math.MinInt64 || y == -1 && x == math.MinInt64 {
+		return 0, false
+	}
+	return product, true
+}
+
+// addExprNumbers - add the given integers, or return false if the sum overflows int64.
+func addExprNumbers(x, y int64) (int64, bool) {
+	sum := x + y
+	if x > 0 && y > 0 && sum < 0 || x < 0 && y < 0 && sum >= 0 {
+		return 0, false
+	}
+	return sum, true
+}
+
+/****************************************************************************************/
+
+// exprNode - a node of the syntax tree of an expression. A node is evaluated only after it is type checked.
+type exprNode interface {
+	pos() int
+	check() (exprType, error)
+	eval(env *exprEnv) (exprValue, error)
+}
+
+type exprLiteral struct {
+	at    int
+	typ   exprType
+	value exprValue
+}
+
+func (n *exprLiteral) pos() int                             { return n.at }
+func (n *exprLiteral) check() (exprType, error)             { return n.typ, nil }
+func (n *exprLiteral) eval(env *exprEnv) (exprValue, error) { return n.value, nil }
+
+type exprPeriodName struct {
+	at     int
+	period rulePeriod
+}
+
+func (n *exprPeriodName) pos() int                 { return n.at }
+func (n *exprPeriodName) check() (exprType, error) { return exprPeriod, nil }
+func (n *exprPeriodName) eval(env *exprEnv) (exprValue, error) {
+	return exprValue{str: string(n.period)}, nil
+}
+
+type exprVariableRef struct {
+	at       int
+	name     string
+	variable exprVariable
+}
+
+func (n *exprVariableRef) pos() int                             { return n.at }
+func (n *exprVariableRef) check() (exprType, error)             { return n.variable.typ, nil }
+func (n *exprVariableRef) eval(env *exprEnv) (exprValue, error) { return n.variable.get(env), nil }
+
+type exprUnary struct {
+	at int
+	op string
+	x  exprNode
+}
+
+func (n *exprUnary) pos() int { return n.at }
+
+func (n *exprUnary) check() (exprType, error) {
+	typ, err := n.x.check()
+	if err != nil {
+		return 0, err
+	}
+	want := exprNumber
+	if n.op == "!" {
+		want = exprBool
+	}
+	if typ != want {
+		return 0, exprError(n.at, "operator %q needs a %s but got a %s", n.op, want, typ)
+	}
+	return want, nil
+}
+
+func (n *exprUnary) eval(env *exprEnv) (exprValue, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return x, err
+	}
+	if n.op == "!" {
+		return exprValue{b: !x.b}, nil
+	}
+	if x.num == math.MinInt64 {
+		return exprValue{}, exprError(n.at, "operator %q overflows", n.op)
+	}
+	return exprValue{num: -x.num}, nil
+}
+
+type exprBinary struct {
+	at   int
+	op   string
+	x, y exprNode
+	typ  exprType // The type of the operands, known once the node is type checked.
+}
+
+func (n *exprBinary) pos() int { return n.at }
+
+func (n *exprBinary) check() (exprType, error) {
+	x, err := n.x.check()
+	if err != nil {
+		return 0, err
+	}
+	y, err := n.y.check()
+	if err != nil {
+		return 0, err
+	}
+	n.typ = x
+
+	switch n.op {
+	case "&&", "||":
+		if x != exprBool || y != exprBool {
+			return 0, exprError(n.at, "operator %q needs booleans but got a %s and a %s", n.op, x, y)
+		}
+		return exprBool, nil
+	case "==", "!=":
+		if x != y || x == exprPeriod {
+			return 0, exprError(n.at, "cannot compare a %s with a %s", x, y)
+		}
+		return exprBool, nil
+	case "<", "<=", ">", ">=":
+		if x != exprNumber || y != exprNumber {
+			return 0, exprError(n.at, "operator %q needs numbers but got a %s and a %s", n.op, x, y)
+		}
+		return exprBool, nil
+	default:
+		if x != exprNumber || y != exprNumber {
+			return 0, exprError(n.at, "operator %q needs numbers but got a %s and a %s", n.op, x, y)
+		}
+		return exprNumber, nil
+	}
+}
+
+func (n *exprBinary) eval(env *exprEnv) (exprValue, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return x, err
+	}
+	// Logical operators short-circuit.
+	switch {
+	case n.op == "&&" && !x.b:
+		return exprValue{b: false}, nil
+	case n.op == "||" && x.b:
+		return exprValue{b: true}, nil
+	}
+	y, err := n.y.eval(env)
+	if err != nil {
+		return y, err
+	}
+
+	switch n.op {
+	case "&&", "||":
+		return exprValue{b: y.b}, nil
+	case "==":
+		return exprValue{b: x == y}, nil
+	case "!=":
+		return exprValue{b: x != y}, nil
+	case "<":
+		return exprValue{b: x.num < y.num}, nil
+	case "<=":
+		return exprValue{b: x.num <= y.num}, nil
+	case ">":
+		return exprValue{b: x.num > y.num}, nil
+	case ">=":
+		return exprValue{b: x.num >= y.num}, nil
+	}
+
+	// Numbers are fixed-point with two decimals, so a product is scaled down and a dividend is scaled up.
+	var num int64
+	ok := true
+	switch n.op {
+	case "+":
+		num, ok = addExprNumbers(x.num, y.num)
+	case "-":
+		if y.num == math.MinInt64 {
+			ok = false
+		} else {
+			num, ok = addExprNumbers(x.num, -y.num)
+		}
+	case "*":
+		num, ok = mulExprNumbers(x.num, y.num)
+		num /= 100
+	default:
+		if y.num == 0 {
+			return exprValue{}, exprError(n.at, "division by zero")
+		}
+		num, ok = mulExprNumbers(x.num, 100)
+		num /= y.num
+	}
+	if !ok {
+		return exprValue{}, exprError(n.at, "operator %q overflows", n.op)
+	}
+	return exprValue{num: num}, nil
+}
+
+// exprFunction - a function that an expression can call. It returns an aggregate of the customer's accepted
+// transactions of the same type as the transaction being checked.
+type exprFunction struct {
+	params []exprType
+	call   func(env *exprEnv, args []exprValue) exprValue
+}
+
+// exprFunctions - the functions that an expression can call.
+var exprFunctions = map[string]exprFunction{
+	// sum(amount, period) - the funds in the calendar period of the transaction, excluding the transaction.
+	"sum": {[]exprType{exprNumber, exprPeriod}, func(env *exprEnv, args []exprValue) exprValue {
+		period := rulePeriod(args[1].str)
+		funds := env.a.counters(env.t.Type).loadedFunds(period)[env.t.periodKey(period)]
+		return exprValue{num: int64(funds)}
+	}},
+	// count(period) - the number of transactions in the calendar period of the transaction, excluding the transaction.
+	"count": {[]exprType{exprPeriod}, func(env *exprEnv, args []exprValue) exprValue {
+		period := rulePeriod(args[0].str)
+		times := env.a.counters(env.t.Type).loadedTime(period)[env.t.periodKey(period)]
+		return exprValue{num: int64(times) * 100}
+	}},
+}
+
+type exprCall struct {
+	at       int
+	name     string
+	function exprFunction
+	args     []exprNode
+}
+
+func (n *exprCall) pos() int { return n.at }
+
+func (n *exprCall) check() (exprType, error) {
+	if len(n.args) != len(n.function.params) {
+		return 0, exprError(n.at, "%s() takes %d arguments but got %d", n.name, len(n.function.params), len(n.args))
+	}
+	for i, arg := range n.args {
+		typ, err := arg.check()
+		if err != nil {
+			return 0, err
+		}
+		if typ != n.function.params[i] {
+			return 0, exprError(arg.pos(), "argument %d of %s() must be a %s but got a %s",
+				i+1, n.name, n.function.params[i], typ)
+		}
+	}
+	// Only the amount can be summed for now.
+	if ref, ok := n.args[0].(*exprVariableRef); n.name == "sum" && (!ok || ref.name != "amount") {
+		return 0, exprError(n.args[0].pos(), "argument 1 of sum() must be amount")
+	}
+	return exprNumber, nil
+}
+
+func (n *exprCall) eval(env *exprEnv) (exprValue, error) {
+	args := make([]exprValue, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return value, err
+		}
+		args[i] = value
+	}
+	return n.function.call(env, args), nil
+}
+
+/****************************************************************************************/
+
+// exprParser - a recursive descent parser of expressions. From the lowest precedence to the highest, the operators
+// are `||`, `&&`, `==` and `!=`, `<`, `<=`, `>` and `>=`, `+` and `-`, `*` and `/`, and the unary `!` and `-`.
+type exprParser struct {
+	tokens []exprToken
+	next   int
+	depth  int
+}
+
+// parseExpression - parse and type check the given expression, which must be a boolean.
+func parseExpression(src string) (exprNode, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, fmt.Errorf("the expression is empty")
+	}
+	if len(src) > maxExpressionLength {
+		return nil, fmt.Errorf("the expression is longer than %d characters", maxExpressionLength)
+	}
+	tokens, err := lexExpression(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token.kind != tokenEOF {
+		return nil, exprError(token.pos, "unexpected %s", describeToken(token))
+	}
+
+	typ, err := node.check()
+	if err != nil {
+		return nil, err
+	}
+	if typ != exprBool {
+		return nil, fmt.Errorf("the expression must be a boolean but is a %s", typ)
+	}
+	return node, nil
+}
+
+// exprPrecedences - the binary operators by precedence, from the lowest to the highest.
+var exprPrecedences = [][]string{{"||"}, {"&&"}, {"==", "!="}, {"<", "<=", ">", ">="}, {"+", "-"}, {"*", "/"}}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.next]
+}
+
+func (p *exprParser) take() exprToken {
+	token := p.tokens[p.next]
+	if token.kind != tokenEOF {
+		p.next++
+	}
+	return token
+}
+
+// expect - take the next token, which must be the given operator.
+func (p *exprParser) expect(operator string) error {
+	if token := p.take(); token.kind != tokenOperator || token.text != operator {
+		return exprError(token.pos, "expected %q but found %s", operator, describeToken(token))
+	}
+	return nil
+}
+
+// parseBinary - parse the binary operators of the given precedence and higher ones, which are left-associative.
+func (p *exprParser) parseBinary(precedence int) (exprNode, error) {
+	if precedence == len(exprPrecedences) {
+		return p.parseUnary()
+	}
+	x, err := p.parseBinary(precedence + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token := p.peek()
+		if token.kind != tokenOperator || !containsString(exprPrecedences[precedence], token.text) {
+			return x, nil
+		}
+		p.take()
+		y, err := p.parseBinary(precedence + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &exprBinary{at: token.pos, op: token.text, x: x, y: y}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	p.depth++
+	defer func() {
+		p.depth--
+	}()
+	token := p.peek()
+	if p.depth > maxExpressionDepth {
+		return nil, exprError(token.pos, "the expression is nested more than %d levels deep", maxExpressionDepth)
+	}
+
+	if token.kind == tokenOperator && (token.text == "!" || token.text == "-") {
+		p.take()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprUnary{at: token.pos, op: token.text, x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	token := p.take()
+	switch token.kind {
+	case tokenNumber:
+		num, err := parseExprNumber(token)
+		if err != nil {
+			return nil, err
+		}
+		return &exprLiteral{at: token.pos, typ: exprNumber, value: exprValue{num: num}}, nil
+	case tokenString:
+		return &exprLiteral{at: token.pos, typ: exprString, value: exprValue{str: token.text}}, nil
+	case tokenName:
+		return p.parseName(token)
+	case tokenOperator:
+		if token.text == "(" {
+			x, err := p.parseBinary(0)
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		}
+	}
+	return nil, exprError(token.pos, "unexpected %s", describeToken(token))
+}
+
+// parseName - parse a literal, variable, period or function call that starts with the given name.
+func (p *exprParser) parseName(token exprToken) (exprNode, error) {
+	if function, ok := exprFunctions[token.text]; ok {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		call := &exprCall{at: token.pos, name: token.text, function: function}
+		for p.peek().kind != tokenOperator || p.peek().text != ")" {
+			if len(call.args) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.parseBinary(0)
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+		}
+		p.take()
+		return call, nil
+	}
+
+	switch token.text {
+	case "true", "false":
+		return &exprLiteral{at: token.pos, typ: exprBool, value: exprValue{b: token.text == "true"}}, nil
+	}
+	if variable, ok := exprVariables[token.text]; ok {
+		return &exprVariableRef{at: token.pos, name: token.text, variable: variable}, nil
+	}
+	if period, ok := exprPeriods[token.text]; ok {
+		return &exprPeriodName{at: token.pos, period: period}, nil
+	}
+
+	names := make([]string, 0, len(exprVariables)+len(exprFunctions))
+	for name := range exprVariables {
+		names = append(names, name)
+	}
+	for name := range exprFunctions {
+		names = append(names, name+"()")
+	}
+	sort.Strings(names)
+	return nil, exprError(token.pos, "unknown name %q: must be one of %s", token.text, strings.Join(names, ", "))
+}
+
+// describeToken - describe the given token for error messages.
+func describeToken(token exprToken) string {
+	switch token.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(token.text)
+	default:
+		return fmt.Sprintf("%q", token.text)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+/****************************************************************************************/
+
+// expressionChecker - check whether given transaction matches a rule expression, in which case it is declined.
+type expressionChecker struct {
+	source  string
+	expr    exprNode
+	message string
+}
+
+func newExpressionChecker(source string, message string) (*expressionChecker, error) {
+	expr, err := parseExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	if message == "" {
+		message = fmt.Sprintf("matches rule (%s)", source)
+	}
+	return &expressionChecker{source: source, expr: expr, message: message}, nil
+}
+
+func (c *expressionChecker) countedPeriods() []rulePeriod {
+	used := make(map[rulePeriod]bool, 0)
+	exprCountedPeriods(c.expr, used)
+	periods := make([]rulePeriod, 0, len(used))
+	for _, period := range calendarPeriods {
+		if used[period] {
+			periods = append(periods, period)
+		}
+	}
+	return periods
+}
+
+// exprCountedPeriods - add the calendar periods that the given expression takes aggregates over to `used`.
+func exprCountedPeriods(node exprNode, used map[rulePeriod]bool) {
+	switch n := node.(type) {
+	case *exprPeriodName:
+		used[n.period] = true
+	case *exprUnary:
+		exprCountedPeriods(n.x, used)
+	case *exprBinary:
+		exprCountedPeriods(n.x, used)
+		exprCountedPeriods(n.y, used)
+	case *exprCall:
+		for _, arg := range n.args {
+			exprCountedPeriods(arg, used)
+		}
+	}
+}
+
+func (c *expressionChecker) check(a *customerAccount, t *loadTransaction) error {
+	value, err := c.expr.eval(&exprEnv{a: a, t: t})
+	if err != nil {
+		return fmt.Errorf("error evaluating rule (%s): %s", c.source, err.Error())
+	}
+	if value.b {
+		return newDeclineError(reasonCustomRule, "%s", c.message)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package account
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExpression(t *testing.T) {
+	testCases := []struct {
+		caseName   string
+		expression string
+		err        error
+	}{
+		{
+			caseName:   "Aggregates, variables and literals",
+			expression: `sum(amount, day) + amount > 5000 && customer.tier == "basic" || count(week) >= 10.5`,
+		},
+		{
+			caseName:   "Unary operators and parentheses",
+			expression: `!(hour < 6 || -amount < -100) && weekday != "sunday" && recipient == customer.id == true`,
+		},
+		{
+			caseName:   "Empty expression",
+			expression: " ",
+			err:        fmt.Errorf("the expression is empty"),
+		},
+		{
+			caseName:   "Not a boolean",
+			expression: "amount * 2",
+			err:        fmt.Errorf("the expression must be a boolean but is a number"),
+		},
+		{
+			caseName:   "Unknown name",
+			expression: "amount > limit",
+			err: fmt.Errorf(`column 10: unknown name "limit": must be one of amount, count(), customer.id, ` +
+				`customer.tier, hour, recipient, sum(), type, weekday`),
+		},
+		{
+			caseName:   "Unexpected character",
+			expression: "amount > $5",
+			err:        fmt.Errorf(`column 10: unexpected character '$'`),
+		},
+		{
+			caseName:   "Unterminated string",
+			expression: `type == "load`,
+			err:        fmt.Errorf("column 9: string is not terminated"),
+		},
+		{
+			caseName:   "Number with more than two decimals",
+			expression: "amount > 10.001",
+			err:        fmt.Errorf("column 10: invalid number 10.001: must have at most two decimals"),
+		},
+		{
+			caseName:   "Number too large",
+			expression: "amount > 92233720368547758.07",
+			err:        fmt.Errorf("column 10: invalid number 92233720368547758.07: must be at most 10000000000000"),
+		},
+		{
+			caseName:   "Missing closing parenthesis",
+			expression: "(amount > 10",
+			err:        fmt.Errorf(`column 13: expected ")" but found end of expression`),
+		},
+		{
+			caseName:   "Trailing tokens",
+			expression: "amount > 10 10",
+			err:        fmt.Errorf(`column 13: unexpected "10"`),
+		},
+		{
+			caseName:   "Mismatched comparison",
+			expression: `amount == "10"`,
+			err:        fmt.Errorf("column 8: cannot compare a number with a string"),
+		},
+		{
+			caseName:   "Arithmetic on strings",
+			expression: `type + 1 > 0`,
+			err:        fmt.Errorf(`column 6: operator "+" needs numbers but got a string and a number`),
+		},
+		{
+			caseName:   "Logical operator on numbers",
+			expression: `amount && true`,
+			err:        fmt.Errorf(`column 8: operator "&&" needs booleans but got a number and a boolean`),
+		},
+		{
+			caseName:   "Period outside of a function call",
+			expression: `day > 1`,
+			err:        fmt.Errorf(`column 5: operator ">" needs numbers but got a period and a number`),
+		},
+		{
+			caseName:   "Wrong number of arguments",
+			expression: `count(day, week) > 1`,
+			err:        fmt.Errorf("column 1: count() takes 1 arguments but got 2"),
+		},
+		{
+			caseName:   "Wrong type of argument",
+			expression: `sum(amount, 5) > 1`,
+			err:        fmt.Errorf("column 13: argument 2 of sum() must be a period but got a number"),
+		},
+		{
+			caseName:   "Sum of something else than the amount",
+			expression: `sum(hour, day) > 1`,
+			err:        fmt.Errorf("column 5: argument 1 of sum() must be amount"),
+		},
+		{
+			caseName:   "Nested too deeply",
+			expression: strings.Repeat("(", 40) + "true" + strings.Repeat(")", 40),
+			err:        fmt.Errorf("column 33: the expression is nested more than 32 levels deep"),
+		},
+		{
+			caseName:   "Too long",
+			expression: "amount > 1" + strings.Repeat(" ", maxExpressionLength),
+			err:        fmt.Errorf("the expression is longer than 1000 characters"),
+		},
+	}
+
+	for _, c := range testCases {
+		_, err := parseExpression(c.expression)
+		if c.err != nil {
+			assert.Equal(t, c.err, err, c.caseName)
+			continue
+		}
+		assert.NoError(t, err, c.caseName)
+	}
+}
+
+func TestExpressionChecker(t *testing.T) {
+	account := newCustomerAccount("1")
+	for _, day := range []int{3, 4} {
+		account.apply(newTestTransaction(t, "1", "1", "$2000.00", time.Date(2000, 1, day, 10, 0, 0, 0, time.UTC)),
+			calendarPeriods)
+	}
+	transaction := newTestTransaction(t, "2", "1", "$1500.50", time.Date(2000, 1, 4, 22, 30, 0, 0, time.UTC))
+	transaction.customerTier = "basic"
+
+	testCases := []struct {
+		caseName   string
+		expression string
+		declined   bool
+		err        error
+	}{
+		{
+			caseName:   "The daily sum is under the limit",
+			expression: `sum(amount, day) + amount > 5000 && customer.tier == "basic"`,
+		},
+		{
+			caseName:   "The weekly sum is over the limit",
+			expression: `sum(amount, week) + amount > 5000 && customer.tier == "basic"`,
+			declined:   true,
+		},
+		{
+			caseName:   "The customer is not in the tier",
+			expression: `sum(amount, week) + amount > 5000 && customer.tier == "premium"`,
+		},
+		{
+			caseName:   "Counts and fixed-point arithmetic",
+			expression: `count(month) == 2 && amount * 2 == 3001 && amount / 2 == 750.25`,
+			declined:   true,
+		},
+		{
+			caseName:   "Time of the transaction",
+			expression: `hour >= 22 && weekday == "tuesday" && type == "load"`,
+			declined:   true,
+		},
+		{
+			caseName:   "Division by zero",
+			expression: `amount / (count(year) - 2) > 0`,
+			err:        fmt.Errorf("error evaluating rule (amount / (count(year) - 2) > 0): column 8: division by zero"),
+		},
+		{
+			caseName:   "Overflowing product",
+			expression: `amount * 10000000000000 * 10000000000000 > 0`,
+			err: fmt.Errorf("error evaluating rule (amount * 10000000000000 * 10000000000000 > 0): " +
+				`column 8: operator "*" overflows`),
+		},
+		{
+			caseName:   "Overflowing sum",
+			expression: `10000000000000 * 90 / 0.01 + 10000000000000 * 90 / 0.01 > 0`,
+			err: fmt.Errorf("error evaluating rule (10000000000000 * 90 / 0.01 + 10000000000000 * 90 / 0.01 > 0): " +
+				`column 28: operator "+" overflows`),
+		},
+		{
+			caseName:   "Overflowing negation",
+			expression: `-(0 - 30316786.50 * 30423316.92 / 0.01 - 0.08) > 0`,
+			err: fmt.Errorf("error evaluating rule (-(0 - 30316786.50 * 30423316.92 / 0.01 - 0.08) > 0): " +
+				`column 1: operator "-" overflows`),
+		},
+		{
+			caseName:   "Short-circuit evaluation",
+			expression: `false && amount / 0 > 0`,
+		},
+	}
+
+	for _, c := range testCases {
+		checker, err := newExpressionChecker(c.expression, "")
+		if !assert.NoError(t, err, c.caseName) {
+			continue
+		}
+		err = checker.check(account, transaction)
+		switch {
+		case c.err != nil:
+			assert.Equal(t, c.err, err, c.caseName)
+		case c.declined:
+			assert.Equal(t, newDeclineError(reasonCustomRule, "matches rule (%s)", c.expression), err, c.caseName)
+		default:
+			assert.NoError(t, err, c.caseName)
+		}
+	}
+}
+
+func TestProcessExpressionRules(t *testing.T) {
+	rules, err := parseRules([]byte(`
+rules:
+  - kind: expression
+    expression: sum(amount, day) + amount > 5000 && customer.tier == "basic"
+    message: exceeds the daily limit of basic customers
+`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	customers, err := parseCustomers([]byte(`customers: {"1": {tier: basic}, "2": {tier: premium}}`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$3000.00","time":"2000-01-01T00:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$3000.00","time":"2000-01-01T01:00:00Z"}`,
+		`{"id":"3","customer_id":"2","load_amount":"$3000.00","time":"2000-01-01T00:00:00Z"}`,
+		`{"id":"4","customer_id":"2","load_amount":"$3000.00","time":"2000-01-01T01:00:00Z"}`,
+	}
+	m := NewManager(WithRules(rules), WithCustomers(customers), WithOutputFormat(OutputFormatDetailed))
+	lines := runManager(t, m, input)
+	assert.Contains(t, lines[1], `"accepted":false,"reason_code":"CUSTOM_RULE",`+
+		`"message":"exceeds the daily limit of basic customers"`)
+
+	results := decodeResults(t, lines)
+	assert.True(t, results["1"].Accepted)
+	assert.False(t, results["2"].Accepted)
+	assert.True(t, results["3"].Accepted)
+	assert.True(t, results["4"].Accepted)
+}
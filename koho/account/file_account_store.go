@@ -0,0 +1,538 @@
+package account
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// snapshotFileName - the file that holds the latest snapshot of all the customer accounts.
+	snapshotFileName = "accounts.snapshot"
+	// walFileName - the append-only log of the decisions made after the latest snapshot.
+	walFileName = "accounts.wal"
+	// DefaultSnapshotInterval - the default number of logged decisions between two snapshots.
+	DefaultSnapshotInterval = 10000
+)
+
+// walRecord - a record in the append-only log. Every decision made for a transaction is logged.
+// TimeZone is the time zone that the transaction's day and week were derived in, if there is one.
+// CoolingOffUntil is the end of the cooling-off period started by the transaction, if it was part of a burst.
+type walRecord struct {
+	Seq             uint64           `json:"seq"`
+	Transaction     *loadTransaction `json:"transaction"`
+	TimeZone        string           `json:"time_zone,omitempty"`
+	Accepted        bool             `json:"accepted"`
+	CoolingOffUntil *time.Time       `json:"cooling_off_until,omitempty"`
+}
+
+// accountSnapshot - a snapshot of all the customer accounts. It reflects at least all the log records
+// up to `Seq`; an account may also reflect later records, which is told by the account's own `Seq`,
+// and so may the ledger, which is told by the ledger's own `Seq`.
+type accountSnapshot struct {
+	Seq      uint64            `json:"seq"`
+	Accounts []json.RawMessage `json:"accounts"`
+	Ledger   *ledgerSnapshot   `json:"ledger,omitempty"`
+}
+
+// fileAccountStore - an account store that keeps customer accounts in memory and persists them to a directory
+// with an append-only log of decisions plus periodic snapshots, so that they survive restarts and crashes.
+//
+// The log is rotated to `accounts.wal.<seq>` when a snapshot is taken and rotated logs are removed once the
+// snapshot is written. On opening, the store loads the snapshot and replays all the remaining logs on top of it.
+type fileAccountStore struct {
+	*memoryAccountStore
+	dir              string
+	snapshotInterval uint64
+
+	wal             *os.File
+	walSize         int64
+	seq             uint64
+	snapshotSeq     uint64
+	snapshotRunning bool
+	failed          error // The error of the sync that failed, after which no decision can be logged anymore.
+	walMutex        *sync.Mutex
+	snapshots       *sync.WaitGroup
+
+	// The log is synced by one routine at a time, for all the decisions logged so far (see sync).
+	syncedSeq uint64
+	syncMutex *sync.Mutex
+
+	// The time zones loaded during recovery, indexed by names.
+	locations map[string]*time.Location
+}
+
+// OpenFileAccountStore - open the account store persisted in the given directory, creating it if it does not exist.
+// Params:
+//	dir: The directory that holds the snapshot and logs of customer accounts.
+//	snapshotInterval: The number of logged decisions between two snapshots.
+// Returns:
+//	AccountStore: The account store that has recovered all the customer accounts persisted in the directory.
+//	error: Any error that occurred during recovering customer accounts.
+func OpenFileAccountStore(dir string, snapshotInterval int) (AccountStore, error) {
+	return openFileAccountStore(dir, snapshotInterval)
+}
+
+func openFileAccountStore(dir string, snapshotInterval int) (*fileAccountStore, error) {
+	if snapshotInterval <= 0 {
+		snapshotInterval = DefaultSnapshotInterval
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating account store directory %s: %s", dir, err.Error())
+	}
+
+	s := &fileAccountStore{
+		memoryAccountStore: newMemoryAccountStore(),
+		dir:                dir,
+		snapshotInterval:   uint64(snapshotInterval),
+		walMutex:           &sync.Mutex{},
+		snapshots:          &sync.WaitGroup{},
+		syncMutex:          &sync.Mutex{},
+		locations:          make(map[string]*time.Location, 0),
+	}
+	if err := s.recover(); err != nil {
+		return nil, fmt.Errorf("error recovering account store %s: %s", dir, err.Error())
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error openning account store log: %s", err.Error())
+	}
+	info, err := wal.Stat()
+	if err != nil {
+		_ = wal.Close()
+		return nil, fmt.Errorf("error openning account store log: %s", err.Error())
+	}
+	// Make sure that the log is still in the directory after an OS crash if it has just been created.
+	if err := syncDir(dir); err != nil {
+		_ = wal.Close()
+		return nil, err
+	}
+	s.wal = wal
+	s.walSize = info.Size()
+
+	return s, nil
+}
+
+// commit - append the decision to the log and post the ledger entry of an accepted transaction. The returned function
+// waits until the decision is synced to disk. A snapshot is taken in the background every `snapshotInterval` records.
+func (s *fileAccountStore) commit(a *customerAccount, t *loadTransaction, entry *ledgerEntry) (func() error, error) {
+	s.walMutex.Lock()
+	defer s.walMutex.Unlock()
+	if s.failed != nil {
+		return nil, s.failed
+	}
+
+	timeZone := ""
+	if t.location != nil {
+		timeZone = t.location.String()
+	}
+	record, err := json.Marshal(&walRecord{
+		Seq:             s.seq + 1,
+		Transaction:     t,
+		TimeZone:        timeZone,
+		Accepted:        entry != nil,
+		CoolingOffUntil: t.coolingOffUntil,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error encoding account store log record: %s", err.Error())
+	}
+	record = append(record, '\n')
+	if _, err := s.wal.Write(record); err != nil {
+		// Remove the partially written record so that it is not followed by other records.
+		_ = s.wal.Truncate(s.walSize)
+		return nil, fmt.Errorf("error writing account store log: %s", err.Error())
+	}
+	s.walSize += int64(len(record))
+	s.seq++
+	a.Seq = s.seq
+	seq := s.seq
+
+	// The entry is posted in the order of the log, so that the ledger reflects all the accepted transactions up to
+	// its own `Seq` whenever a snapshot is taken.
+	if entry != nil {
+		s.balances.post(entry, seq)
+	}
+
+	if s.seq-s.snapshotSeq >= s.snapshotInterval && !s.snapshotRunning {
+		// The snapshot runs in the background because it needs to lock every account,
+		// including the one locked by the caller.
+		s.snapshotRunning = true
+		s.snapshots.Add(1)
+		go func() {
+			defer s.snapshots.Done()
+			if err := s.snapshot(); err != nil {
+				log.Printf("error taking a snapshot of account store %s: %s", s.dir, err.Error())
+			}
+		}()
+	}
+
+	return func() error {
+		return s.sync(seq)
+	}, nil
+}
+
+// sync - wait until the log is synced to disk up to the record with the given sequence number, so that the decision
+// survives an OS crash or a power loss too. The routine that gets to sync first syncs all the records logged so far,
+// while the others wait for it, so that concurrent decisions share a sync (group commit). Once a sync fails, it is
+// unknown which records are on disk, so every decision that is not synced yet fails and no other one is logged.
+func (s *fileAccountStore) sync(seq uint64) error {
+	s.syncMutex.Lock()
+	defer s.syncMutex.Unlock()
+	if s.syncedSeq >= seq {
+		return nil
+	}
+
+	// Let the routines that are ready to log a decision do it first, so that they share this sync.
+	runtime.Gosched()
+	s.walMutex.Lock()
+	wal, lastSeq, err := s.wal, s.seq, s.failed
+	s.walMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := wal.Sync(); err != nil {
+		return s.fail(fmt.Errorf("error syncing account store log: %s", err.Error()))
+	}
+	s.syncedSeq = lastSeq
+	return nil
+}
+
+// fail - record the given error of a sync, so that no decision is logged anymore.
+func (s *fileAccountStore) fail(err error) error {
+	s.walMutex.Lock()
+	defer s.walMutex.Unlock()
+	if s.failed == nil {
+		s.failed = err
+	}
+	return s.failed
+}
+
+// Close - take a final snapshot and close the log. It must be called after all the commits are done.
+func (s *fileAccountStore) Close() error {
+	s.snapshots.Wait()
+	err := s.snapshot()
+
+	s.walMutex.Lock()
+	defer s.walMutex.Unlock()
+	if closeErr := s.wal.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("error closing account store log: %s", closeErr.Error())
+	}
+	return err
+}
+
+// snapshot - rotate the log, write a snapshot of all the accounts and remove the logs covered by the snapshot.
+// No snapshot is taken once a sync has failed, as the accounts may reflect decisions that are not on disk.
+func (s *fileAccountStore) snapshot() error {
+	s.syncMutex.Lock()
+	s.walMutex.Lock()
+	seq := s.seq
+	err := s.failed
+	if err == nil {
+		err = s.rotateLog()
+	}
+	s.walMutex.Unlock()
+	s.syncMutex.Unlock()
+	defer func() {
+		s.walMutex.Lock()
+		s.snapshotRunning = false
+		if err == nil {
+			s.snapshotSeq = seq
+		}
+		s.walMutex.Unlock()
+	}()
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := s.encodeAccounts(seq)
+	if err != nil {
+		return err
+	}
+	if err = s.writeSnapshot(snapshot); err != nil {
+		return err
+	}
+
+	// The rotated logs are covered by the snapshot now.
+	segments, err := s.rotatedLogs()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment.seq <= seq {
+			if removeErr := os.Remove(segment.path); removeErr != nil {
+				err = fmt.Errorf("error removing account store log %s: %s", segment.path, removeErr.Error())
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// saveCheckpoint - record the last decision in the checkpoint, as the accounts are persisted by the store itself.
+func (s *fileAccountStore) saveCheckpoint(c *checkpoint) error {
+	s.walMutex.Lock()
+	defer s.walMutex.Unlock()
+	c.StoreSeq = s.seq
+	return nil
+}
+
+// loadCheckpoint - check that no decision has been persisted since the checkpoint was written.
+func (s *fileAccountStore) loadCheckpoint(c *checkpoint) error {
+	if c.Accounts != nil {
+		return fmt.Errorf("the checkpoint holds accounts kept in memory, not in an account store directory")
+	}
+	s.walMutex.Lock()
+	defer s.walMutex.Unlock()
+	if s.seq != c.StoreSeq {
+		return fmt.Errorf("the account store is at decision %d, but the checkpoint was written at decision %d",
+			s.seq, c.StoreSeq)
+	}
+	return nil
+}
+
+// rotateLog - sync the current log, rename it to `accounts.wal.<seq>` and start a new one. It is called with
+// `syncMutex` and `walMutex` locked.
+func (s *fileAccountStore) rotateLog() error {
+	if s.walSize == 0 {
+		return nil
+	}
+	walPath := filepath.Join(s.dir, walFileName)
+	if err := s.wal.Sync(); err != nil {
+		s.failed = fmt.Errorf("error syncing account store log: %s", err.Error())
+		return s.failed
+	}
+	s.syncedSeq = s.seq
+	if err := os.Rename(walPath, fmt.Sprintf("%s.%d", walPath, s.seq)); err != nil {
+		return fmt.Errorf("error rotating account store log: %s", err.Error())
+	}
+
+	wal, err := os.OpenFile(walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error openning account store log: %s", err.Error())
+	}
+	_ = s.wal.Close()
+	s.wal = wal
+	s.walSize = 0
+	return syncDir(s.dir)
+}
+
+// writeSnapshot - write the given snapshot atomically by writing it to a temporary file and renaming it.
+func (s *fileAccountStore) writeSnapshot(snapshot *accountSnapshot) error {
+	snapshotPath := filepath.Join(s.dir, snapshotFileName)
+	file, err := os.Create(snapshotPath + ".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating account store snapshot: %s", err.Error())
+	}
+
+	w := bufio.NewWriter(file)
+	err = json.NewEncoder(w).Encode(snapshot)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing account store snapshot: %s", err.Error())
+	}
+
+	if err := os.Rename(snapshotPath+".tmp", snapshotPath); err != nil {
+		return fmt.Errorf("error renaming account store snapshot: %s", err.Error())
+	}
+	return syncDir(s.dir)
+}
+
+// recover - load the snapshot and replay the logs in the store directory.
+func (s *fileAccountStore) recover() error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error reading snapshot: %s", err.Error())
+	}
+	if err == nil {
+		snapshot := &accountSnapshot{}
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			return fmt.Errorf("error decoding snapshot: %s", err.Error())
+		}
+		if err := s.restoreAccounts(snapshot); err != nil {
+			return fmt.Errorf("error decoding snapshot: %s", err.Error())
+		}
+		for _, account := range s.accounts {
+			if account.Seq > s.seq {
+				s.seq = account.Seq
+			}
+		}
+		if snapshot.Seq > s.seq {
+			s.seq = snapshot.Seq
+		}
+		s.snapshotSeq = snapshot.Seq
+	}
+
+	segments, err := s.rotatedLogs()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if err := s.replayLog(segment.path, false); err != nil {
+			return err
+		}
+	}
+	return s.replayLog(filepath.Join(s.dir, walFileName), true)
+}
+
+// replayLog - apply the records in the given log to the accounts that have not seen them.
+// A trailing record without a line break is the result of an interrupted write: it is ignored and,
+// if `truncate` is true, removed from the log.
+func (s *fileAccountStore) replayLog(path string, truncate bool) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error openning log %s: %s", path, err.Error())
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	r := bufio.NewReader(file)
+	offset := int64(0)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) != 0 {
+				log.Printf("ignoring the incomplete record at line %d of log %s", lineNumber, path)
+				if truncate {
+					if err := os.Truncate(path, offset); err != nil {
+						return fmt.Errorf("error truncating log %s: %s", path, err.Error())
+					}
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading log %s: %s", path, err.Error())
+		}
+		offset += int64(len(line))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		record := &walRecord{}
+		if err := json.Unmarshal(line, record); err != nil || record.Transaction == nil {
+			return fmt.Errorf("corrupted record at line %d of log %s", lineNumber, path)
+		}
+		if err := s.replay(record); err != nil {
+			return fmt.Errorf("invalid record at line %d of log %s: %s", lineNumber, path, err.Error())
+		}
+	}
+}
+
+// replay - apply the given log record to its account if the account has not seen it.
+func (s *fileAccountStore) replay(record *walRecord) error {
+	if record.Seq > s.seq {
+		s.seq = record.Seq
+	}
+	// Derive the day and week in the same time zone as the decision did.
+	location := s.locations[record.TimeZone]
+	if location == nil && record.TimeZone != "" {
+		var err error
+		if location, err = loadLocation(record.TimeZone); err != nil {
+			return err
+		}
+		s.locations[record.TimeZone] = location
+	}
+	if err := record.Transaction.transformAndValidate(location); err != nil && record.Accepted {
+		return err
+	}
+
+	// The transaction rolled back by an accepted reversal has been logged before the reversal, so the account
+	// remembers it even if the account has seen the reversal too.
+	account := s.get(record.Transaction.CustomerID)
+	if record.Accepted && record.Transaction.Type == transactionTypeReversal {
+		original := account.Transactions[record.Transaction.OriginalID]
+		if original == nil || original.Type == "" {
+			return fmt.Errorf("transaction %s reversed by log record %d is unknown",
+				record.Transaction.OriginalID.String(), record.Seq)
+		}
+		record.Transaction.original = original
+		record.Transaction.loadAmount = original.Amount
+	}
+
+	// Accepted transactions are posted to the ledger in the order of their sequence numbers.
+	if record.Accepted && record.Seq > s.balances.seq {
+		s.balances.post(record.Transaction.ledgerEntry(), record.Seq)
+	}
+
+	if record.Seq <= account.Seq {
+		return nil
+	}
+	account.remember(record.Transaction, record.Accepted)
+	record.Transaction.coolingOffUntil = record.CoolingOffUntil
+	account.coolOff(record.Transaction)
+	if record.Accepted {
+		// The rules are not known yet, so the transaction is counted in every calendar period, only the latest of
+		// which are kept.
+		account.apply(record.Transaction, calendarPeriods)
+	}
+	account.Seq = record.Seq
+	return nil
+}
+
+// rotatedLog - a log that has been rotated when a snapshot is taken.
+type rotatedLog struct {
+	path string
+	seq  uint64
+}
+
+// rotatedLogs - return the rotated logs in the store directory in the order of their sequence numbers.
+func (s *fileAccountStore) rotatedLogs() ([]rotatedLog, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, walFileName+".*"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing logs: %s", err.Error())
+	}
+
+	segments := make([]rotatedLog, 0, len(paths))
+	for _, path := range paths {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(filepath.Base(path), walFileName+"."), 10, 64)
+		if err != nil {
+			// Not a rotated log
+			continue
+		}
+		segments = append(segments, rotatedLog{path: path, seq: seq})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].seq < segments[j].seq
+	})
+	return segments, nil
+}
+
+// syncDir - flush the entries of the given directory, e.g. renamed files, to the disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("error openning directory %s: %s", dir, err.Error())
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("error syncing directory %s: %s", dir, err.Error())
+	}
+	return nil
+}
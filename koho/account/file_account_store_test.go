@@ -0,0 +1,295 @@
+package account
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestTransaction - create a validated load transaction.
+func newTestTransaction(t *testing.T, id, customerID, amount string, at time.Time) *loadTransaction {
+	transaction := &loadTransaction{
+		ID:         identifier(id),
+		CustomerID: identifier(customerID),
+		LoadAmount: amount,
+		Time:       at,
+	}
+	if !assert.NoError(t, transaction.transformAndValidate(nil)) {
+		t.FailNow()
+	}
+	return transaction
+}
+
+// commitTestTransactions - commit, apply and post the given transactions as accepted ones.
+func commitTestTransactions(t *testing.T, store AccountStore, transactions ...*loadTransaction) {
+	for _, transaction := range transactions {
+		account := store.get(transaction.CustomerID)
+		account.mutex.Lock()
+		wait, err := store.commit(account, transaction, transaction.ledgerEntry())
+		if err == nil {
+			err = wait()
+		}
+		if err == nil {
+			account.apply(transaction, calendarPeriods)
+		}
+		account.mutex.Unlock()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+}
+
+func newTestStoreDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "koho-account-store-test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return dir
+}
+
+func openTestStore(t *testing.T, dir string, snapshotInterval int) *fileAccountStore {
+	store, err := openFileAccountStore(dir, snapshotInterval)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return store
+}
+
+func TestFileAccountStoreAcrossRuns(t *testing.T) {
+	dir := newTestStoreDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	day := time.Date(2000, 1, 3, 10, 0, 0, 0, time.UTC)
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$3000.00","time":"2000-01-03T10:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$1500.00","time":"2000-01-03T11:00:00Z"}`,
+	}
+	store := openTestStore(t, dir, 0)
+	results := decodeResults(t, runManager(t, NewManager(WithAccountStore(store)), input))
+	assert.True(t, results["1"].Accepted)
+	assert.True(t, results["2"].Accepted)
+	assert.NoError(t, store.Close())
+
+	// The next run knows the loads accepted by the previous run.
+	input = []string{
+		`{"id":"3","customer_id":"1","load_amount":"$500.01","time":"2000-01-03T12:00:00Z"}`,
+		`{"id":"4","customer_id":"1","load_amount":"$500.00","time":"2000-01-03T13:00:00Z"}`,
+	}
+	store = openTestStore(t, dir, 0)
+	results = decodeResults(t, runManager(t, NewManager(WithAccountStore(store)), input))
+	assert.False(t, results["3"].Accepted)
+	assert.True(t, results["4"].Accepted)
+	assert.NoError(t, store.Close())
+
+	// Transactions processed by previous runs are detected as duplicates.
+	input = []string{
+		`{"id":"1","customer_id":"1","load_amount":"$3000.00","time":"2000-01-03T10:00:00Z"}`,
+		`{"id":"3","customer_id":"1","load_amount":"$500.01","time":"2000-01-03T12:00:00Z"}`,
+	}
+	store = openTestStore(t, dir, 0)
+	assert.Equal(t, []string{
+		`{"id":"1","customer_id":"1","accepted":true,"outcome":"duplicate"}`,
+		`{"id":"3","customer_id":"1","accepted":false,"outcome":"duplicate"}`,
+	}, runManager(t, NewManager(WithAccountStore(store)), input))
+	assert.NoError(t, store.Close())
+
+	store = openTestStore(t, dir, 0)
+	assert.Equal(t, money(500000), store.get("1").DailyLoadedFunds[dateFromTime(day)])
+	assert.Equal(t, uint(3), store.get("1").DailyLoadedTime[dateFromTime(day)])
+	assert.NoError(t, store.Close())
+}
+
+func TestFileAccountStoreCrashRecovery(t *testing.T) {
+	dir := newTestStoreDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	day := time.Date(2000, 1, 3, 10, 0, 0, 0, time.UTC)
+	store := openTestStore(t, dir, 0)
+	commitTestTransactions(t, store,
+		newTestTransaction(t, "1", "1", "$100.00", day),
+		newTestTransaction(t, "2", "2", "$200.00", day),
+		newTestTransaction(t, "3", "1", "$300.00", day))
+
+	// Crash in the middle of writing a record: the store is never closed and the last record is incomplete.
+	walPath := filepath.Join(dir, walFileName)
+	wal, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, err = wal.WriteString(`{"seq":4,"transaction":{"id":"4","customer_id":"1","load_am`)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Close())
+
+	store = openTestStore(t, dir, 0)
+	assert.Equal(t, money(40000), store.get("1").DailyLoadedFunds[dateFromTime(day)])
+	assert.Equal(t, uint(2), store.get("1").DailyLoadedTime[dateFromTime(day)])
+	assert.Equal(t, money(20000), store.get("2").DailyLoadedFunds[dateFromTime(day)])
+
+	// The incomplete record is removed, so new records can be appended after a crash.
+	commitTestTransactions(t, store, newTestTransaction(t, "5", "2", "$1.00", day))
+	assert.Equal(t, uint64(4), store.get("2").Seq)
+
+	store = openTestStore(t, dir, 0)
+	assert.Equal(t, money(20100), store.get("2").DailyLoadedFunds[dateFromTime(day)])
+	assert.Equal(t, money(40000), store.ledger().balance("1"))
+	assert.Equal(t, money(20100), store.ledger().balance("2"))
+	assert.NoError(t, store.Close())
+}
+
+func TestFileAccountStoreSnapshots(t *testing.T) {
+	dir := newTestStoreDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	day := time.Date(2000, 1, 3, 10, 0, 0, 0, time.UTC)
+	store := openTestStore(t, dir, 2)
+	for i := 0; i < 10; i++ {
+		commitTestTransactions(t, store, newTestTransaction(t, "id", "1", "$10.00", day))
+	}
+	store.snapshots.Wait()
+	commitTestTransactions(t, store, newTestTransaction(t, "id", "1", "$10.00", day))
+
+	// Crash after a snapshot is written but before the logs it covers are removed.
+	walData, err := ioutil.ReadFile(filepath.Join(dir, walFileName))
+	assert.NoError(t, err)
+	assert.NoError(t, store.snapshot())
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, walFileName+".11"), walData, 0644))
+
+	// Records that are already in the snapshot are neither applied nor posted twice.
+	store = openTestStore(t, dir, 2)
+	assert.Equal(t, money(11000), store.get("1").DailyLoadedFunds[dateFromTime(day)])
+	assert.Equal(t, uint64(11), store.get("1").Seq)
+	assert.Equal(t, money(11000), store.ledger().balance("1"))
+	assert.NoError(t, store.Close())
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{filepath.Join(dir, snapshotFileName), filepath.Join(dir, walFileName)}, paths)
+
+	store = openTestStore(t, dir, 2)
+	assert.Equal(t, money(11000), store.get("1").DailyLoadedFunds[dateFromTime(day)])
+	assert.Equal(t, money(11000), store.ledger().balance("1"))
+	assert.NoError(t, store.Close())
+}
+
+func TestFileAccountStoreCorruptedLog(t *testing.T) {
+	dir := newTestStoreDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, walFileName), []byte("garbage\n{}\n"), 0644))
+	_, err := openFileAccountStore(dir, 0)
+	assert.EqualError(t, err, "error recovering account store "+dir+": corrupted record at line 1 of log "+
+		filepath.Join(dir, walFileName))
+}
+
+func TestFileAccountStoreReplaysInDecisionTimeZone(t *testing.T) {
+	dir := newTestStoreDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	toronto, err := time.LoadLocation("America/Toronto")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// 1am UTC on Tuesday is still Monday in Toronto.
+	transaction := &loadTransaction{ID: "1", CustomerID: "1", LoadAmount: "$10.00",
+		Time: time.Date(2021, 3, 16, 1, 0, 0, 0, time.UTC)}
+	assert.NoError(t, transaction.transformAndValidate(toronto))
+	store := openTestStore(t, dir, 0)
+	commitTestTransactions(t, store, transaction)
+
+	// Crash without a snapshot, so the account is recovered from the log.
+	store = openTestStore(t, dir, 0)
+	assert.Equal(t, map[transactionDate]money{"2021-3-15": 1000}, store.get("1").DailyLoadedFunds)
+	assert.NoError(t, store.Close())
+}
+
+func TestFileAccountStoreKeepsTransactionTypes(t *testing.T) {
+	dir := newTestStoreDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	day := time.Date(2000, 1, 3, 10, 0, 0, 0, time.UTC)
+	withdrawal := &loadTransaction{ID: "1", CustomerID: "1", Type: transactionTypeWithdrawal, LoadAmount: "$10.00",
+		Time: day}
+	if !assert.NoError(t, withdrawal.transformAndValidate(nil)) {
+		t.FailNow()
+	}
+	store := openTestStore(t, dir, 0)
+	commitTestTransactions(t, store, withdrawal, newTestTransaction(t, "2", "1", "$20.00", day))
+	assert.NoError(t, store.Close())
+
+	// The withdrawal is replayed into the withdrawal counters, not the load counters.
+	store = openTestStore(t, dir, 0)
+	account := store.get("1")
+	assert.Equal(t, money(2000), account.DailyLoadedFunds["2000-1-3"])
+	if assert.NotNil(t, account.Withdrawals) {
+		assert.Equal(t, money(1000), account.Withdrawals.DailyLoadedFunds["2000-1-3"])
+	}
+	assert.NoError(t, store.Close())
+}
+
+func TestFileAccountStoreConcurrentTransfers(t *testing.T) {
+	dir := newTestStoreDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// Customers transfer funds to each other in both directions while they are processed by different workers, so
+	// that their wallets are locked in every order and their decisions share syncs.
+	input := make([]string, 0)
+	for i := 0; i < 8; i++ {
+		input = append(input, fmt.Sprintf(
+			`{"id":"load-%d","customer_id":"%d","load_amount":"$1000.00","time":"2000-01-03T00:00:00Z"}`, i, i))
+	}
+	for i := 0; i < 400; i++ {
+		input = append(input, fmt.Sprintf(`{"id":"transfer-%d","customer_id":"%d","type":"transfer",`+
+			`"recipient_id":"%d","load_amount":"$%d.00","time":"2000-01-03T01:00:00Z"}`, i, i%8, (i*3+1)%8, 1+i%7))
+	}
+	rules, err := parseRules([]byte(`
+rules:
+  - kind: amount
+    type: transfer
+    period: day
+    amount: 1000000
+`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	store := openTestStore(t, dir, 50)
+	manager := NewManager(WithAccountStore(store), WithRules(rules), WithWorkers(8))
+	results := decodeResults(t, runManager(t, manager, input))
+	accepted := 0
+	for _, result := range results {
+		if result.Accepted {
+			accepted++
+		}
+	}
+	assert.True(t, accepted > 8, "%d accepted transactions", accepted)
+	expected := &bytes.Buffer{}
+	assert.NoError(t, manager.WriteTrialBalance(expected))
+	assert.Contains(t, expected.String(), fmt.Sprintf("Total (%d entries)  $8000.00  $8000.00\n", accepted))
+	assert.NoError(t, store.Close())
+
+	// The ledger recovered from the store is the one that the decisions were made against.
+	store = openTestStore(t, dir, 50)
+	actual := &bytes.Buffer{}
+	assert.NoError(t, store.ledger().writeTrialBalance(actual))
+	assert.Equal(t, expected.String(), actual.String())
+	assert.NoError(t, store.Close())
+}
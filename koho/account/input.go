@@ -0,0 +1,364 @@
+package account
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// StdinInput - the input file name that reads transactions from the standard input.
+const StdinInput = "-"
+
+// InputFormat - the format of the transactions in an input.
+type InputFormat string
+
+const (
+	// InputFormatAuto - tell the format by the extension of the input file: CSV for `.csv` and NDJSON otherwise.
+	InputFormatAuto InputFormat = ""
+	// InputFormatNDJSON - a JSON transaction per line, e.g. `{"id":"1","customer_id":"1",...}`.
+	InputFormatNDJSON InputFormat = "ndjson"
+	// InputFormatCSV - a header row that names the columns, then a transaction per row.
+	InputFormatCSV InputFormat = "csv"
+)
+
+// ParseInputFormat - parse the given input format name. An empty name tells the format by the file extension.
+func ParseInputFormat(s string) (InputFormat, error) {
+	switch format := InputFormat(s); format {
+	case InputFormatAuto, InputFormatNDJSON, InputFormatCSV:
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid input format %q: must be one of %q, %q", s, InputFormatNDJSON, InputFormatCSV)
+	}
+}
+
+// csvFields - the fields of a transaction that can be read from CSV columns, named as in NDJSON inputs.
+var csvFields = []string{"id", "customer_id", "type", "recipient_id", "original_id", "load_amount", "time"}
+
+// csvRequiredFields - the fields that a CSV input must have a column for.
+var csvRequiredFields = []string{"id", "customer_id", "time"}
+
+// ParseCSVColumns - parse a mapping of transaction fields to the CSV columns they are read from, e.g.
+// `load_amount=amount,time=created_at`. The fields that are not mapped are read from the columns with their names.
+func ParseCSVColumns(s string) (map[string]string, error) {
+	columns := make(map[string]string, 0)
+	if strings.TrimSpace(s) == "" {
+		return columns, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		field := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid mapping %q: must be <field>=<column>", pair)
+		}
+		if !containsString(csvFields, field) {
+			return nil, fmt.Errorf("invalid field %q: must be one of %s", field, strings.Join(csvFields, ", "))
+		}
+		columns[field] = strings.TrimSpace(parts[1])
+	}
+	return columns, nil
+}
+
+// transactionReader - a reader of the transactions in an input, whatever its format.
+type transactionReader interface {
+	// next - read the next transaction. It returns io.EOF at the end of the input, and an `*invalidRecordError` if
+	// a record cannot be read as a transaction, in which case the next records can still be read.
+	next() (*loadTransaction, error)
+}
+
+// inputRecord - the record of the input that a transaction is read from.
+type inputRecord struct {
+	line int    // The line that the record starts on, starting from 1.
+	raw  string // The record as it is in the input, if it could be read.
+}
+
+// invalidRecordError - a record of the input that cannot be read as a transaction.
+type invalidRecordError struct {
+	transaction *loadTransaction // The fields that could be read from the record, and the record itself.
+	err         error
+}
+
+func (e *invalidRecordError) Error() string {
+	record := e.transaction.record
+	if record.raw == "" {
+		return fmt.Sprintf("error loading transaction on line %d: %s", record.line, e.err.Error())
+	}
+	return fmt.Sprintf("error loading transaction %s on line %d: %s", record.raw, record.line, e.err.Error())
+}
+
+// openInput - open the given input file, or the standard input for "-". A file with the `.gz` extension is
+// decompressed transparently.
+// Params:
+//	inputFile: The file that contains transactions.
+// Returns:
+//	io.ReadCloser: The content of the input, which needs to be closed after use.
+//	error: Any error that occurred during opening the input.
+func openInput(inputFile string) (io.ReadCloser, error) {
+	if inputFile == StdinInput {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	file, err := os.Open(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(inputFile) != ".gz" {
+		return file, nil
+	}
+	decompressed, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("error decompressing: %s", err.Error())
+	}
+	return &gzipInput{Reader: decompressed, file: file}, nil
+}
+
+// gzipInput - the decompressed content of a gzip file.
+type gzipInput struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (i *gzipInput) Close() error {
+	err := i.Reader.Close()
+	if closeErr := i.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// newTransactionReader - create a reader of the transactions in the given input file in the manager's input format,
+// or in the format told by the extension of the file.
+func (m *ManagerDefault) newTransactionReader(input io.Reader, inputFile string) (transactionReader, error) {
+	format := m.inputFormat
+	if format == InputFormatAuto {
+		format = InputFormatNDJSON
+		if filepath.Ext(strings.TrimSuffix(inputFile, ".gz")) == ".csv" {
+			format = InputFormatCSV
+		}
+	}
+	if format == InputFormatCSV {
+		return newCSVTransactionReader(input, m.csvColumns)
+	}
+	return newNDJSONTransactionReader(input), nil
+}
+
+/****************************************************************************************/
+
+// maxNDJSONRecordSize - the maximum size of a line of an NDJSON input. A longer line is an invalid record.
+const maxNDJSONRecordSize = 1 << 20
+
+// ndjsonTransactionReader - a reader of NDJSON transactions, one JSON object per line. Blank lines are skipped.
+type ndjsonTransactionReader struct {
+	reader *bufio.Reader
+	line   int
+}
+
+func newNDJSONTransactionReader(input io.Reader) *ndjsonTransactionReader {
+	return &ndjsonTransactionReader{reader: bufio.NewReader(input)}
+}
+
+func (r *ndjsonTransactionReader) next() (*loadTransaction, error) {
+	var raw []byte
+	for {
+		line, tooLong, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		r.line++
+		if tooLong {
+			transaction := &loadTransaction{record: inputRecord{line: r.line}}
+			return nil, &invalidRecordError{transaction: transaction,
+				err: fmt.Errorf("the line is longer than %d bytes", maxNDJSONRecordSize)}
+		}
+		if len(bytes.TrimSpace(line)) != 0 {
+			raw = line
+			break
+		}
+	}
+
+	// The fields decoded before an error are kept, so that an invalid record can still be told apart.
+	transaction := &loadTransaction{record: inputRecord{line: r.line, raw: string(raw)}}
+	if err := json.Unmarshal(raw, transaction); err != nil {
+		return nil, &invalidRecordError{transaction: transaction, err: err}
+	}
+	return transaction, nil
+}
+
+// readLine - read the next line of the input without its line break. The rest of a line longer than
+// maxNDJSONRecordSize is skipped without being kept in memory, and only whether it is too long is returned.
+// It returns io.EOF at the end of the input.
+func (r *ndjsonTransactionReader) readLine() ([]byte, bool, error) {
+	var line []byte
+	tooLong, empty := false, true
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		empty = empty && len(chunk) == 0
+		if !tooLong && len(line)+len(chunk) > maxNDJSONRecordSize+len("\r\n") {
+			tooLong, line = true, nil
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || empty) {
+			return nil, false, err
+		}
+		break
+	}
+	line = bytes.TrimSuffix(line, []byte{'\n'})
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	if !tooLong && len(line) > maxNDJSONRecordSize {
+		tooLong, line = true, nil
+	}
+	return line, tooLong, nil
+}
+
+/****************************************************************************************/
+
+// csvTransactionReader - a reader of CSV transactions. The first row is a header that names the columns, and the
+// other rows are transactions. The columns that are not mapped to a field of transactions are ignored.
+type csvTransactionReader struct {
+	reader  *csv.Reader
+	lines   *lineCountingReader
+	indexes map[string]int // The index of the column of each field, if there is one.
+}
+
+// newCSVTransactionReader - read the header of the given CSV input and create a reader of its transactions.
+// Params:
+//	input: The CSV input.
+//	columns: The columns that fields are read from, indexed by field. A field is read from the column with its name
+//		by default.
+// Returns:
+//	*csvTransactionReader: The reader of the transactions after the header.
+//	error: Any error that occurred during reading the header, or a required field without a column.
+func newCSVTransactionReader(input io.Reader, columns map[string]string) (*csvTransactionReader, error) {
+	lines := &lineCountingReader{reader: bufio.NewReader(input)}
+	reader := csv.NewReader(lines)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("the CSV header is missing")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading the CSV header: %s", err.Error())
+	}
+
+	indexes := make(map[string]int, len(csvFields))
+	for _, field := range csvFields {
+		column := field
+		if columns[field] != "" {
+			column = columns[field]
+		}
+		for i, name := range header {
+			if strings.TrimSpace(name) == column {
+				indexes[field] = i
+				break
+			}
+		}
+	}
+	for _, field := range csvRequiredFields {
+		if _, ok := indexes[field]; !ok {
+			column := field
+			if columns[field] != "" {
+				column = columns[field]
+			}
+			return nil, fmt.Errorf("the CSV header has no column %q for the field %q", column, field)
+		}
+	}
+	return &csvTransactionReader{reader: reader, lines: lines, indexes: indexes}, nil
+}
+
+func (r *csvTransactionReader) next() (*loadTransaction, error) {
+	row, err := r.reader.Read()
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		// A row with a bare quote is skipped, while an unterminated quote would swallow the rest of the input.
+		if parseErr, ok := err.(*csv.ParseError); ok && parseErr.Err != csv.ErrQuote {
+			transaction := &loadTransaction{record: inputRecord{line: parseErr.StartLine}}
+			return nil, &invalidRecordError{transaction: transaction, err: parseErr.Err}
+		}
+		return nil, err
+	}
+	// The row ends on the last line read, and starts as many lines before as there are line breaks in its fields.
+	line := r.lines.lastLine()
+	for _, field := range row {
+		line -= strings.Count(field, "\n")
+	}
+
+	value := func(field string) string {
+		i, ok := r.indexes[field]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+	transaction := &loadTransaction{
+		ID:          identifier(value("id")),
+		CustomerID:  identifier(value("customer_id")),
+		Type:        transactionType(value("type")),
+		RecipientID: identifier(value("recipient_id")),
+		OriginalID:  identifier(value("original_id")),
+		LoadAmount:  value("load_amount"),
+		record:      inputRecord{line: line, raw: formatCSVRow(row)},
+	}
+	if transaction.Time, err = time.Parse(time.RFC3339Nano, value("time")); err != nil {
+		return nil, &invalidRecordError{transaction: transaction, err: fmt.Errorf("invalid time: %s", err.Error())}
+	}
+	return transaction, nil
+}
+
+// lineCountingReader - a reader that hands out its input at most one line at a time, so that the lines read from it
+// are the lines consumed by the CSV reader on top of it, and counts them.
+type lineCountingReader struct {
+	reader  *bufio.Reader
+	pending []byte // The rest of the current line, not read yet.
+	lines   int    // The number of line breaks read.
+	partial bool   // Whether the last line read has no line break yet.
+}
+
+func (r *lineCountingReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(r.pending) == 0 {
+		line, err := r.reader.ReadSlice('\n')
+		if len(line) == 0 {
+			return 0, err
+		}
+		r.pending = line
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	r.lines += bytes.Count(p[:n], []byte{'\n'})
+	r.partial = p[n-1] != '\n'
+	return n, nil
+}
+
+// lastLine - return the line that the last byte read is on, starting from 1.
+func (r *lineCountingReader) lastLine() int {
+	if r.partial {
+		return r.lines + 1
+	}
+	return r.lines
+}
+
+// formatCSVRow - format the given row as it would be in a CSV input.
+func formatCSVRow(row []string) string {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	_ = w.Write(row)
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,258 @@
+package account
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCSVColumns(t *testing.T) {
+	testCases := []struct {
+		caseName string
+		s        string
+		columns  map[string]string
+		err      string
+	}{
+		{
+			caseName: "No mapping",
+			s:        "",
+			columns:  map[string]string{},
+		},
+		{
+			caseName: "Fields mapped to columns",
+			s:        "load_amount=amount, time = created_at",
+			columns:  map[string]string{"load_amount": "amount", "time": "created_at"},
+		},
+		{
+			caseName: "A mapping without a column",
+			s:        "load_amount=",
+			err:      `invalid mapping "load_amount=": must be <field>=<column>`,
+		},
+		{
+			caseName: "An unknown field",
+			s:        "amount=load_amount",
+			err: `invalid field "amount": must be one of id, customer_id, type, recipient_id, original_id, ` +
+				`load_amount, time`,
+		},
+	}
+
+	for _, c := range testCases {
+		columns, err := ParseCSVColumns(c.s)
+		if c.err != "" {
+			assert.EqualError(t, err, c.err, c.caseName)
+			continue
+		}
+		assert.NoError(t, err, c.caseName)
+		assert.Equal(t, c.columns, columns, c.caseName)
+	}
+}
+
+func TestCSVTransactionReader(t *testing.T) {
+	input := strings.Join([]string{
+		"created_at,amount,customer_id,id,note",
+		"2000-01-01T00:00:00Z,$1.00,1,10,first",
+		`2000-01-01T00:01:00Z,$2.00,1,11,"a, quoted note"`,
+		"yesterday,$3.00,1,12,",
+		`2000-01-01T00:03:00Z,$4.00,1,13,a "bare" quote`,
+		"",
+		"2000-01-01T00:04:00Z,$5.00,2,14,\"two\r\nlines\"\r",
+		"2000-01-01T00:05:00Z,$6.00,2,15",
+	}, "\n")
+	r, err := newCSVTransactionReader(strings.NewReader(input),
+		map[string]string{"load_amount": "amount", "time": "created_at"})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	transactions := make([]*loadTransaction, 0)
+	invalid := make([]string, 0)
+	for {
+		transaction, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if assert.IsType(t, &invalidRecordError{}, err) {
+				invalid = append(invalid, err.Error())
+			}
+			continue
+		}
+		transactions = append(transactions, transaction)
+	}
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, []*loadTransaction{
+		{ID: "10", CustomerID: "1", LoadAmount: "$1.00", Time: start,
+			record: inputRecord{line: 2, raw: "2000-01-01T00:00:00Z,$1.00,1,10,first"}},
+		{ID: "11", CustomerID: "1", LoadAmount: "$2.00", Time: start.Add(time.Minute),
+			record: inputRecord{line: 3, raw: `2000-01-01T00:01:00Z,$2.00,1,11,"a, quoted note"`}},
+		{ID: "14", CustomerID: "2", LoadAmount: "$5.00", Time: start.Add(4 * time.Minute),
+			record: inputRecord{line: 7, raw: "2000-01-01T00:04:00Z,$5.00,2,14,\"two\nlines\""}},
+		{ID: "15", CustomerID: "2", LoadAmount: "$6.00", Time: start.Add(5 * time.Minute),
+			record: inputRecord{line: 9, raw: "2000-01-01T00:05:00Z,$6.00,2,15"}},
+	}, transactions)
+	assert.Equal(t, []string{
+		`error loading transaction yesterday,$3.00,1,12, on line 4: invalid time: ` +
+			`parsing time "yesterday" as "2006-01-02T15:04:05.999999999Z07:00": cannot parse "yesterday" as "2006"`,
+		`error loading transaction on line 5: bare " in non-quoted-field`,
+	}, invalid)
+
+	// The header must have a column for each required field.
+	_, err = newCSVTransactionReader(strings.NewReader(""), nil)
+	assert.EqualError(t, err, "the CSV header is missing")
+	_, err = newCSVTransactionReader(strings.NewReader("id,customer_id,load_amount,time\n"),
+		map[string]string{"time": "created_at"})
+	assert.EqualError(t, err, `the CSV header has no column "created_at" for the field "time"`)
+}
+
+func TestNDJSONTransactionReader(t *testing.T) {
+	longNote := strings.Repeat("x", maxNDJSONRecordSize)
+	input := strings.Join([]string{
+		`{"id":"1","customer_id":"1","load_amount":"$1.00","time":"2000-01-01T00:00:00Z"}`,
+		"",
+		`{"id":"2","customer_id":"1","load_amount":"$2.00","time":"2000-01-01T00:01:00Z","note":"` + longNote + `"}`,
+		`{"id":"3","customer_id":"1","load_amount":"$3.00","time":"2000-01-01T00:02:00Z"}` + "\r",
+		`{"id":"4",`,
+		`{"id":"5","customer_id":"2","load_amount":"$5.00","time":"2000-01-01T00:04:00Z"}`,
+	}, "\n")
+	r := newNDJSONTransactionReader(strings.NewReader(input))
+
+	transactions := make([]*loadTransaction, 0)
+	invalid := make([]string, 0)
+	for {
+		transaction, err := r.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if assert.IsType(t, &invalidRecordError{}, err) {
+				invalid = append(invalid, err.Error())
+			}
+			continue
+		}
+		transactions = append(transactions, transaction)
+	}
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, []*loadTransaction{
+		{ID: "1", CustomerID: "1", LoadAmount: "$1.00", Time: start, record: inputRecord{line: 1,
+			raw: `{"id":"1","customer_id":"1","load_amount":"$1.00","time":"2000-01-01T00:00:00Z"}`}},
+		{ID: "3", CustomerID: "1", LoadAmount: "$3.00", Time: start.Add(2 * time.Minute), record: inputRecord{line: 4,
+			raw: `{"id":"3","customer_id":"1","load_amount":"$3.00","time":"2000-01-01T00:02:00Z"}`}},
+		{ID: "5", CustomerID: "2", LoadAmount: "$5.00", Time: start.Add(4 * time.Minute), record: inputRecord{line: 6,
+			raw: `{"id":"5","customer_id":"2","load_amount":"$5.00","time":"2000-01-01T00:04:00Z"}`}},
+	}, transactions)
+	assert.Equal(t, []string{
+		"error loading transaction on line 3: the line is longer than 1048576 bytes",
+		`error loading transaction {"id":"4", on line 5: unexpected end of JSON input`,
+	}, invalid)
+}
+
+func TestProcessInputFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "koho-input-test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	defer func(stdin *os.File) {
+		os.Stdin = stdin
+	}(os.Stdin)
+
+	ndjson := strings.Join([]string{
+		`{"id":"1","customer_id":"1","load_amount":"$3000.00","time":"2000-01-03T00:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$3000.00","time":"2000-01-03T01:00:00Z"}`,
+		`{"id":"4","customer_id":"2","load_amount":"$1.00","time":"yesterday"}`,
+		`{"id":"3","customer_id":"2","type":"withdrawal","load_amount":"$1.00","time":"2000-01-03T02:00:00Z"}`,
+	}, "\n")
+	csv := strings.Join([]string{
+		"id,customer_id,type,load_amount,time",
+		"1,1,,$3000.00,2000-01-03T00:00:00Z",
+		"2,1,,$3000.00,2000-01-03T01:00:00Z",
+		"4,2,,$1.00,yesterday",
+		"3,2,withdrawal,$1.00,2000-01-03T02:00:00Z",
+	}, "\n")
+	gzipped := func(s string) string {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		_, _ = w.Write([]byte(s))
+		_ = w.Close()
+		return b.String()
+	}
+	output := []string{
+		`{"id":"1","customer_id":"1","accepted":true}`,
+		`{"id":"2","customer_id":"1","accepted":false}`,
+		`{"id":"4","customer_id":"2","accepted":false}`,
+		`{"id":"3","customer_id":"2","type":"withdrawal","accepted":false}`,
+	}
+
+	testCases := []struct {
+		caseName  string
+		inputFile string
+		content   string
+		options   []ManagerOption
+		stdin     bool
+	}{
+		{
+			caseName:  "CSV told by the extension",
+			inputFile: "input.csv",
+			content:   csv,
+		},
+		{
+			caseName:  "CSV given by the input format",
+			inputFile: "input.txt",
+			content:   csv,
+			options:   []ManagerOption{WithInputFormat(InputFormatCSV)},
+		},
+		{
+			caseName:  "Gzip-compressed NDJSON",
+			inputFile: "input.txt.gz",
+			content:   gzipped(ndjson),
+		},
+		{
+			caseName:  "Gzip-compressed CSV",
+			inputFile: "input.csv.gz",
+			content:   gzipped(csv),
+		},
+		{
+			caseName:  "NDJSON from the standard input",
+			inputFile: "stdin.txt",
+			content:   ndjson,
+			stdin:     true,
+		},
+	}
+
+	for _, c := range testCases {
+		inputFile := filepath.Join(dir, c.inputFile)
+		outputFile := filepath.Join(dir, "output.txt")
+		if !assert.NoError(t, ioutil.WriteFile(inputFile, []byte(c.content), 0644), c.caseName) {
+			continue
+		}
+		if c.stdin {
+			stdin, err := os.Open(inputFile)
+			if !assert.NoError(t, err, c.caseName) {
+				continue
+			}
+			defer func() {
+				_ = stdin.Close()
+			}()
+			os.Stdin = stdin
+			inputFile = StdinInput
+		}
+		err := NewManager(c.options...).ProcessLoadTransactions(context.Background(), inputFile, outputFile)
+		if !assert.NoError(t, err, c.caseName) {
+			continue
+		}
+		content, err := ioutil.ReadFile(outputFile)
+		assert.NoError(t, err, c.caseName)
+		assert.Equal(t, output, strings.Split(strings.TrimSpace(string(content)), "\n"), c.caseName)
+	}
+}
@@ -0,0 +1,222 @@
+package account
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// LatePolicy - what to do with a transaction that arrives after the lateness watermark has passed its time,
+// so that it cannot be processed in time order with the other transactions of its customer anymore.
+type LatePolicy string
+
+const (
+	// LateDecline - decline the late transaction without checking or counting it.
+	LateDecline LatePolicy = "decline"
+	// LateFlag - process the late transaction as it arrives and flag its result as late.
+	LateFlag LatePolicy = "flag"
+)
+
+// ParseLatePolicy - parse the given late policy name.
+func ParseLatePolicy(s string) (LatePolicy, error) {
+	switch policy := LatePolicy(s); policy {
+	case LateDecline, LateFlag:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid late policy %q: must be one of %q, %q", s, LateDecline, LateFlag)
+	}
+}
+
+// outcomeLate - the transaction arrived after the lateness watermark had passed its time.
+const outcomeLate resultOutcome = "late"
+
+// DefaultLatenessBufferSize - the default number of records read after a transaction that it can be held for.
+const DefaultLatenessBufferSize = 10000
+
+// latenessBuffer - a buffer that holds transactions until the lateness watermark of their customer passes their
+// time, so that the transactions of a customer are released in time order even if they are out of order in the input.
+// The watermark of a customer is the time of the latest transaction of the customer read minus the allowed lateness,
+// and it never goes back. A transaction is also released once `size` more records are read after it, and the watermark
+// of its customer then moves to its time. So which transactions are released and late only depends on the input.
+//
+// The watermark of a customer is forgotten once `2*size` records are read after the latest transaction of the customer:
+// none of the customer's transactions is held after `size` records, and the watermark still tells late transactions
+// apart for `size` more. So the buffer remembers at most `2*size` customers.
+type latenessBuffer struct {
+	lateness  time.Duration
+	size      uint64
+	next      uint64 // The sequence number of the next record to read.
+	customers map[identifier]*customerWatermark
+	recent    []recentCustomer   // The customers of the records read lately, in input order.
+	held      []*loadTransaction // The transactions held in input order, some of which may be released already.
+	released  []*loadTransaction // The transactions released but not popped yet, in the order they are released.
+}
+
+// customerWatermark - the lateness watermark of a customer and the transactions of the customer held until it passes
+// their time.
+type customerWatermark struct {
+	latest    time.Time // The time of the latest transaction of the customer read.
+	watermark time.Time
+	forgetAt  uint64 // The sequence number of the record that the watermark is forgotten at.
+	held      transactionHeap
+}
+
+// recentCustomer - a customer whose watermark may be forgotten at the record with the given sequence number.
+type recentCustomer struct {
+	customerID identifier
+	forgetAt   uint64
+}
+
+// watermarkState - the lateness watermark of a customer recorded in a checkpoint, so that a resumed run still tells
+// which transactions of the customer are late.
+type watermarkState struct {
+	Latest    time.Time `json:"latest"`
+	Watermark time.Time `json:"watermark"`
+	Records   uint64    `json:"records"` // The number of records that the watermark is remembered for.
+}
+
+func newLatenessBuffer(lateness time.Duration, size int) *latenessBuffer {
+	return &latenessBuffer{
+		lateness:  lateness,
+		size:      uint64(size),
+		customers: make(map[identifier]*customerWatermark, 0),
+	}
+}
+
+// push - hold the given transaction until the watermark of its customer passes its time. It returns false without
+// holding the transaction if the watermark has already passed its time, i.e. the transaction is late.
+func (b *latenessBuffer) push(t *loadTransaction) bool {
+	c := b.customers[t.CustomerID]
+	if c == nil {
+		c = &customerWatermark{}
+		b.customers[t.CustomerID] = c
+	}
+	c.forgetAt = t.seq + 2*b.size
+	b.recent = append(b.recent, recentCustomer{customerID: t.CustomerID, forgetAt: c.forgetAt})
+	if t.Time.Before(c.watermark) {
+		return false
+	}
+	heap.Push(&c.held, t)
+	b.held = append(b.held, t)
+	if t.Time.After(c.latest) {
+		c.latest = t.Time
+	}
+	b.advance(c, c.latest.Add(-b.lateness))
+	return true
+}
+
+// expire - release the transactions held since `size` records before the record with the given sequence number,
+// which is read next, and forget the watermarks of the customers without any transaction since then.
+func (b *latenessBuffer) expire(seq uint64) {
+	b.next = seq + 1
+	b.release(seq)
+	for len(b.recent) > 0 && b.recent[0].forgetAt <= seq {
+		r := b.recent[0]
+		b.recent = b.recent[1:]
+		if c := b.customers[r.customerID]; c != nil && c.forgetAt == r.forgetAt && len(c.held) == 0 {
+			delete(b.customers, r.customerID)
+		}
+	}
+}
+
+// flush - release all the held transactions, e.g. at the end of the input. The watermarks are still remembered.
+func (b *latenessBuffer) flush() {
+	b.release(^uint64(0))
+}
+
+// release - release the transactions held since `size` records before the record with the given sequence number.
+func (b *latenessBuffer) release(seq uint64) {
+	for len(b.held) > 0 {
+		t := b.held[0]
+		c := b.customers[t.CustomerID]
+		if t.seq+b.size > seq && t.Time.After(c.watermark) {
+			// The transaction is still held, and not for long enough.
+			return
+		}
+		b.held[0] = nil
+		b.held = b.held[1:]
+		b.advance(c, t.Time)
+	}
+}
+
+// watermarks - return the watermarks that are remembered, once the held transactions are flushed.
+func (b *latenessBuffer) watermarks() map[identifier]*watermarkState {
+	watermarks := make(map[identifier]*watermarkState, len(b.customers))
+	for customerID, c := range b.customers {
+		watermarks[customerID] = &watermarkState{Latest: c.latest, Watermark: c.watermark, Records: c.forgetAt - b.next}
+	}
+	return watermarks
+}
+
+// restoreWatermarks - remember the given watermarks before any record is read.
+func (b *latenessBuffer) restoreWatermarks(watermarks map[identifier]*watermarkState) {
+	for customerID, state := range watermarks {
+		b.customers[customerID] = &customerWatermark{latest: state.Latest, watermark: state.Watermark,
+			forgetAt: state.Records}
+		b.recent = append(b.recent, recentCustomer{customerID: customerID, forgetAt: state.Records})
+	}
+	sort.Slice(b.recent, func(i, j int) bool {
+		return b.recent[i].forgetAt < b.recent[j].forgetAt
+	})
+}
+
+// pop - return the next released transaction, or nil if there is none.
+func (b *latenessBuffer) pop() *loadTransaction {
+	if len(b.released) == 0 {
+		return nil
+	}
+	t := b.released[0]
+	b.released[0] = nil
+	b.released = b.released[1:]
+	return t
+}
+
+// watermarkOf - return the watermark of the given customer.
+func (b *latenessBuffer) watermarkOf(customerID identifier) time.Time {
+	if c := b.customers[customerID]; c != nil {
+		return c.watermark
+	}
+	return time.Time{}
+}
+
+// advance - move the watermark of the given customer to the given time unless it is already past it, and release
+// the transactions of the customer whose time it has passed.
+func (b *latenessBuffer) advance(c *customerWatermark, watermark time.Time) {
+	if watermark.After(c.watermark) {
+		c.watermark = watermark
+	}
+	for len(c.held) > 0 && !c.held[0].Time.After(c.watermark) {
+		b.released = append(b.released, heap.Pop(&c.held).(*loadTransaction))
+	}
+}
+
+// transactionHeap - a min-heap of transactions ordered by time, then by their position in the input.
+type transactionHeap []*loadTransaction
+
+func (h transactionHeap) Len() int {
+	return len(h)
+}
+
+func (h transactionHeap) Less(i, j int) bool {
+	if h[i].Time.Equal(h[j].Time) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].Time.Before(h[j].Time)
+}
+
+func (h transactionHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *transactionHeap) Push(x interface{}) {
+	*h = append(*h, x.(*loadTransaction))
+}
+
+func (h *transactionHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return t
+}
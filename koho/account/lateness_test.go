@@ -0,0 +1,211 @@
+package account
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatenessBuffer(t *testing.T) {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	newTransaction := func(seq uint64, customerID identifier, minutes int) *loadTransaction {
+		return &loadTransaction{seq: seq, CustomerID: customerID, Time: start.Add(time.Duration(minutes) * time.Minute)}
+	}
+	released := func(b *latenessBuffer) []uint64 {
+		seqs := make([]uint64, 0)
+		for t := b.pop(); t != nil; t = b.pop() {
+			seqs = append(seqs, t.seq)
+		}
+		return seqs
+	}
+
+	b := newLatenessBuffer(time.Hour, 4)
+	assert.True(t, b.push(newTransaction(0, "1", 30)))
+	assert.True(t, b.push(newTransaction(1, "1", 0)))
+	assert.Empty(t, released(b))
+
+	// The watermark of a customer only moves with the transactions of the customer.
+	assert.True(t, b.push(newTransaction(2, "2", 120)))
+	assert.Empty(t, released(b))
+
+	// The watermark passes the held transactions once a transaction of the customer an hour later is read.
+	assert.True(t, b.push(newTransaction(3, "1", 60)))
+	assert.Equal(t, []uint64{1}, released(b))
+	assert.True(t, b.push(newTransaction(4, "1", 90)))
+	assert.Equal(t, []uint64{0}, released(b))
+
+	// A transaction older than the watermark is late, while a transaction at the watermark is not.
+	assert.False(t, b.push(newTransaction(5, "1", 29)))
+	assert.True(t, b.push(newTransaction(6, "1", 30)))
+	assert.Equal(t, []uint64{6}, released(b))
+
+	// A transaction held for the size of the buffer is released, and the watermark of its customer moves to its time.
+	b.expire(5)
+	assert.Empty(t, released(b))
+	b.expire(6)
+	assert.Equal(t, []uint64{2}, released(b))
+	assert.False(t, b.push(newTransaction(7, "2", 119)))
+	assert.Equal(t, start.Add(120*time.Minute), b.watermarkOf("2"))
+
+	// The remaining transactions are released in time order.
+	b.flush()
+	assert.Equal(t, []uint64{3, 4}, released(b))
+	assert.Nil(t, b.pop())
+}
+
+func TestLatenessBufferForgetsWatermarks(t *testing.T) {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newLatenessBuffer(time.Hour, 2)
+	read := func(seq uint64, customerID identifier, minutes int) bool {
+		b.expire(seq)
+		late := !b.push(&loadTransaction{seq: seq, CustomerID: customerID, Time: start.Add(time.Duration(minutes) *
+			time.Minute)})
+		for b.pop() != nil {
+		}
+		return late
+	}
+
+	assert.False(t, read(0, "1", 120))
+	assert.False(t, read(1, "2", 0))
+	assert.False(t, read(2, "2", 1))
+	assert.Equal(t, start.Add(120*time.Minute), b.watermarkOf("1"))
+
+	// The watermarks are kept across a checkpoint, where the held transactions are flushed, and the watermark of a
+	// customer is forgotten once twice the size of the buffer of records is read after the latest transaction of the
+	// customer.
+	b.flush()
+	watermarks := b.watermarks()
+	assert.Equal(t, &watermarkState{Latest: start.Add(120 * time.Minute), Watermark: start.Add(120 * time.Minute),
+		Records: 1}, watermarks["1"])
+	b = newLatenessBuffer(time.Hour, 2)
+	b.restoreWatermarks(watermarks)
+	assert.True(t, read(0, "2", 0))
+	assert.Equal(t, start.Add(120*time.Minute), b.watermarkOf("1"))
+	assert.False(t, read(1, "2", 2))
+	assert.Equal(t, time.Time{}, b.watermarkOf("1"))
+	assert.False(t, read(2, "1", 0))
+	assert.Len(t, b.customers, 2)
+}
+
+func TestProcessOutOfOrderTransactions(t *testing.T) {
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$3000.00","time":"2000-01-03T10:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$3000.00","time":"2000-01-03T09:00:00Z"}`,
+		`{"id":"3","customer_id":"1","type":"withdrawal","load_amount":"$3000.00","time":"2000-01-03T09:30:00Z"}`,
+		`{"id":"4","customer_id":"1","load_amount":"$100.00","time":"2000-01-03T12:00:00Z"}`,
+		`{"id":"5","customer_id":"1","load_amount":"$1000.00","time":"2000-01-03T09:45:00Z"}`,
+	}
+	testCases := []struct {
+		caseName string
+		options  []ManagerOption
+		output   []string
+	}{
+		{
+			caseName: "Transactions are processed in input order by default",
+			output: []string{
+				`{"id":"1","customer_id":"1","accepted":true}`,
+				`{"id":"2","customer_id":"1","accepted":false}`,
+				`{"id":"3","customer_id":"1","type":"withdrawal","accepted":true}`,
+				`{"id":"4","customer_id":"1","accepted":true}`,
+				`{"id":"5","customer_id":"1","accepted":true}`,
+			},
+		},
+		{
+			caseName: "Transactions are processed in time order within the lateness",
+			options:  []ManagerOption{WithLateness(3*time.Hour, LateDecline)},
+			output: []string{
+				`{"id":"1","customer_id":"1","accepted":false}`,
+				`{"id":"2","customer_id":"1","accepted":true}`,
+				`{"id":"3","customer_id":"1","type":"withdrawal","accepted":true}`,
+				`{"id":"4","customer_id":"1","accepted":true}`,
+				`{"id":"5","customer_id":"1","accepted":true}`,
+			},
+		},
+		{
+			caseName: "Late transactions are declined",
+			options:  []ManagerOption{WithLateness(2*time.Hour, LateDecline)},
+			output: []string{
+				`{"id":"1","customer_id":"1","accepted":false}`,
+				`{"id":"2","customer_id":"1","accepted":true}`,
+				`{"id":"3","customer_id":"1","type":"withdrawal","accepted":true}`,
+				`{"id":"4","customer_id":"1","accepted":true}`,
+				`{"id":"5","customer_id":"1","accepted":false,"outcome":"late"}`,
+			},
+		},
+		{
+			caseName: "Late transactions are processed as they arrive and flagged",
+			options:  []ManagerOption{WithLateness(30*time.Minute, LateFlag)},
+			output: []string{
+				`{"id":"1","customer_id":"1","accepted":false}`,
+				`{"id":"2","customer_id":"1","accepted":true,"outcome":"late"}`,
+				`{"id":"3","customer_id":"1","type":"withdrawal","accepted":true}`,
+				`{"id":"4","customer_id":"1","accepted":true}`,
+				`{"id":"5","customer_id":"1","accepted":true,"outcome":"late"}`,
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		options := append([]ManagerOption{WithWorkers(2)}, c.options...)
+		assert.Equal(t, c.output, runManager(t, NewManager(options...), input), c.caseName)
+	}
+}
+
+func TestProcessOutOfOrderTransactionsWithFewPendingSlots(t *testing.T) {
+	// Customers send their transactions out of order, and customer 0 sends one far in the future that must not make
+	// the transactions of the other customers late. The decisions do not depend on the number of pending slots.
+	input := []string{`{"id":"0","customer_id":"0","load_amount":"$1.00","time":"2000-01-10T00:00:00Z"}`}
+	for i := 1; i < 200; i++ {
+		minute := i % 60
+		if i%3 == 0 {
+			minute = (i + 30) % 60
+		}
+		input = append(input, fmt.Sprintf(
+			`{"id":"%d","customer_id":"%d","load_amount":"$%d.00","time":"2000-01-03T%02d:%02d:00Z"}`,
+			i, i%7, 500+i*37%1500, i/60, minute))
+	}
+
+	expected := runManager(t, NewManager(WithLateness(30*time.Minute, LateDecline), WithWorkers(4)), input)
+	for _, options := range [][]ManagerOption{
+		{WithMaxPendingTransactions(1), WithWorkers(4)},
+		{WithMaxPendingTransactions(1), WithWorkers(1)},
+		{WithMaxPendingTransactions(3), WithWorkers(2), WithInputOrder(false)},
+	} {
+		m := NewManager(append(options, WithLateness(30*time.Minute, LateDecline))...)
+		output := runManager(t, m, input)
+		if m.inputOrder {
+			assert.Equal(t, expected, output)
+		} else {
+			assert.ElementsMatch(t, expected, output)
+		}
+	}
+
+	late := 0
+	for _, line := range expected {
+		if strings.Contains(line, `"late"`) {
+			late++
+		}
+	}
+	assert.True(t, late > 0 && late < len(expected)/2, "%d late transactions", late)
+
+	// A transaction held for the size of the lateness buffer is released, so the output does not wait for it until
+	// the end of the input, whatever the number of pending slots.
+	m := NewManager(WithLateness(time.Hour, LateDecline), WithLatenessBufferSize(2), WithMaxPendingTransactions(1))
+	output := runManager(t, m, []string{
+		`{"id":"1","customer_id":"1","load_amount":"$1.00","time":"2000-01-03T00:30:00Z"}`,
+		`{"id":"2","customer_id":"2","load_amount":"$1.00","time":"2000-01-03T00:00:00Z"}`,
+		`{"id":"3","customer_id":"2","load_amount":"$1.00","time":"2000-01-03T00:01:00Z"}`,
+		`{"id":"4","customer_id":"1","load_amount":"$1.00","time":"2000-01-03T00:29:00Z"}`,
+		`{"id":"5","customer_id":"1","load_amount":"$1.00","time":"2000-01-03T00:31:00Z"}`,
+	})
+	assert.Equal(t, []string{
+		`{"id":"1","customer_id":"1","accepted":true}`,
+		`{"id":"2","customer_id":"2","accepted":true}`,
+		`{"id":"3","customer_id":"2","accepted":true}`,
+		`{"id":"4","customer_id":"1","accepted":false,"outcome":"late"}`,
+		`{"id":"5","customer_id":"1","accepted":true}`,
+	}, output)
+}
@@ -0,0 +1,278 @@
+package account
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ledgerAccount - the name of an account in the ledger.
+type ledgerAccount string
+
+// settlementAccount - the ledger account of the funds held for customers outside of their wallets, e.g. in the bank.
+// Loads move funds from it to customers' wallets and withdrawals move funds from customers' wallets back to it.
+const settlementAccount ledgerAccount = "settlement"
+
+// walletAccount - return the ledger account of the given customer's wallet.
+func walletAccount(customerID identifier) ledgerAccount {
+	return ledgerAccount("customer:" + customerID.String())
+}
+
+// posting - a debit or a credit of a ledger account.
+type posting struct {
+	account ledgerAccount
+	debit   money
+	credit  money
+}
+
+// ledgerEntry - the postings of an accepted transaction. The debits of an entry always equal its credits.
+type ledgerEntry struct {
+	postings []posting
+}
+
+// ledgerEntry - return the entry that posts the transaction to the ledger.
+// The settlement account is an asset, so it is debited when funds arrive, while a wallet is the customer's funds
+// owed by us, so it is credited when funds arrive.
+func (t *loadTransaction) ledgerEntry() *ledgerEntry {
+	var debited, credited ledgerAccount
+	switch t.Type {
+	case transactionTypeReversal:
+		return t.reversalLedgerEntry()
+	case transactionTypeWithdrawal:
+		debited, credited = walletAccount(t.CustomerID), settlementAccount
+	case transactionTypeTransfer:
+		debited, credited = walletAccount(t.CustomerID), walletAccount(t.RecipientID)
+	default:
+		debited, credited = settlementAccount, walletAccount(t.CustomerID)
+	}
+	return &ledgerEntry{postings: []posting{
+		{account: debited, debit: t.loadAmount},
+		{account: credited, credit: t.loadAmount},
+	}}
+}
+
+// balanceLimit - the maximum balance of a customer's wallet.
+type balanceLimit struct {
+	maxBalance money
+	message    string
+	rule       string // The name of the rule that sets the limit.
+}
+
+// walletLockStripes - the number of locks that wallets are hashed to, so that transactions of different wallets
+// rarely wait for each other while the number of locks stays fixed whatever the number of wallets.
+const walletLockStripes = 256
+
+// ledger - a double-entry ledger of the accepted transactions. It maintains the balance of every ledger account
+// as debits minus credits, so the balance of a customer's wallet is the negation of its ledger balance.
+//
+// A wallet's balance is checked and changed with the wallet locked (see lockWallets), so that it cannot change in
+// between. `mutex` only guards the balances for the time of a read or an update, as the settlement account is
+// changed by every load and withdrawal but never checked.
+type ledger struct {
+	balances map[ledgerAccount]money
+	entries  uint64
+	seq      uint64 // The sequence number of the last transaction posted, if the account store persists decisions.
+	mutex    *sync.Mutex
+	wallets  []sync.Mutex
+}
+
+func newLedger() *ledger {
+	return &ledger{
+		balances: make(map[ledgerAccount]money, 0),
+		mutex:    &sync.Mutex{},
+		wallets:  make([]sync.Mutex, walletLockStripes),
+	}
+}
+
+// wallets - return the wallets that the entry debits or credits.
+func (e *ledgerEntry) wallets() []ledgerAccount {
+	wallets := make([]ledgerAccount, 0, len(e.postings))
+	for _, p := range e.postings {
+		if p.account != settlementAccount {
+			wallets = append(wallets, p.account)
+		}
+	}
+	return wallets
+}
+
+// lockWallets - lock the given wallets and return the function that unlocks them. The locks are always taken in the
+// same order, so that two transfers between the same wallets in opposite directions cannot deadlock.
+func (l *ledger) lockWallets(wallets ...ledgerAccount) func() {
+	stripes := make([]int, 0, len(wallets))
+	for _, wallet := range wallets {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(wallet))
+		stripes = append(stripes, int(h.Sum32()%walletLockStripes))
+	}
+	sort.Ints(stripes)
+	locked := make([]int, 0, len(stripes))
+	for i, stripe := range stripes {
+		if i > 0 && stripe == stripes[i-1] {
+			continue
+		}
+		l.wallets[stripe].Lock()
+		locked = append(locked, stripe)
+	}
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			l.wallets[locked[i]].Unlock()
+		}
+	}
+}
+
+// check - check whether the given entry can be posted. A wallet cannot be debited over its balance
+// nor credited over the given limit. The caller must hold the locks of the wallets of the entry.
+func (l *ledger) check(entry *ledgerEntry, limit *balanceLimit) error {
+	for _, p := range entry.postings {
+		if p.account == settlementAccount {
+			continue
+		}
+		l.mutex.Lock()
+		balance := -l.balances[p.account]
+		l.mutex.Unlock()
+		if p.debit > balance {
+			return newDeclineError(reasonInsufficientFunds, "insufficient funds (%s) in %s", balance, p.account)
+		}
+		if limit != nil && p.credit > 0 && balance+p.credit > limit.maxBalance {
+			err := newDeclineError(reasonMaxBalance, "%s in %s", limit.message, p.account)
+			err.rule = limit.rule
+			return err
+		}
+	}
+	return nil
+}
+
+// post - post the given entry of the transaction with the given sequence number. The caller must hold the locks of
+// the wallets of the entry, unless no other transaction is processed at the same time.
+func (l *ledger) post(entry *ledgerEntry, seq uint64) {
+	debits, credits := money(0), money(0)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, p := range entry.postings {
+		l.balances[p.account] += p.debit - p.credit
+		debits += p.debit
+		credits += p.credit
+	}
+	if debits != credits {
+		// This should never happen
+		panic(fmt.Sprintf("unbalanced ledger entry: debits %s, credits %s", debits, credits))
+	}
+	l.entries++
+	if seq > l.seq {
+		l.seq = seq
+	}
+}
+
+// unpost - take back the given entry posted for a transaction whose decision could not be persisted after all.
+// The caller must hold the locks of the wallets of the entry.
+func (l *ledger) unpost(entry *ledgerEntry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, p := range entry.postings {
+		l.balances[p.account] -= p.debit - p.credit
+	}
+	l.entries--
+}
+
+// balance - return the balance of the given customer's wallet.
+func (l *ledger) balance(customerID identifier) money {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return -l.balances[walletAccount(customerID)]
+}
+
+// ledgerSnapshot - a snapshot of the ledger. It reflects all the accepted transactions up to `Seq`.
+type ledgerSnapshot struct {
+	Seq      uint64                  `json:"seq"`
+	Entries  uint64                  `json:"entries"`
+	Balances map[ledgerAccount]money `json:"balances"`
+}
+
+// snapshot - return a snapshot of the ledger.
+func (l *ledger) snapshot() *ledgerSnapshot {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	snapshot := &ledgerSnapshot{
+		Seq:      l.seq,
+		Entries:  l.entries,
+		Balances: make(map[ledgerAccount]money, len(l.balances)),
+	}
+	for account, balance := range l.balances {
+		snapshot.Balances[account] = balance
+	}
+	return snapshot
+}
+
+// restore - replace the state of the ledger with the given snapshot.
+func (l *ledger) restore(snapshot *ledgerSnapshot) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.seq = snapshot.Seq
+	l.entries = snapshot.Entries
+	l.balances = make(map[ledgerAccount]money, len(snapshot.Balances))
+	for account, balance := range snapshot.Balances {
+		l.balances[account] = balance
+	}
+}
+
+// writeTrialBalance - write the debit or credit balance of every ledger account and their totals, which are
+// always equal. Amounts are aligned to the right like the columns of a paper ledger.
+func (l *ledger) writeTrialBalance(w io.Writer) error {
+	snapshot := l.snapshot()
+	accounts := make([]string, 0, len(snapshot.Balances))
+	for account := range snapshot.Balances {
+		accounts = append(accounts, string(account))
+	}
+	sort.Strings(accounts)
+
+	rows := [][]string{{"Account", "Debit", "Credit"}}
+	debits, credits := money(0), money(0)
+	for _, account := range accounts {
+		balance := snapshot.Balances[ledgerAccount(account)]
+		if balance > 0 {
+			debits += balance
+			rows = append(rows, []string{account, balance.String(), ""})
+		} else {
+			credits -= balance
+			rows = append(rows, []string{account, "", (-balance).String()})
+		}
+	}
+	rows = append(rows, []string{fmt.Sprintf("Total (%d entries)", snapshot.Entries), debits.String(), credits.String()})
+	return writeTable(w, rows, 1)
+}
+
+// writeTable - write the given rows as a table whose columns are separated by two spaces. The given number of
+// leading columns are left-aligned and the other ones are right-aligned.
+func writeTable(w io.Writer, rows [][]string, leftAligned int) error {
+	widths := make([]int, 0)
+	for _, row := range rows {
+		for i, cell := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			if len(cell) > widths[i] {
+				widths[i] = len(cell)
+			}
+		}
+	}
+	for _, row := range rows {
+		var line strings.Builder
+		for i, cell := range row {
+			if i > 0 {
+				line.WriteString("  ")
+			}
+			if i < leftAligned {
+				fmt.Fprintf(&line, "%-*s", widths[i], cell)
+			} else {
+				fmt.Fprintf(&line, "%*s", widths[i], cell)
+			}
+		}
+		if _, err := fmt.Fprintln(w, strings.TrimRight(line.String(), " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
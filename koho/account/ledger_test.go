@@ -0,0 +1,113 @@
+package account
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLedgerEntry(t *testing.T) {
+	testCases := []struct {
+		caseName    string
+		transaction *loadTransaction
+		postings    []posting
+	}{
+		{
+			caseName:    "A load moves funds from the settlement account to the wallet",
+			transaction: &loadTransaction{CustomerID: "1", Type: transactionTypeLoad, loadAmount: 100},
+			postings:    []posting{{account: settlementAccount, debit: 100}, {account: "customer:1", credit: 100}},
+		},
+		{
+			caseName:    "A withdrawal moves funds from the wallet to the settlement account",
+			transaction: &loadTransaction{CustomerID: "1", Type: transactionTypeWithdrawal, loadAmount: 100},
+			postings:    []posting{{account: "customer:1", debit: 100}, {account: settlementAccount, credit: 100}},
+		},
+		{
+			caseName: "A transfer moves funds from the wallet to the recipient's wallet",
+			transaction: &loadTransaction{CustomerID: "1", Type: transactionTypeTransfer, RecipientID: "2",
+				loadAmount: 100},
+			postings: []posting{{account: "customer:1", debit: 100}, {account: "customer:2", credit: 100}},
+		},
+	}
+
+	for _, c := range testCases {
+		assert.Equal(t, &ledgerEntry{postings: c.postings}, c.transaction.ledgerEntry(), c.caseName)
+	}
+}
+
+func TestLedgerCheck(t *testing.T) {
+	l := newLedger()
+	l.post((&loadTransaction{CustomerID: "1", loadAmount: 1000}).ledgerEntry(), 1)
+	limit := &balanceLimit{maxBalance: 1500, message: "exceeds maximum balance ($15.00)"}
+
+	testCases := []struct {
+		caseName    string
+		transaction *loadTransaction
+		limit       *balanceLimit
+		err         error
+	}{
+		{
+			caseName:    "Withdraw the whole balance",
+			transaction: &loadTransaction{CustomerID: "1", Type: transactionTypeWithdrawal, loadAmount: 1000},
+		},
+		{
+			caseName:    "Withdraw more than the balance",
+			transaction: &loadTransaction{CustomerID: "1", Type: transactionTypeWithdrawal, loadAmount: 1001},
+			err:         newDeclineError(reasonInsufficientFunds, "insufficient funds ($10.00) in customer:1"),
+		},
+		{
+			caseName:    "Load up to the maximum balance",
+			transaction: &loadTransaction{CustomerID: "1", Type: transactionTypeLoad, loadAmount: 500},
+			limit:       limit,
+		},
+		{
+			caseName:    "Load over the maximum balance",
+			transaction: &loadTransaction{CustomerID: "1", Type: transactionTypeLoad, loadAmount: 501},
+			limit:       limit,
+			err: newDeclineError(reasonMaxBalance,
+				"exceeds maximum balance ($15.00) in customer:1"),
+		},
+		{
+			caseName:    "Load over the maximum balance without a limit",
+			transaction: &loadTransaction{CustomerID: "1", Type: transactionTypeLoad, loadAmount: 501},
+		},
+		{
+			caseName: "Transfer over the recipient's maximum balance",
+			transaction: &loadTransaction{CustomerID: "1", Type: transactionTypeTransfer, RecipientID: "2",
+				loadAmount: 1000},
+			limit: &balanceLimit{maxBalance: 999, message: "too rich"},
+			err:   newDeclineError(reasonMaxBalance, "too rich in customer:2"),
+		},
+	}
+
+	for _, c := range testCases {
+		assert.Equal(t, c.err, l.check(c.transaction.ledgerEntry(), c.limit), c.caseName)
+	}
+}
+
+func TestLedgerTrialBalance(t *testing.T) {
+	l := newLedger()
+	l.post((&loadTransaction{CustomerID: "1", loadAmount: 1000}).ledgerEntry(), 1)
+	l.post((&loadTransaction{CustomerID: "2", loadAmount: 2000}).ledgerEntry(), 2)
+	l.post((&loadTransaction{CustomerID: "2", Type: transactionTypeTransfer, RecipientID: "1",
+		loadAmount: 500}).ledgerEntry(), 3)
+	l.post((&loadTransaction{CustomerID: "1", Type: transactionTypeWithdrawal, loadAmount: 1500}).ledgerEntry(), 5)
+	assert.Equal(t, uint64(5), l.seq)
+	assert.Equal(t, money(0), l.balance("1"))
+	assert.Equal(t, money(1500), l.balance("2"))
+
+	output := &bytes.Buffer{}
+	assert.NoError(t, l.writeTrialBalance(output))
+	assert.Equal(t, ""+
+		"Account             Debit  Credit\n"+
+		"customer:1                  $0.00\n"+
+		"customer:2                 $15.00\n"+
+		"settlement         $15.00\n"+
+		"Total (4 entries)  $15.00  $15.00\n", output.String())
+
+	// The ledger is restored from its snapshot as it was.
+	restored := newLedger()
+	restored.restore(l.snapshot())
+	assert.Equal(t, l.snapshot(), restored.snapshot())
+}
@@ -3,12 +3,18 @@ package account
 import (
 	"bufio"
 	"context"
-	"encoding/json"
 	"fmt"
+	"io"
 	"log"
-	"os"
+	"runtime"
+	"time"
+
+	"github.com/azhuox/code-interviews/koho/metrics"
 )
 
+// defaultMaxPendingTransactions - the default number of transactions that can be held in memory at the same time.
+const defaultMaxPendingTransactions = 1000
+
 // Manager defines the interface for managing accounts
 type Manager interface {
 	ProcessLoadTransactions(ctx context.Context, inputFile, outputFile string) error
@@ -16,221 +22,753 @@ type Manager interface {
 
 // ManagerDefault - default account manager.
 type ManagerDefault struct {
-	transactionCheckers []transactionChecker
+	transactionCheckers    map[transactionType][]transactionChecker
+	checkerNames           map[transactionType][]string
+	historyRetention       time.Duration
+	periods                map[transactionType][]rulePeriod
+	maxBalance             *balanceLimit
+	maxPendingTransactions int
+	workers                int
+	accountStore           AccountStore
+
+	identicalDuplicatePolicy   DuplicatePolicy
+	conflictingDuplicatePolicy DuplicatePolicy
+	duplicateRetention         time.Duration
+	reversalWindow             time.Duration
+
+	customers *Customers
+	location  *time.Location
+
+	outputFormat OutputFormat
+	inputOrder   bool
+
+	resultEncoding ResultEncoding
+	splitOutput    bool
+	summaryOutput  io.Writer // Nil if no summary is written.
+	summaryFormat  SummaryFormat
+
+	lateness           time.Duration
+	latePolicy         LatePolicy
+	latenessBufferSize int
+
+	inputFormat InputFormat
+	csvColumns  map[string]string
+
+	deadLetterFile    string
+	maxInvalidRecords int // No limit if negative.
+
+	checkpointFile string
+	resume         bool
+
+	metrics  *managerMetrics
+	auditLog *AuditLog
+
+	// resultObserver - called with every result once it is ready to be written, in the order results are written.
+	resultObserver func(result *loadTransactionResult)
+}
+
+// ManagerOption - an option for customizing the default account manager.
+type ManagerOption func(m *ManagerDefault)
+
+// WithRules - check transactions against the given rules instead of the default ones.
+func WithRules(rules *Rules) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.transactionCheckers = rules.transactionCheckers
+		m.checkerNames = rules.checkerNames
+		m.historyRetention = rules.historyRetention
+		m.periods = rules.periods
+		m.maxBalance = rules.maxBalance
+	}
+}
+
+// WithMaxPendingTransactions - limit the number of transactions that have been read from the input
+// but whose results have not been written yet. It bounds the memory used for processing an input.
+func WithMaxPendingTransactions(n int) ManagerOption {
+	return func(m *ManagerDefault) {
+		if n > 0 {
+			m.maxPendingTransactions = n
+		}
+	}
+}
+
+// WithWorkers - process transactions with the given number of workers. Customers are sharded across the workers,
+// so transactions of different customers are processed in parallel. By default, there is a worker per CPU.
+func WithWorkers(n int) ManagerOption {
+	return func(m *ManagerDefault) {
+		if n > 0 {
+			m.workers = n
+		}
+	}
+}
+
+// WithAccountStore - keep customer accounts in the given store instead of memory.
+func WithAccountStore(store AccountStore) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.accountStore = store
+	}
+}
+
+// WithDuplicatePolicies - choose what to do with a transaction whose ID has already been processed for the same
+// customer. `identical` applies when the payload is the same as the original one and `conflicting` applies otherwise.
+// By default, identical duplicates replay the original decision and conflicting ones are declined.
+func WithDuplicatePolicies(identical, conflicting DuplicatePolicy) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.identicalDuplicatePolicy = identical
+		m.conflictingDuplicatePolicy = conflicting
+	}
+}
+
+// WithDuplicateRetention - choose how long, in transaction time, an account remembers a processed transaction ID
+// to detect its duplicates. A transaction whose ID was processed longer ago is processed as a new one.
+// By default, transaction IDs are remembered for 30 days.
+func WithDuplicateRetention(retention time.Duration) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.duplicateRetention = retention
+	}
+}
+
+// WithReversalWindow - choose how long, in transaction time, an accepted transaction can be reversed after it.
+// By default, transactions can be reversed for 120 days.
+func WithReversalWindow(window time.Duration) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.reversalWindow = window
+	}
+}
+
+// WithCustomers - use the given customer profiles, e.g. the time zone of each customer.
+func WithCustomers(customers *Customers) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.customers = customers
+	}
+}
+
+// WithTimeZone - derive the day and week of a transaction in the given time zone unless the customer has
+// their own time zone. By default, they are derived in the offset of the transaction's time.
+func WithTimeZone(location *time.Location) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.location = location
+	}
+}
+
+// WithOutputFormat - write transaction results in the given format. By default, they are written in the KOHO format.
+func WithOutputFormat(format OutputFormat) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.outputFormat = format
+	}
+}
+
+// WithInputOrder - choose whether results are written in the order of their transactions in the input file.
+// Transactions are still processed in parallel across customers, and a result is held in memory until the results of
+// all the transactions before it are written. Otherwise, results are written as soon as they are ready, so their
+// order may differ between runs. Results are written in input order by default.
+func WithInputOrder(enabled bool) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.inputOrder = enabled
+	}
+}
+
+// WithResultEncoding - write transaction results to output files in the given encoding. By default, the encoding is
+// told by the extension of each file: CSV for `.csv` and NDJSON otherwise.
+func WithResultEncoding(encoding ResultEncoding) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.resultEncoding = encoding
+	}
+}
+
+// WithSplitOutput - choose whether accepted and declined results are written to two files named after the output file,
+// e.g. `output.accepted.txt` and `output.declined.txt` for `output.txt`, rather than to the output file itself.
+// Results are written to the output file by default.
+func WithSplitOutput(enabled bool) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.splitOutput = enabled
+	}
+}
+
+// WithSummary - write a summary of the results of each input file to the given writer once they are all written:
+// the number of accepted and declined transactions, the number of declines by reason code and the customers with
+// the most declined transactions. By default, no summary is written.
+func WithSummary(w io.Writer, format SummaryFormat) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.summaryOutput = w
+		m.summaryFormat = format
+	}
+}
+
+// WithInputFormat - read the transactions of input files in the given format. By default, the format is told by the
+// extension of each file: CSV for `.csv` and NDJSON otherwise.
+func WithInputFormat(format InputFormat) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.inputFormat = format
+	}
+}
+
+// WithCSVColumns - read the fields of transactions from the given CSV columns, indexed by field, in CSV inputs.
+// By default, a field is read from the column with its name, e.g. `load_amount`.
+func WithCSVColumns(columns map[string]string) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.csvColumns = columns
+	}
+}
+
+// WithDeadLetterFile - write the records of input files that are not valid transactions to the given file, with
+// their line and the reason they are invalid. The file is overwritten by each input file.
+func WithDeadLetterFile(deadLetterFile string) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.deadLetterFile = deadLetterFile
+	}
+}
+
+// WithMaxInvalidRecords - fail the processing of an input file with an `*InvalidRecordsError` if more than the given
+// number of its records are not valid transactions. By default, there is no limit.
+func WithMaxInvalidRecords(max int) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.maxInvalidRecords = max
+	}
+}
+
+// WithCheckpointFile - write a checkpoint to the given file when the processing of an input file is cancelled, so that
+// it can be resumed later (see WithResume). The checkpoint holds the number of records decided and the accounts, unless
+// they are persisted by the account store. It is removed once an input file is processed completely.
+// By default, no checkpoint is written.
+func WithCheckpointFile(checkpointFile string) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.checkpointFile = checkpointFile
+	}
+}
+
+// WithResume - choose whether the processing of an input file resumes from the checkpoint written when it was
+// cancelled: the records decided before the checkpoint are skipped, the accounts are restored, and results and dead
+// letters are appended to the existing files. Input files are processed from the start by default.
+func WithResume(enabled bool) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.resume = enabled
+	}
+}
+
+// WithLateness - process the transactions of each customer in time order rather than in input order, as long as they
+// are at most `lateness` older than the latest transaction of the customer read: a transaction is held until the
+// lateness watermark of its customer, the time of the latest transaction of the customer read minus `lateness`, passes
+// its time. A transaction that arrives after the watermark passed its time is handled according to the given policy.
+// The watermark also passes the time of held transactions when they are released early because they are held for too
+// many records (see WithLatenessBufferSize). By default, transactions are processed in input order.
+func WithLateness(lateness time.Duration, policy LatePolicy) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.lateness = lateness
+		m.latePolicy = policy
+	}
+}
+
+// WithLatenessBufferSize - release a transaction held for the lateness once the given number of records are read after
+// it, so that the held transactions are bounded. The held transactions take pending slots on top of the ones limited
+// by WithMaxPendingTransactions. By default, a transaction is held for at most 10,000 records.
+func WithLatenessBufferSize(n int) ManagerOption {
+	return func(m *ManagerDefault) {
+		if n > 0 {
+			m.latenessBufferSize = n
+		}
+	}
+}
+
+// WithMetrics - record the decisions, the time spent by every checker, the queue depth of every shard and the input
+// parse errors in the given registry. Managers that share a registry share their metrics. By default, no metrics are
+// recorded.
+func WithMetrics(registry *metrics.Registry) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.metrics = newManagerMetrics(registry)
+	}
+}
+
+// WithAuditLog - append every decision to the given audit log. By default, decisions are not audited.
+func WithAuditLog(auditLog *AuditLog) ManagerOption {
+	return func(m *ManagerDefault) {
+		m.auditLog = auditLog
+	}
 }
 
 // NewManager - create a new instance of default account manager.
-func NewManager() *ManagerDefault {
+func NewManager(opts ...ManagerOption) *ManagerDefault {
+	defaultRules := DefaultRules()
 	man := &ManagerDefault{
-		transactionCheckers: []transactionChecker{
-			&dailyLoadFundsChecker{}, &weeklyFundsChecker{}, &dailyLoadTimeChecker{},
-		},
+		transactionCheckers:    defaultRules.transactionCheckers,
+		checkerNames:           defaultRules.checkerNames,
+		historyRetention:       defaultRules.historyRetention,
+		periods:                defaultRules.periods,
+		maxPendingTransactions: defaultMaxPendingTransactions,
+		latenessBufferSize:     DefaultLatenessBufferSize,
+		workers:                runtime.GOMAXPROCS(0),
+		accountStore:           newMemoryAccountStore(),
+
+		identicalDuplicatePolicy:   DuplicateReplay,
+		conflictingDuplicatePolicy: DuplicateDecline,
+		duplicateRetention:         defaultDuplicateRetention,
+		reversalWindow:             defaultReversalWindow,
+
+		outputFormat: OutputFormatKOHO,
+		inputOrder:   true,
+
+		maxInvalidRecords: -1,
+	}
+	for _, opt := range opts {
+		opt(man)
 	}
 
 	return man
 }
 
 // ProcessLoadTransactions - process the load transactions in the given input file.
-// inputFile - The file that contains load transactions that need to be processed.
-// outputFile - The file that contains all the transaction results.
-// error - an error that occurred during the process of transactions.
+// Transactions are streamed from the input file and results are written to the output file as soon as they are ready.
+// If the context is done, e.g. on SIGINT, no more transactions are read, but the transactions already read are
+// processed and their results are written before it returns, along with a checkpoint if the manager has a checkpoint
+// file.
+// inputFile - The file that contains load transactions that need to be processed, or "-" for the standard input.
+// A file with the `.gz` extension is decompressed transparently.
+// outputFile - The file that contains all the transaction results, in NDJSON or CSV. If the output is split, accepted
+// and declined results are written to two files named after it instead.
+// error - an error that occurred during the process of transactions, an `*InterruptedError` if the context is done
+// before the end of the input file, or an `*InvalidRecordsError` if the input file has more invalid records than
+// allowed.
 func (m *ManagerDefault) ProcessLoadTransactions(ctx context.Context, inputFile, outputFile string) error {
-
-	// Load transactions into transaction queues
-	transactionQueues, customerAccounts, totalTransactions, err := m.loadTransactionsAndCustomers(ctx, inputFile)
+	inFile, err := openInput(inputFile)
+	if err != nil {
+		return fmt.Errorf("error openning file %s: %s", inputFile, err.Error())
+	}
+	defer func() {
+		_ = inFile.Close()
+	}()
+	reader, err := m.newTransactionReader(inFile, inputFile)
 	if err != nil {
-		return fmt.Errorf("error loading transactions: %s", err.Error())
+		return fmt.Errorf("error loading transactions from file %s: %s", inputFile, err.Error())
+	}
+	transactions := &countingTransactionReader{transactionReader: reader}
+
+	// Skip the records decided before the checkpoint, if the processing is resumed.
+	lateness := m.newLatenessBuffer()
+	resumed := &checkpoint{InputFile: inputFile}
+	if m.resume {
+		if resumed, err = m.loadCheckpoint(inputFile); err != nil {
+			return fmt.Errorf("error resuming from checkpoint %s: %s", m.checkpointFile, err.Error())
+		}
+		if err = skipRecords(transactions, resumed.Records); err != nil {
+			return fmt.Errorf("error resuming from checkpoint %s: %s", m.checkpointFile, err.Error())
+		}
+		if lateness != nil {
+			lateness.restoreWatermarks(resumed.Watermarks)
+		}
 	}
 
-	// Prepare channel buffers for triggering multiple go routines to process load transactions.
-	scheduleCh := make(chan struct{}, 50)
-	transactionResultCh := make(chan *loadTransactionResult, 50)
-	customersInProcess := make(map[identifier]bool, 0)
-	processedCustomers := make(chan identifier, 50)
-	done := make(chan struct{}, 1)
+	// Invalid records are counted even if they are not written to a dead-letter file.
+	deadLetters := newDeadLetterWriter(nil)
+	var deadLetterOutput *bufio.Writer
+	if m.deadLetterFile != "" {
+		deadLetterFile, err := createOutputFile(m.deadLetterFile, m.resume)
+		if err != nil {
+			return fmt.Errorf("error openning dead-letter file %s: %s", m.deadLetterFile, err.Error())
+		}
+		defer func() {
+			_ = deadLetterFile.Close()
+		}()
+		deadLetterOutput = bufio.NewWriter(deadLetterFile)
+		deadLetters = newDeadLetterWriter(deadLetterOutput)
+	}
+	deadLetters.invalid = resumed.Invalid
 
-	// Open output file and trigger a go routine to process transaction results
-	outFile, err := os.Create(outputFile)
+	// Open output files and trigger a go routine to process transaction results
+	sink, err := m.openResultSink(outputFile)
 	if err != nil {
-		return fmt.Errorf("error openning output file %s: %s", outputFile, err)
+		return err
 	}
-	defer func() {
-		_ = outFile.Close()
-	}()
-
-	go m.processLoadTransactionsResultsRoutine(ctx, outFile, totalTransactions, transactionResultCh, processedCustomers, done)
-
-	for totalTransactions != 0 {
-		// Start at most 50 go routines to process transactions for at most customers in parallel.
-		for customerID, transactionQueue := range transactionQueues {
-			if !customersInProcess[customerID] && !transactionQueue.isEmpty() {
-				// Get a slot from channel buffer and start a go routine to process the first transaction in the queue.
-				scheduleCh <- struct{}{}
-				go m.processLoadTransaction(ctx, transactionQueue.popFront(), customerAccounts[customerID], transactionResultCh, scheduleCh)
-				customersInProcess[customerID] = true
-				totalTransactions--
-			}
+	err = m.processLoadTransactionStream(ctx, transactions, lateness, sink, deadLetters)
+	if closeErr := sink.close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("error closing output files: %s", closeErr.Error())
+	}
+	if deadLetterOutput != nil {
+		if flushErr := deadLetterOutput.Flush(); flushErr != nil {
+			log.Printf("error flushing records to the dead-letter file: %s", flushErr.Error())
 		}
+	}
 
-		// Remove processed customers from `customersInProcess` map.
-		hasMoreProcessedCustomers := true
-		for {
-			if !hasMoreProcessedCustomers {
-				break
-			}
-			select {
-			case processedCustomer := <-processedCustomers:
-				// Mark the customer "processed"
-				customersInProcess[processedCustomer] = false
-			default:
-				hasMoreProcessedCustomers = false
+	if err != nil && err == ctx.Err() {
+		// Every record read is decided, so the processing can resume right after the last one.
+		records := transactions.records
+		if m.checkpointFile != "" {
+			checkpointErr := m.saveCheckpoint(inputFile, records, deadLetters.invalid, lateness)
+			if checkpointErr != nil {
+				// An older checkpoint of the input file would make a resumed run decide some transactions twice.
+				_ = m.removeCheckpoint(inputFile)
+				return fmt.Errorf("error writing checkpoint %s after %d records: %s",
+					m.checkpointFile, records, checkpointErr.Error())
 			}
 		}
+		return &InterruptedError{Records: records, Err: ctx.Err()}
+	}
+	if err != nil {
+		return fmt.Errorf("error loading transactions from file %s: %s", inputFile, err.Error())
 	}
+	if m.checkpointFile != "" {
+		if err := m.removeCheckpoint(inputFile); err != nil {
+			return fmt.Errorf("error removing checkpoint %s: %s", m.checkpointFile, err.Error())
+		}
+	}
+	if m.maxInvalidRecords >= 0 && deadLetters.invalid > m.maxInvalidRecords {
+		return &InvalidRecordsError{Invalid: deadLetters.invalid, Max: m.maxInvalidRecords}
+	}
+	return nil
+}
+
+// processLoadTransactionStream - process the load transactions read by the given reader and write their results
+// to the given sink, which is flushed but not closed. The invalid records are written to the given dead-letter writer
+// too. Transactions are processed in time order through the given lateness buffer, unless it is nil.
+func (m *ManagerDefault) processLoadTransactionStream(ctx context.Context, transactions transactionReader,
+	lateness *latenessBuffer, sink resultSink, deadLetters *deadLetterWriter) error {
+
+	// Every transaction takes a slot in `pendingSlots` from being read until its result is written.
+	pendingSlots := make(chan struct{}, m.pendingCapacity())
+	transactionResultCh := make(chan *loadTransactionResult, m.pendingCapacity())
+	done := make(chan struct{}, 1)
+
+	go m.processLoadTransactionsResultsRoutine(sink, transactionResultCh, pendingSlots, done)
+
+	err := m.dispatchLoadTransactions(ctx, transactions, lateness, transactionResultCh, pendingSlots, deadLetters)
 
 	// Wait 'processLoadTransactionsResultsRoutine' for processing all the transaction results.
+	close(transactionResultCh)
 	<-done
 
-	// Reset properties and return
-	return nil
+	return err
 }
 
-// loadTransactionsAndCustomers - load all the transactions in the given files to the memory and
-// create corresponding customers.
+// dispatchLoadTransactions - read transactions from the given reader one by one and dispatch each of them to
+// the worker that owns its customer's shard, so a customer has at most one transaction being processed at any time.
 // Params:
-//	inputFile: The file that includes some load transactions.
+//	transactions: The reader of the transactions in the input, whatever its format.
+//	buffer: The buffer that holds transactions to release them in time order, or nil to dispatch them in input order.
+//	transactionResultCh: A channel buffer for saving transaction results.
+//	pendingSlots: A channel buffer that limits the number of transactions held in memory.
+//	deadLetters: The writer of the records that are not valid transactions.
 // Returns:
-//	map[string]*transactionQueue: A map of transaction queue and each of them represents a transaction queue for a customer.
-// 	map[identifier]*customerAccount: A map of customer accounts indexed by customer IDs.
-//	int: Total number of transactions that needs to be processed.
-//	error: Any error tha occurred during loading transactions to the memory.
-func (m *ManagerDefault) loadTransactionsAndCustomers(ctx context.Context, inputFile string) (
-	map[identifier]*transactionQueue, map[identifier]*customerAccount, int, error) {
-
-	file, err := os.Open(inputFile)
-	if err != nil {
-		return nil, nil, 0, fmt.Errorf("error openning file %s: %s", inputFile, err.Error())
+//	error: Any error that occurred during reading the input, or the error of the context if it is done before the end
+//		of the input. It returns after all the transactions read are processed, so every record read is decided.
+func (m *ManagerDefault) dispatchLoadTransactions(ctx context.Context, transactions transactionReader,
+	buffer *latenessBuffer, transactionResultCh chan<- *loadTransactionResult, pendingSlots chan struct{},
+	deadLetters *deadLetterWriter) error {
+
+	pool := m.startWorkerPool(ctx, transactionResultCh)
+	defer pool.stop()
+
+	dispatchReleased := func() {
+		for t := buffer.pop(); t != nil; t = buffer.pop() {
+			pool.dispatch(t)
+		}
 	}
-	defer func() {
-		_ = file.Close()
-	}()
 
-	// Load transactions and put them into transaction queues
-	transactionCount := 0
-	transactionQueues := make(map[identifier]*transactionQueue, 0)
-	customerAccounts := make(map[identifier]*customerAccount, 0)
-	scanner := bufio.NewScanner(file)
-
-	// Scan and load transactions
-	for scanner.Scan() {
-		transactionBytes := scanner.Bytes()
-		transaction := loadTransaction{}
-		err := json.Unmarshal(transactionBytes, &transaction)
-		if err != nil {
-			log.Printf("error loading transaction %s: %s", string(transactionBytes), err.Error())
-			continue
+	// Every transaction that produces a result gets the next sequence number.
+	seq := uint64(0)
+
+	var readErr, cancelErr error
+	for {
+		// Wait for a free slot before reading one more transaction, so that no record is left undecided once read.
+		if cancelErr = acquirePendingSlot(ctx, pendingSlots); cancelErr != nil {
+			break
 		}
-		if err = transaction.transformAndValidate(); err != nil {
-			log.Printf("error transforming and validating transaction %#v: %s", transaction, err.Error())
+		if cancelErr = ctx.Err(); cancelErr != nil {
+			<-pendingSlots
+			break
 		}
 
-		// Load transactions into customer's transaction queues
-		if transactionQueues[transaction.CustomerID] == nil {
-			// Create the customer's transaction queue if it does not exist.
-			transactionQueues[transaction.CustomerID] = newTransactionQueue(transaction.CustomerID)
+		transaction, err := transactions.next()
+		if err == io.EOF {
+			<-pendingSlots
+			break
+		}
+		var invalidErr error
+		if err != nil {
+			invalid, ok := err.(*invalidRecordError)
+			if !ok {
+				<-pendingSlots
+				readErr = err
+				break
+			}
+			log.Print(invalid.Error())
+			m.metrics.recordParseError()
+			transaction, invalidErr = invalid.transaction, invalid.err
 		}
-		transactionQueues[transaction.CustomerID].pushBack(&transaction)
-		transactionCount++
 
-		if customerAccounts[transaction.CustomerID] == nil {
-			// Create customer account if it does not exist.
-			customerAccounts[transaction.CustomerID] = &customerAccount{
-				CustomerID:        transaction.CustomerID,
-				DailyLoadedFunds:  make(map[transactionDate]float64, 0),
-				WeeklyLoadedFunds: make(map[transactionDate]float64, 0),
-				DailyLoadedTime:   make(map[transactionDate]uint, 0),
+		transaction.seq = seq
+		seq++
+		if buffer != nil {
+			// Release the transactions held for too many records, whatever this record is.
+			buffer.expire(transaction.seq)
+			dispatchReleased()
+		}
+		if invalidErr == nil {
+			invalidErr = transaction.transformAndValidate(m.customerLocation(transaction.CustomerID))
+		}
+		if invalidErr != nil {
+			// An invalid transaction is declined without being checked or counted, and its record is a dead letter.
+			deadLetters.write(transaction, invalidErr)
+			result := transaction.newResult()
+			result.Error = newDeclineError(reasonInvalidInput, "invalid transaction: %s", invalidErr.Error())
+			m.audit(newAuditRecord(transaction), result)
+			transactionResultCh <- result
+			continue
+		}
+
+		if buffer == nil {
+			pool.dispatch(transaction)
+			continue
+		}
+		if !buffer.push(transaction) {
+			transaction.late = true
+			if m.latePolicy == LateDecline {
+				// A late transaction is declined without being checked or counted.
+				result := transaction.newResult()
+				result.Error = newDeclineError(reasonLate, "arrived after the lateness watermark %s",
+					buffer.watermarkOf(transaction.CustomerID).Format(time.RFC3339))
+				m.audit(newAuditRecord(transaction), result)
+				transactionResultCh <- result
+				continue
 			}
+			pool.dispatch(transaction)
 		}
+		dispatchReleased()
+	}
+
+	// Release the transactions still held at the end of the input, or once the processing is cancelled.
+	if buffer != nil {
+		buffer.flush()
+		dispatchReleased()
+	}
+
+	if readErr != nil {
+		return fmt.Errorf("error scanning input: %s", readErr.Error())
+	}
+	return cancelErr
+}
+
+// customerLocation - return the time zone that the given customer's days and weeks are based on.
+func (m *ManagerDefault) customerLocation(customerID identifier) *time.Location {
+	if location := m.customers.location(customerID); location != nil {
+		return location
 	}
+	return m.location
+}
 
-	if scanner.Err() != nil {
-		return nil, nil, 0, fmt.Errorf("error scanning file %s: %s", inputFile, scanner.Err().Error())
+// newLatenessBuffer - create the buffer that releases the transactions of an input in time order if some lateness is
+// allowed, or return nil if transactions are processed in input order.
+func (m *ManagerDefault) newLatenessBuffer() *latenessBuffer {
+	if m.lateness <= 0 {
+		return nil
 	}
+	return newLatenessBuffer(m.lateness, m.latenessBufferSize)
+}
 
-	return transactionQueues, customerAccounts, transactionCount, nil
+// pendingCapacity - return the number of transactions that can be held in memory at the same time. The transactions
+// held by the lateness buffer take slots on top of the pending ones, so that a slot is always freed eventually without
+// releasing them early: the result that the output waits for is never held by the buffer once all the slots are taken.
+func (m *ManagerDefault) pendingCapacity() int {
+	if m.lateness > 0 {
+		return m.maxPendingTransactions + m.latenessBufferSize
+	}
+	return m.maxPendingTransactions
 }
 
-// processLoadTransaction - process the given transaction
+// acquirePendingSlot - wait for a free slot in `pendingSlots`, or until the context is done.
+func acquirePendingSlot(ctx context.Context, pendingSlots chan struct{}) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case pendingSlots <- struct{}{}:
+		return nil
+	}
+}
+
+// processLoadTransaction - process the given transaction. It is safe to process transactions of the same customer
+// concurrently as the customer's account is locked during the process.
 // Params:
-// 	transaction: The transaction that needs to be processed.
-// 	customerAccount: The account of the customer who owns this transaction.
-// 	transactionResultCh: A channel buffer for saving transaction results.
-// 	scheduleCh: A channel buffer for controlling the number of transaction-process routines
+//	transaction: The transaction that needs to be processed.
+//	customerAccount: The account of the customer who owns this transaction.
+// Returns:
+//	*loadTransactionResult: The result of the transaction.
 func (m *ManagerDefault) processLoadTransaction(
-	ctx context.Context, transaction *loadTransaction, customerAccount *customerAccount,
-	transactionResultCh chan<- *loadTransactionResult, scheduleCh <-chan struct{}) {
+	ctx context.Context, transaction *loadTransaction, customerAccount *customerAccount) *loadTransactionResult {
 
-	result := &loadTransactionResult{
-		ID:         transaction.ID,
-		CustomerID: transaction.CustomerID,
+	result := transaction.newResult()
+	var audit *auditRecord
+	if m.auditLog != nil {
+		audit = newAuditRecord(transaction)
 	}
 
-	// Check whether this transaction hits some limit.
-	for _, checker := range m.transactionCheckers {
-		if err := checker.check(customerAccount, transaction); err != nil {
-			result.Accepted = false
-			result.Error = err
-			goto end
+	customerAccount.mutex.Lock()
+	defer customerAccount.mutex.Unlock()
+
+	// A duplicate is neither checked nor counted.
+	customerAccount.forget(transaction.Time, m.duplicateRetention, m.reversalWindow)
+	if duplicateResult := m.checkDuplicate(customerAccount, transaction); duplicateResult != nil {
+		m.audit(audit, duplicateResult)
+		m.reportDetails(customerAccount, transaction, duplicateResult)
+		return duplicateResult
+	}
+	audit.observeAccount(customerAccount, transaction, m.periods[transaction.Type])
+
+	var err error
+	if transaction.Type == transactionTypeReversal {
+		// A reversal is not limited, but it needs an accepted transaction to roll back.
+		err = customerAccount.resolveReversal(transaction, m.reversalWindow)
+	} else {
+		// Forget the transactions that are too old to be in any rolling window of this transaction.
+		customerAccount.counters(transaction.Type).pruneHistory(transaction.Time.Add(-m.historyRetention))
+
+		// Check whether this transaction hits some limit of its type.
+		transaction.customerTier = m.customers.tier(transaction.CustomerID)
+		for i, checker := range m.transactionCheckers[transaction.Type] {
+			start := time.Now()
+			err = checker.check(customerAccount, transaction)
+			m.metrics.observeChecker(transaction.Type, m.checkerNames[transaction.Type][i], time.Since(start))
+			audit.observeCheck(m.checkerNames[transaction.Type][i], err)
+			if err != nil {
+				if declineErr, ok := err.(*declineError); ok {
+					declineErr.rule = m.checkerNames[transaction.Type][i]
+				}
+				break
+			}
+		}
+	}
+
+	// Check whether the funds can be moved and post them along with logging the decision. Only the wallets that the
+	// transaction moves funds between stay locked in between, as a transfer also changes the balance of its recipient,
+	// whose account is not locked. Waiting for the decision to be durable happens once they are unlocked.
+	ledger := m.accountStore.ledger()
+	var entry *ledgerEntry
+	wallets := []ledgerAccount{walletAccount(transaction.CustomerID)}
+	if err == nil {
+		entry = transaction.ledgerEntry()
+		wallets = append(wallets, entry.wallets()...)
+	}
+	unlockWallets := ledger.lockWallets(wallets...)
+	audit.observeBalance(ledger.balance(transaction.CustomerID))
+	// A reversal is forced like a chargeback is, even if it overdraws a wallet.
+	if err == nil && transaction.Type != transactionTypeReversal {
+		err = ledger.check(entry, m.maxBalance)
+	}
+	result.Accepted = err == nil
+	result.Error = err
+	if !result.Accepted {
+		entry = nil
+	}
+	wait, err := m.accountStore.commit(customerAccount, transaction, entry)
+	unlockWallets()
+
+	// Persist the decision before applying it, so that a transaction is never applied without being persisted.
+	if err == nil {
+		if err = wait(); err != nil && entry != nil {
+			unlockWallets = ledger.lockWallets(wallets...)
+			ledger.unpost(entry)
+			unlockWallets()
 		}
 	}
+	if err != nil {
+		result.Accepted = false
+		result.Error = fmt.Errorf("error persisting the decision: %s", err.Error())
+		m.audit(audit, result)
+		return result
+	}
+
+	customerAccount.remember(transaction, result.Accepted)
+	customerAccount.coolOff(transaction)
+	if result.Accepted {
+		customerAccount.apply(transaction, m.periods[transaction.Type])
+	}
+	m.audit(audit, result)
+	m.reportDetails(customerAccount, transaction, result)
+	return result
+}
 
-	// Update customer account if all checks are passed.
-	customerAccount.DailyLoadedFunds[transaction.currentDate] += transaction.LoadAmountFloat
-	customerAccount.WeeklyLoadedFunds[transaction.mondayDateOfCurrentWeek] += transaction.LoadAmountFloat
-	customerAccount.DailyLoadedTime[transaction.currentDate] += 1
-	result.Accepted = true
+// audit - append the given record of a transaction with the decision of the given result to the audit log.
+// It does nothing if there is no audit log. A decision that cannot be audited is still made, and the error is logged.
+func (m *ManagerDefault) audit(record *auditRecord, result *loadTransactionResult) {
+	if m.auditLog == nil || record == nil {
+		return
+	}
+	record.observeResult(result)
+	if err := m.auditLog.append(record); err != nil {
+		log.Printf("error auditing transaction %s for customer %s: %s",
+			result.ID.String(), result.CustomerID.String(), err.Error())
+	}
+}
 
-end:
-	transactionResultCh <- result
+// reportDetails - attach the customer's remaining headroom and balance to the given result if the output format
+// reports them. The caller must hold the lock of the account but not the lock of the ledger.
+func (m *ManagerDefault) reportDetails(a *customerAccount, t *loadTransaction, result *loadTransactionResult) {
+	if m.outputFormat == OutputFormatDetailed {
+		result.headroom = m.headroom(a, t)
+		result.balance = m.accountStore.ledger().balance(t.CustomerID).String()
+	}
+}
 
-	// Release a slot
-	<-scheduleCh
+// WriteTrialBalance - write the trial balance of the ledger, i.e. the balance of the settlement account and every
+// customer's wallet, to the given writer.
+func (m *ManagerDefault) WriteTrialBalance(w io.Writer) error {
+	return m.accountStore.ledger().writeTrialBalance(w)
 }
 
 // processLoadTransactionsResultsRoutine - a routine for processing transaction results.
+// It returns once `transactionResultCh` is closed and drained.
 // Params:
-//	totalTransactions: Total transactions that need to be processed.
-//  transactionResultCh: A channel buffer for passing transaction results to this routine.
-//  processedCustomers: A channel buffer notifying processed customers to the main routine.
-//  done: A channel for notifying the main routine that all transactions results are processed.
+//		sink: The sink that transaction results are written to.
+//	 transactionResultCh: A channel buffer for passing transaction results to this routine.
+//	 pendingSlots: A channel buffer whose slot is released once a transaction result is written.
+//	 done: A channel for notifying the main routine that all transactions results are processed.
 func (m *ManagerDefault) processLoadTransactionsResultsRoutine(
-	ctx context.Context, outputFile *os.File, totalTransactions int,
-	transactionResultCh <-chan *loadTransactionResult, processedCustomers chan<- identifier, done chan<- struct{}) {
-
-	enc := json.NewEncoder(outputFile)
-
-	for totalTransactions != 0 {
-		select {
-		case <-ctx.Done():
-			// This should never happen
-			done <- struct{}{}
-			return
-		case result := <-transactionResultCh:
-			if result.Error != nil {
-				// Create an error log for failed transaction.
-				log.Printf("error processing transaction %s for customer %s: %s",
-					result.ID.String(), result.CustomerID.String(), result.Error.Error())
+	sink resultSink, transactionResultCh <-chan *loadTransactionResult, pendingSlots <-chan struct{},
+	done chan<- struct{}) {
+
+	reorder := newReorderBuffer()
+
+	for result := range transactionResultCh {
+		if !m.inputOrder {
+			m.writeLoadTransactionResult(sink, result)
+			<-pendingSlots
+		} else {
+			// Write the results that are ready in input order.
+			reorder.push(result)
+			for result = reorder.pop(); result != nil; result = reorder.pop() {
+				m.writeLoadTransactionResult(sink, result)
+				<-pendingSlots
 			}
+		}
 
-			if err := enc.Encode(result); err != nil {
-				log.Printf("error writing transaction %s to the output file for customer %s: %s",
-					result.ID.String(), result.CustomerID.String(), result.Error.Error())
+		// Flush results whenever the routine catches up with the workers so that they are emitted incrementally.
+		if len(transactionResultCh) == 0 {
+			if err := sink.flush(); err != nil {
+				log.Printf("error flushing results to the output file: %s", err.Error())
 			}
-
-			processedCustomers <- result.CustomerID
-			totalTransactions--
 		}
 	}
 
+	if err := sink.flush(); err != nil {
+		log.Printf("error flushing results to the output file: %s", err.Error())
+	}
 	done <- struct{}{}
 }
+
+// writeLoadTransactionResult - log the error of the given transaction result if it has one and write
+// the result to the output unless it is dropped.
+func (m *ManagerDefault) writeLoadTransactionResult(sink resultSink, result *loadTransactionResult) {
+	if result.Error != nil {
+		// Create an error log for failed transaction.
+		log.Printf("error processing transaction %s for customer %s: %s",
+			result.ID.String(), result.CustomerID.String(), result.Error.Error())
+	}
+
+	m.metrics.recordResult(result)
+	if m.resultObserver != nil {
+		m.resultObserver(result)
+	}
+
+	if !result.dropped {
+		if err := sink.write(result); err != nil {
+			log.Printf("error writing transaction %s to the output file for customer %s: %s",
+				result.ID.String(), result.CustomerID.String(), err.Error())
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package account
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	benchmarkTransactions = 1000000
+	benchmarkCustomers    = 10000
+	// benchmarkStoreTransactions - the number of transactions processed against an account store directory, whose
+	// decisions are synced to disk.
+	benchmarkStoreTransactions = 20000
+)
+
+// writeBenchmarkInput - write an input file of the given number of transactions spread across
+// `benchmarkCustomers` customers, each of whom loads once every 6 hours, so both accepted and declined
+// transactions are processed.
+func writeBenchmarkInput(b *testing.B, inputFile string, transactions int) {
+	file, err := os.Create(inputFile)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	output := bufio.NewWriter(file)
+	for i := 0; i < transactions; i++ {
+		_, _ = fmt.Fprintf(output, `{"id":"%d","customer_id":"%d","load_amount":"$%d.%02d","time":"%s"}`+"\n",
+			i, i%benchmarkCustomers, 10+i%2000, i%100,
+			start.Add(time.Duration(i/benchmarkCustomers)*6*time.Hour).Format(time.RFC3339))
+	}
+	if err := output.Flush(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkProcessLoadTransactions - measure the throughput and CPU usage of processing 1M transactions
+// with different numbers of workers. Run it with `go test ./account -run NONE -bench ProcessLoadTransactions`.
+func BenchmarkProcessLoadTransactions(b *testing.B) {
+	dir, err := ioutil.TempDir("", "koho-manager-benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	inputFile := filepath.Join(dir, "input.txt")
+	outputFile := filepath.Join(dir, "output.txt")
+	writeBenchmarkInput(b, inputFile, benchmarkTransactions)
+
+	// Declined transactions are logged, which is not what is measured.
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			startCPU, cpuSupported := cpuTime()
+			start := time.Now()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				m := NewManager(WithWorkers(workers))
+				if err := m.ProcessLoadTransactions(context.Background(), inputFile, outputFile); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			elapsed := time.Since(start)
+			b.ReportMetric(float64(benchmarkTransactions*b.N)/elapsed.Seconds(), "tx/s")
+			if endCPU, _ := cpuTime(); cpuSupported {
+				// The average number of CPUs that are busy during the benchmark.
+				b.ReportMetric(float64(endCPU-startCPU)/float64(elapsed), "CPUs")
+			}
+		})
+	}
+}
+
+// BenchmarkProcessLoadTransactionsWithFileStore - measure the throughput of processing 20K transactions against an
+// account store directory with different numbers of workers. Every decision is synced to disk before its result is
+// written, and the decisions made by different workers at the same time share a sync. Run it with
+// `go test ./account -run NONE -bench ProcessLoadTransactionsWithFileStore`.
+func BenchmarkProcessLoadTransactionsWithFileStore(b *testing.B) {
+	dir, err := ioutil.TempDir("", "koho-manager-benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	inputFile := filepath.Join(dir, "input.txt")
+	outputFile := filepath.Join(dir, "output.txt")
+	writeBenchmarkInput(b, inputFile, benchmarkStoreTransactions)
+
+	// Declined transactions are logged, which is not what is measured.
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, workers := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			var elapsed time.Duration
+			for i := 0; i < b.N; i++ {
+				// Every run starts with empty accounts, which is not what is measured.
+				b.StopTimer()
+				storeDir := filepath.Join(dir, fmt.Sprintf("state-%d-%d", workers, i))
+				store, err := OpenFileAccountStore(storeDir, DefaultSnapshotInterval)
+				if err != nil {
+					b.Fatal(err)
+				}
+				start := time.Now()
+				b.StartTimer()
+
+				m := NewManager(WithWorkers(workers), WithAccountStore(store))
+				if err := m.ProcessLoadTransactions(context.Background(), inputFile, outputFile); err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				elapsed += time.Since(start)
+				if err := store.Close(); err != nil {
+					b.Fatal(err)
+				}
+				_ = os.RemoveAll(storeDir)
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(benchmarkStoreTransactions*b.N)/elapsed.Seconds(), "tx/s")
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package account
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// runManager - run the given manager against the given input lines and return the output lines.
+func runManager(t *testing.T, m *ManagerDefault, inputLines []string) []string {
+	dir, err := ioutil.TempDir("", "koho-manager-test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	inputFile := filepath.Join(dir, "input.txt")
+	outputFile := filepath.Join(dir, "output.txt")
+	if !assert.NoError(t, ioutil.WriteFile(inputFile, []byte(strings.Join(inputLines, "\n")), 0644)) {
+		t.FailNow()
+	}
+	if !assert.NoError(t, m.ProcessLoadTransactions(context.Background(), inputFile, outputFile)) {
+		t.FailNow()
+	}
+
+	output, err := ioutil.ReadFile(outputFile)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	return lines
+}
+
+// decodeResults - decode the given output lines into transaction results indexed by transaction ID.
+func decodeResults(t *testing.T, lines []string) map[identifier]*loadTransactionResult {
+	results := make(map[identifier]*loadTransactionResult, len(lines))
+	for _, line := range lines {
+		result := &loadTransactionResult{}
+		if !assert.NoError(t, json.Unmarshal([]byte(line), result)) {
+			t.FailNow()
+		}
+		results[result.ID] = result
+	}
+	return results
+}
+
+func TestProcessLoadTransactions(t *testing.T) {
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$4000.00","time":"2000-01-01T00:00:00Z"}`,
+		`{"id":"2","customer_id":"2","load_amount":"$100.00","time":"2000-01-01T00:10:00Z"}`,
+		`{"id":"3","customer_id":"1","load_amount":"$1000.01","time":"2000-01-01T01:00:00Z"}`,
+		`not a transaction`,
+		`{"id":"4","customer_id":"1","load_amount":"$1000.00","time":"2000-01-01T02:00:00Z"}`,
+		`{"id":"5","customer_id":"2","load_amount":"$100.00","time":"2000-01-01T03:00:00Z"}`,
+		`{"id":"6","customer_id":"2","load_amount":"$100.00","time":"2000-01-01T04:00:00Z"}`,
+		`{"id":"7","customer_id":"2","load_amount":"$100.00","time":"2000-01-01T05:00:00Z"}`,
+	}
+	// The line that cannot be decoded is declined with no ID.
+	expected := map[identifier]bool{
+		"1": true, "2": true, "3": false, "": false, "4": true, "5": true, "6": true, "7": false,
+	}
+
+	for _, maxPending := range []int{1, 3, defaultMaxPendingTransactions} {
+		results := decodeResults(t, runManager(t, NewManager(WithMaxPendingTransactions(maxPending)), input))
+		accepted := make(map[identifier]bool, len(results))
+		for id, result := range results {
+			accepted[id] = result.Accepted
+		}
+		assert.Equal(t, expected, accepted, "max pending transactions: %d", maxPending)
+	}
+}
+
+func TestProcessFixture(t *testing.T) {
+	// output.txt holds the results of input.txt with the default options, so it changes along with the decisions.
+	input, err := ioutil.ReadFile(filepath.Join("..", "input.txt"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	expected, err := ioutil.ReadFile(filepath.Join("..", "output.txt"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	output := runManager(t, NewManager(), strings.Split(strings.TrimSpace(string(input)), "\n"))
+	assert.Equal(t, strings.Split(strings.TrimSpace(string(expected)), "\n"), output)
+}
+
+func TestProcessLoadTransactionsKeepsCustomerOrder(t *testing.T) {
+	// Every customer has 3 loads of $2,000 on the same day, so only the first two of them can be accepted.
+	input := make([]string, 0, 300)
+	for i := 0; i < 3; i++ {
+		for customer := 0; customer < 100; customer++ {
+			input = append(input, `{"id":"`+string(rune('a'+i))+strings.Repeat("0", customer)+`","customer_id":"`+
+				strings.Repeat("c", customer+1)+`","load_amount":"$2000.00","time":"2000-01-01T00:00:00Z"}`)
+		}
+	}
+
+	for _, workers := range []int{1, 3, 64} {
+		lines := runManager(t, NewManager(WithMaxPendingTransactions(16), WithWorkers(workers)), input)
+		assert.Len(t, lines, len(input))
+		declined := make([]string, 0)
+		for id, result := range decodeResults(t, lines) {
+			if !result.Accepted {
+				declined = append(declined, id.String()[:1])
+			}
+		}
+		sort.Strings(declined)
+		assert.Equal(t, strings.Repeat("c", 100), strings.Join(declined, ""), "workers: %d", workers)
+	}
+}
+
+func TestProcessLoadTransactionsInInputOrder(t *testing.T) {
+	// Customers have different numbers of transactions, so their workers finish in a different order than the input.
+	input := make([]string, 0, 200)
+	expected := make([]string, 0, 200)
+	for i := 0; i < 200; i++ {
+		id := strconv.Itoa(i)
+		customerID := strconv.Itoa(i % 7)
+		if i%5 == 0 {
+			customerID = "0"
+		}
+		input = append(input, `{"id":"`+id+`","customer_id":"`+customerID+
+			`","load_amount":"$1.00","time":"2000-01-01T00:00:00Z"}`)
+		expected = append(expected, id)
+	}
+	// A line that cannot be decoded, an invalid transaction and a dropped duplicate do not break the order.
+	input = append(input[:10], append([]string{
+		`not a transaction`,
+		`{"id":"invalid","customer_id":"1","load_amount":"1.00","time":"2000-01-01T00:00:00Z"}`,
+		`{"id":"3","customer_id":"3","load_amount":"$1.00","time":"2000-01-01T00:00:00Z"}`,
+	}, input[10:]...)...)
+	expected = append(expected[:10], append([]string{"", "invalid"}, expected[10:]...)...)
+
+	for _, maxPending := range []int{1, 16, defaultMaxPendingTransactions} {
+		m := NewManager(WithMaxPendingTransactions(maxPending), WithDuplicatePolicies(DuplicateDrop, DuplicateDrop))
+		ids := make([]string, 0, len(expected))
+		for _, line := range runManager(t, m, input) {
+			result := &loadTransactionResult{}
+			if !assert.NoError(t, json.Unmarshal([]byte(line), result)) {
+				t.FailNow()
+			}
+			ids = append(ids, result.ID.String())
+		}
+		assert.Equal(t, expected, ids, "max pending transactions: %d", maxPending)
+	}
+}
+
+func TestProcessTransactionsOfDifferentTypes(t *testing.T) {
+	rules, err := parseRules([]byte(`
+rules:
+  - kind: amount
+    period: day
+    amount: 5000
+  - type: withdrawal
+    kind: amount
+    period: day
+    amount: 1000
+  - type: transfer
+    kind: count
+    period: week
+    count: 2
+`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$5000.00","time":"2000-01-03T01:00:00Z"}`,
+		`{"id":"2","customer_id":"1","type":"withdrawal","load_amount":"$1000.00","time":"2000-01-03T02:00:00Z"}`,
+		`{"id":"3","customer_id":"1","type":"withdrawal","load_amount":"$0.01","time":"2000-01-03T03:00:00Z"}`,
+		`{"id":"4","customer_id":"1","type":"transfer","recipient_id":"2","load_amount":"$1000.00",` +
+			`"time":"2000-01-03T04:00:00Z"}`,
+		`{"id":"5","customer_id":"1","type":"transfer","recipient_id":"2","load_amount":"$1000.00",` +
+			`"time":"2000-01-04T04:00:00Z"}`,
+		`{"id":"6","customer_id":"1","type":"transfer","recipient_id":"2","load_amount":"$1.00",` +
+			`"time":"2000-01-05T04:00:00Z"}`,
+		`{"id":"7","customer_id":"1","type":"transfer","load_amount":"$1.00","time":"2000-01-05T05:00:00Z"}`,
+		`{"id":"8","customer_id":"1","load_amount":"$0.01","time":"2000-01-03T05:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$1000.00","time":"2000-01-03T02:00:00Z"}`,
+	}
+	output := runManager(t, NewManager(WithRules(rules), WithOutputFormat(OutputFormatDetailed)), input)
+	assert.Equal(t, []string{
+		`{"id":"1","customer_id":"1","accepted":true,"headroom":{"daily_amount":"$0.00"},"balance":"$5000.00"}`,
+		`{"id":"2","customer_id":"1","type":"withdrawal","accepted":true,"headroom":{"daily_amount":"$0.00"},` +
+			`"balance":"$4000.00"}`,
+		`{"id":"3","customer_id":"1","type":"withdrawal","accepted":false,"reason_code":"DAILY_AMOUNT",` +
+			`"message":"exceeds maximum daily withdrawal funds ($1000.00) on date 2000-1-3",` +
+			`"headroom":{"daily_amount":"$0.00"},"balance":"$4000.00"}`,
+		`{"id":"4","customer_id":"1","type":"transfer","accepted":true,"headroom":{"weekly_count":1},"balance":"$3000.00"}`,
+		`{"id":"5","customer_id":"1","type":"transfer","accepted":true,"headroom":{"weekly_count":0},"balance":"$2000.00"}`,
+		`{"id":"6","customer_id":"1","type":"transfer","accepted":false,"reason_code":"WEEKLY_COUNT",` +
+			`"message":"exceeds maximum weekly transfer time (2) on week which monday is 2000-1-3",` +
+			`"headroom":{"weekly_count":0},"balance":"$2000.00"}`,
+		`{"id":"7","customer_id":"1","type":"transfer","accepted":false,"reason_code":"INVALID_INPUT",` +
+			`"message":"invalid transaction: transfer's recipient ID is empty"}`,
+		`{"id":"8","customer_id":"1","accepted":false,"reason_code":"DAILY_AMOUNT",` +
+			`"message":"exceeds maximum daily load funds ($5000.00) on date 2000-1-3",` +
+			`"headroom":{"daily_amount":"$0.00"},"balance":"$2000.00"}`,
+		`{"id":"2","customer_id":"1","accepted":false,"outcome":"conflict","reason_code":"CONFLICT",` +
+			`"message":"transaction ID 2 has been processed (conflict)",` +
+			`"headroom":{"daily_amount":"$0.00"},"balance":"$2000.00"}`,
+	}, output)
+}
+
+func TestProcessTransactionsAgainstBalances(t *testing.T) {
+	rules, err := parseRules([]byte(`
+rules:
+  - kind: amount
+    period: day
+    amount: 5000
+  - kind: balance
+    amount: 3000
+`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	input := []string{
+		`{"id":"1","customer_id":"1","type":"withdrawal","load_amount":"$0.01","time":"2000-01-03T01:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$3000.00","time":"2000-01-03T02:00:00Z"}`,
+		`{"id":"3","customer_id":"1","load_amount":"$0.01","time":"2000-01-03T03:00:00Z"}`,
+		`{"id":"4","customer_id":"2","load_amount":"$2000.00","time":"2000-01-03T04:00:00Z"}`,
+		`{"id":"5","customer_id":"1","type":"transfer","recipient_id":"2","load_amount":"$1000.01",` +
+			`"time":"2000-01-03T05:00:00Z"}`,
+		`{"id":"6","customer_id":"1","type":"transfer","recipient_id":"2","load_amount":"$1000.00",` +
+			`"time":"2000-01-03T06:00:00Z"}`,
+		`{"id":"7","customer_id":"1","type":"withdrawal","load_amount":"$2000.01","time":"2000-01-03T07:00:00Z"}`,
+		`{"id":"8","customer_id":"1","type":"withdrawal","load_amount":"$2000.00","time":"2000-01-03T08:00:00Z"}`,
+	}
+	// Each customer is processed by their own worker, so the transactions of both customers need to be
+	// processed by a single worker to make the transfers see the load of their recipient.
+	manager := NewManager(WithRules(rules), WithOutputFormat(OutputFormatDetailed), WithWorkers(1))
+	output := runManager(t, manager, input)
+	assert.Equal(t, []string{
+		`{"id":"1","customer_id":"1","type":"withdrawal","accepted":false,"reason_code":"INSUFFICIENT_FUNDS",` +
+			`"message":"insufficient funds ($0.00) in customer:1","balance":"$0.00"}`,
+		`{"id":"2","customer_id":"1","accepted":true,"headroom":{"daily_amount":"$2000.00"},"balance":"$3000.00"}`,
+		`{"id":"3","customer_id":"1","accepted":false,"reason_code":"MAX_BALANCE",` +
+			`"message":"exceeds maximum balance ($3000.00) in customer:1",` +
+			`"headroom":{"daily_amount":"$2000.00"},"balance":"$3000.00"}`,
+		`{"id":"4","customer_id":"2","accepted":true,"headroom":{"daily_amount":"$3000.00"},"balance":"$2000.00"}`,
+		`{"id":"5","customer_id":"1","type":"transfer","accepted":false,"reason_code":"MAX_BALANCE",` +
+			`"message":"exceeds maximum balance ($3000.00) in customer:2","balance":"$3000.00"}`,
+		`{"id":"6","customer_id":"1","type":"transfer","accepted":true,"balance":"$2000.00"}`,
+		`{"id":"7","customer_id":"1","type":"withdrawal","accepted":false,"reason_code":"INSUFFICIENT_FUNDS",` +
+			`"message":"insufficient funds ($2000.00) in customer:1","balance":"$2000.00"}`,
+		`{"id":"8","customer_id":"1","type":"withdrawal","accepted":true,"balance":"$0.00"}`,
+	}, output)
+
+	trialBalance := &bytes.Buffer{}
+	assert.NoError(t, manager.WriteTrialBalance(trialBalance))
+	assert.Equal(t, ""+
+		"Account               Debit    Credit\n"+
+		"customer:1                      $0.00\n"+
+		"customer:2                   $3000.00\n"+
+		"settlement         $3000.00\n"+
+		"Total (4 entries)  $3000.00  $3000.00\n", trialBalance.String())
+}
@@ -0,0 +1,84 @@
+package account
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/azhuox/code-interviews/koho/metrics"
+)
+
+// managerMetrics - the metrics of an account manager. A nil `managerMetrics` records nothing.
+type managerMetrics struct {
+	accepted        *metrics.CounterVec
+	declined        *metrics.CounterVec
+	checkerDuration *metrics.HistogramVec
+	queueDepth      *metrics.GaugeVec
+	parseErrors     *metrics.Counter
+}
+
+// newManagerMetrics - register the metrics of an account manager in the given registry.
+func newManagerMetrics(registry *metrics.Registry) *managerMetrics {
+	return &managerMetrics{
+		accepted: registry.NewCounterVec("koho_transactions_accepted_total",
+			"Number of accepted transactions by type.", "type"),
+		declined: registry.NewCounterVec("koho_transactions_declined_total",
+			"Number of declined transactions by type and reason code.", "type", "reason"),
+		checkerDuration: registry.NewHistogramVec("koho_checker_duration_seconds",
+			"Time spent checking a transaction against a velocity limit rule, by transaction type and rule name.",
+			metrics.DefaultDurationBuckets, "type", "rule"),
+		queueDepth: registry.NewGaugeVec("koho_shard_queue_depth",
+			"Number of transactions dispatched to a shard of customers and waiting to be processed.", "shard"),
+		parseErrors: registry.NewCounterVec("koho_input_parse_errors_total",
+			"Number of input lines or requests that could not be parsed as transactions.").With(),
+	}
+}
+
+// recordResult - count the decision of the given result.
+func (mm *managerMetrics) recordResult(result *loadTransactionResult) {
+	if mm == nil {
+		return
+	}
+	// The type of an invalid transaction comes from the input, so it is not used as is to bound the number of metrics.
+	typ := "unknown"
+	switch result.Type {
+	case "":
+		typ = string(transactionTypeLoad)
+	case transactionTypeLoad, transactionTypeWithdrawal, transactionTypeTransfer, transactionTypeReversal:
+		typ = string(result.Type)
+	}
+
+	if result.Accepted {
+		mm.accepted.With(typ).Inc()
+	} else {
+		mm.declined.With(typ, string(reasonCodeOf(result.Error))).Inc()
+	}
+}
+
+// recordParseError - count an input that could not be parsed as a transaction.
+func (mm *managerMetrics) recordParseError() {
+	if mm == nil {
+		return
+	}
+	mm.parseErrors.Inc()
+}
+
+// observeChecker - record the time spent by the checker of the given rule.
+func (mm *managerMetrics) observeChecker(t transactionType, rule string, duration time.Duration) {
+	if mm == nil {
+		return
+	}
+	mm.checkerDuration.With(string(t), rule).Observe(duration.Seconds())
+}
+
+// shardQueueDepths - return the gauges of the queue depths of the given number of shards, or nil if no metrics are
+// recorded.
+func (mm *managerMetrics) shardQueueDepths(shards int) []*metrics.Gauge {
+	if mm == nil {
+		return nil
+	}
+	gauges := make([]*metrics.Gauge, shards)
+	for i := range gauges {
+		gauges[i] = mm.queueDepth.With(strconv.Itoa(i))
+	}
+	return gauges
+}
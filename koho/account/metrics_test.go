@@ -0,0 +1,47 @@
+package account
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/azhuox/code-interviews/koho/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManagerMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	m := NewManager(WithMetrics(registry), WithWorkers(2))
+	runManager(t, m, []string{
+		`{"id":"1","customer_id":"1","load_amount":"$3000.00","time":"2000-01-01T00:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$3000.00","time":"2000-01-01T01:00:00Z"}`,
+		`{"id":"3","customer_id":"2","type":"withdrawal","load_amount":"$10.00","time":"2000-01-01T00:00:00Z"}`,
+		`{"id":"4","customer_id":"2","type":"deposit","load_amount":"$10.00","time":"2000-01-01T00:00:00Z"}`,
+		`{"id":"5","customer_id":"2",`,
+	})
+
+	// Requests of the HTTP service are counted as well.
+	handler := m.HTTPHandler()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/loads", strings.NewReader("{")))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/loads", strings.NewReader(
+		`{"id":"6","customer_id":"1","load_amount":"$1000.00","time":"2000-01-02T00:00:00Z"}`)))
+
+	output := &bytes.Buffer{}
+	assert.NoError(t, registry.WriteText(output))
+	text := output.String()
+	for _, line := range []string{
+		`koho_transactions_accepted_total{type="load"} 2`,
+		`koho_transactions_declined_total{type="load",reason="DAILY_AMOUNT"} 1`,
+		`koho_transactions_declined_total{type="withdrawal",reason="INSUFFICIENT_FUNDS"} 1`,
+		`koho_transactions_declined_total{type="unknown",reason="INVALID_INPUT"} 1`,
+		`koho_input_parse_errors_total 2`,
+		// The daily amount rule checks all the loads and the other rules only check the loads that it accepts.
+		`koho_checker_duration_seconds_count{type="load",rule="rule #1"} 3`,
+		`koho_checker_duration_seconds_count{type="load",rule="rule #3"} 2`,
+		`koho_shard_queue_depth{shard="0"} 0`,
+		`koho_shard_queue_depth{shard="1"} 0`,
+	} {
+		assert.Contains(t, text, line+"\n")
+	}
+}
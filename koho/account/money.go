@@ -0,0 +1,89 @@
+package account
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// money - an exact amount of money stored in cents.
+type money int64
+
+// maxMoney - the largest amount of money that can be parsed ($10 trillion).
+// It leaves enough room for summing amounts without overflowing int64.
+const maxMoney = money(1e15)
+
+// String - format the money as dollars, e.g. "$3318.47".
+func (m money) String() string {
+	sign := ""
+	if m < 0 {
+		sign = "-"
+		m = -m
+	}
+	return fmt.Sprintf("%s$%d.%02d", sign, int64(m/100), int64(m%100))
+}
+
+// UnmarshalYAML - decode money from a YAML scalar such as `5000`, `1000.5` or `"$5000"`.
+func (m *money) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: money must be a scalar", value.Line)
+	}
+	amount, err := parseDollars(strings.TrimPrefix(value.Value, "$"))
+	if err != nil {
+		return fmt.Errorf("line %d: invalid amount %q: %s", value.Line, value.Value, err.Error())
+	}
+	*m = amount
+	return nil
+}
+
+// parseMoney - parse a money string in the format of "$<dollars>[.<cents>]", e.g. "$3318.47".
+// It rejects negative amounts, amounts with more than two decimals and anything that is not a plain number.
+func parseMoney(s string) (money, error) {
+	if !strings.HasPrefix(s, "$") {
+		return 0, fmt.Errorf("money %q must start with '$'", s)
+	}
+	amount, err := parseDollars(s[1:])
+	if err != nil {
+		return 0, fmt.Errorf("money %q is invalid: %s", s, err.Error())
+	}
+	return amount, nil
+}
+
+// parseDollars - parse a non-negative decimal number of dollars with at most two decimals into money.
+func parseDollars(s string) (money, error) {
+	dollars, cents := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		dollars, cents = s[:i], s[i+1:]
+		if cents == "" {
+			return 0, fmt.Errorf("missing digits after the decimal point")
+		}
+		if len(cents) > 2 {
+			return 0, fmt.Errorf("more than two decimals")
+		}
+	}
+	if dollars == "" {
+		return 0, fmt.Errorf("missing dollars")
+	}
+
+	var amount money
+	for _, digits := range []string{dollars, cents} {
+		for _, r := range digits {
+			if r < '0' || r > '9' {
+				return 0, fmt.Errorf("unexpected character %q", r)
+			}
+			if amount > (maxMoney-9)/10 {
+				return 0, fmt.Errorf("amount is too large")
+			}
+			amount = amount*10 + money(r-'0')
+		}
+	}
+	for i := len(cents); i < 2; i++ {
+		if amount > maxMoney/10 {
+			return 0, fmt.Errorf("amount is too large")
+		}
+		amount *= 10
+	}
+
+	return amount, nil
+}
@@ -0,0 +1,52 @@
+package account
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMoney(t *testing.T) {
+	testCases := []struct {
+		caseName string
+		input    string
+		amount   money
+		err      error
+	}{
+		{caseName: "Dollars and cents", input: "$3318.47", amount: 331847},
+		{caseName: "Dollars only", input: "$5000", amount: 500000},
+		{caseName: "One decimal", input: "$0.5", amount: 50},
+		{caseName: "Zero", input: "$0.00", amount: 0},
+		{caseName: "Missing dollar sign", input: "3318.47",
+			err: fmt.Errorf(`money "3318.47" must start with '$'`)},
+		{caseName: "More than two decimals", input: "$1.001",
+			err: fmt.Errorf(`money "$1.001" is invalid: more than two decimals`)},
+		{caseName: "Negative amount", input: "$-1.00",
+			err: fmt.Errorf(`money "$-1.00" is invalid: unexpected character '-'`)},
+		{caseName: "Garbage after dollar sign", input: "$12abc",
+			err: fmt.Errorf(`money "$12abc" is invalid: unexpected character 'a'`)},
+		{caseName: "Whitespace", input: "$ 12.00",
+			err: fmt.Errorf(`money "$ 12.00" is invalid: unexpected character ' '`)},
+		{caseName: "Only dollar sign", input: "$",
+			err: fmt.Errorf(`money "$" is invalid: missing dollars`)},
+		{caseName: "Missing cents", input: "$12.",
+			err: fmt.Errorf(`money "$12." is invalid: missing digits after the decimal point`)},
+		{caseName: "Missing dollars", input: "$.50",
+			err: fmt.Errorf(`money "$.50" is invalid: missing dollars`)},
+		{caseName: "Too large", input: "$100000000000000",
+			err: fmt.Errorf(`money "$100000000000000" is invalid: amount is too large`)},
+	}
+
+	for _, c := range testCases {
+		amount, err := parseMoney(c.input)
+		assert.Equal(t, c.err, err, c.caseName)
+		assert.Equal(t, c.amount, amount, c.caseName)
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	assert.Equal(t, "$3318.47", money(331847).String())
+	assert.Equal(t, "$0.05", money(5).String())
+	assert.Equal(t, "-$12.30", money(-1230).String())
+}
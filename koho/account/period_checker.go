@@ -0,0 +1,197 @@
+package account
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// calendarPeriods - the calendar periods that accepted transactions can be counted in, from the shortest.
+var calendarPeriods = []rulePeriod{rulePeriodDay, rulePeriodWeek, rulePeriodMonth, rulePeriodQuarter, rulePeriodYear}
+
+// periodCounter - a checker that limits calendar periods, so that accepted transactions of its type must be counted
+// in them.
+type periodCounter interface {
+	countedPeriods() []rulePeriod
+}
+
+// periodKey - return the key of the calendar period that contains the given local time:
+// "yyyy-m-d" for a day, the date of the Monday for an ISO week, "yyyy-m" for a month, "yyyy-Qn" for a quarter
+// and "yyyy" for a year.
+func periodKey(period rulePeriod, localTime time.Time) transactionDate {
+	switch period {
+	case rulePeriodDay:
+		return dateFromTime(localTime)
+	case rulePeriodWeek:
+		return mondayDateFromTime(localTime)
+	case rulePeriodMonth:
+		return transactionDate(fmt.Sprintf("%d-%d", localTime.Year(), localTime.Month()))
+	case rulePeriodQuarter:
+		return transactionDate(fmt.Sprintf("%d-Q%d", localTime.Year(), (localTime.Month()+2)/3))
+	default:
+		return transactionDate(fmt.Sprintf("%d", localTime.Year()))
+	}
+}
+
+// periodKeyBefore - tell whether the calendar period with the key `x` is before the one with the key `y`. The numbers
+// of a key, e.g. the year, the month and the day, are compared in order.
+func periodKeyBefore(x, y transactionDate) bool {
+	isSeparator := func(r rune) bool {
+		return r < '0' || r > '9'
+	}
+	xs, ys := strings.FieldsFunc(x.String(), isSeparator), strings.FieldsFunc(y.String(), isSeparator)
+	for i := 0; i < len(xs) && i < len(ys); i++ {
+		xn, _ := strconv.Atoi(xs[i])
+		yn, _ := strconv.Atoi(ys[i])
+		if xn != yn {
+			return xn < yn
+		}
+	}
+	return len(xs) < len(ys)
+}
+
+// periodKey - return the key of the calendar period of the transaction.
+func (t *loadTransaction) periodKey(period rulePeriod) transactionDate {
+	switch period {
+	case rulePeriodDay:
+		return t.currentDate
+	case rulePeriodWeek:
+		return t.mondayDateOfCurrentWeek
+	default:
+		return periodKey(period, t.localTime)
+	}
+}
+
+// periodKey - return the key of the calendar period that the recorded transaction was counted in.
+func (r *transactionRecord) periodKey(period rulePeriod) transactionDate {
+	switch period {
+	case rulePeriodDay:
+		return r.Date
+	case rulePeriodWeek:
+		return r.Week
+	default:
+		date, err := time.Parse("2006-1-2", r.Date.String())
+		if err != nil {
+			// This should never happen
+			panic(fmt.Sprintf("invalid date %q of transaction record: %s", r.Date, err.Error()))
+		}
+		return periodKey(period, date)
+	}
+}
+
+// loadedFunds - return the funds of the accepted transactions in each period of the given kind.
+// The counters of days and weeks keep their own fields, so that persisted accounts can still be read.
+func (a *activityCounters) loadedFunds(period rulePeriod) map[transactionDate]money {
+	switch period {
+	case rulePeriodDay:
+		return a.DailyLoadedFunds
+	case rulePeriodWeek:
+		return a.WeeklyLoadedFunds
+	}
+	if a.PeriodLoadedFunds == nil {
+		a.PeriodLoadedFunds = make(map[rulePeriod]map[transactionDate]money, 0)
+	}
+	if a.PeriodLoadedFunds[period] == nil {
+		a.PeriodLoadedFunds[period] = make(map[transactionDate]money, 0)
+	}
+	return a.PeriodLoadedFunds[period]
+}
+
+// loadedTime - return the number of the accepted transactions in each period of the given kind.
+func (a *activityCounters) loadedTime(period rulePeriod) map[transactionDate]uint {
+	switch period {
+	case rulePeriodDay:
+		return a.DailyLoadedTime
+	case rulePeriodWeek:
+		return a.WeeklyLoadedTime
+	}
+	if a.PeriodLoadedTime == nil {
+		a.PeriodLoadedTime = make(map[rulePeriod]map[transactionDate]uint, 0)
+	}
+	if a.PeriodLoadedTime[period] == nil {
+		a.PeriodLoadedTime[period] = make(map[transactionDate]uint, 0)
+	}
+	return a.PeriodLoadedTime[period]
+}
+
+// count - count the given accepted transaction in the calendar period of the given kind that contains it, and drop
+// the counters of the periods before it, which no transaction is checked against anymore once a later period has
+// started.
+func (a *activityCounters) count(period rulePeriod, t *loadTransaction) {
+	key := t.periodKey(period)
+	funds, times := a.loadedFunds(period), a.loadedTime(period)
+	funds[key] += t.loadAmount
+	times[key] += 1
+	for k := range times {
+		if periodKeyBefore(k, key) {
+			delete(times, k)
+		}
+	}
+	for k := range funds {
+		if periodKeyBefore(k, key) {
+			delete(funds, k)
+		}
+	}
+}
+
+// periodChecker - check whether given transaction hit the fund or time limit of a calendar period.
+type periodChecker struct {
+	period   rulePeriod
+	kind     ruleKind
+	maxFunds money
+	maxTimes uint
+	message  string
+}
+
+func newPeriodFundsChecker(period rulePeriod, maxFunds money, message string) *periodChecker {
+	return &periodChecker{period: period, kind: ruleKindAmount, maxFunds: maxFunds, message: message}
+}
+
+func newPeriodLoadTimeChecker(period rulePeriod, maxTimes uint, message string) *periodChecker {
+	return &periodChecker{period: period, kind: ruleKindCount, maxTimes: maxTimes, message: message}
+}
+
+func (c *periodChecker) countedPeriods() []rulePeriod {
+	return []rulePeriod{c.period}
+}
+
+func (c *periodChecker) check(a *customerAccount, t *loadTransaction) error {
+	key := t.periodKey(c.period)
+	counters := a.counters(t.Type)
+	if c.kind == ruleKindAmount && counters.loadedFunds(c.period)[key]+t.loadAmount > c.maxFunds ||
+		c.kind == ruleKindCount && counters.loadedTime(c.period)[key]+1 > c.maxTimes {
+		return newDeclineError(periodReasonCodes[c.period][c.kind], "%s %s", c.message, describePeriod(c.period, key))
+	}
+	return nil
+}
+
+// periodAdjectives - the adjectives of calendar periods used in messages.
+var periodAdjectives = map[rulePeriod]string{
+	rulePeriodDay:     "daily",
+	rulePeriodWeek:    "weekly",
+	rulePeriodMonth:   "monthly",
+	rulePeriodQuarter: "quarterly",
+	rulePeriodYear:    "yearly",
+}
+
+// periodReasonCodes - the reason codes of the limits of each calendar period and kind.
+var periodReasonCodes = map[rulePeriod]map[ruleKind]reasonCode{
+	rulePeriodDay:     {ruleKindAmount: reasonDailyAmount, ruleKindCount: reasonDailyCount},
+	rulePeriodWeek:    {ruleKindAmount: reasonWeeklyAmount, ruleKindCount: reasonWeeklyCount},
+	rulePeriodMonth:   {ruleKindAmount: reasonMonthlyAmount, ruleKindCount: reasonMonthlyCount},
+	rulePeriodQuarter: {ruleKindAmount: reasonQuarterlyAmount, ruleKindCount: reasonQuarterlyCount},
+	rulePeriodYear:    {ruleKindAmount: reasonYearlyAmount, ruleKindCount: reasonYearlyCount},
+}
+
+// describePeriod - describe the calendar period with the given key for messages.
+func describePeriod(period rulePeriod, key transactionDate) string {
+	switch period {
+	case rulePeriodDay:
+		return fmt.Sprintf("on date %s", key)
+	case rulePeriodWeek:
+		return fmt.Sprintf("on week which monday is %s", key)
+	default:
+		return fmt.Sprintf("in %s %s", period, key)
+	}
+}
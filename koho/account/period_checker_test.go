@@ -0,0 +1,190 @@
+package account
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeriodKey(t *testing.T) {
+	testCases := []struct {
+		caseName string
+		time     time.Time
+		keys     map[rulePeriod]transactionDate
+	}{
+		{
+			caseName: "A Sunday at the end of a year is in the week of the Monday before",
+			time:     time.Date(2000, 12, 31, 23, 0, 0, 0, time.UTC),
+			keys: map[rulePeriod]transactionDate{
+				rulePeriodDay: "2000-12-31", rulePeriodWeek: "2000-12-25", rulePeriodMonth: "2000-12",
+				rulePeriodQuarter: "2000-Q4", rulePeriodYear: "2000",
+			},
+		},
+		{
+			caseName: "A Monday at the beginning of a year",
+			time:     time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC),
+			keys: map[rulePeriod]transactionDate{
+				rulePeriodDay: "2001-1-1", rulePeriodWeek: "2001-1-1", rulePeriodMonth: "2001-1",
+				rulePeriodQuarter: "2001-Q1", rulePeriodYear: "2001",
+			},
+		},
+		{
+			caseName: "The last day of the first quarter",
+			time:     time.Date(2001, 3, 31, 0, 0, 0, 0, time.UTC),
+			keys:     map[rulePeriod]transactionDate{rulePeriodMonth: "2001-3", rulePeriodQuarter: "2001-Q1"},
+		},
+		{
+			caseName: "The first day of the second quarter",
+			time:     time.Date(2001, 4, 1, 0, 0, 0, 0, time.UTC),
+			keys:     map[rulePeriod]transactionDate{rulePeriodMonth: "2001-4", rulePeriodQuarter: "2001-Q2"},
+		},
+		{
+			caseName: "The third quarter",
+			time:     time.Date(2001, 9, 30, 0, 0, 0, 0, time.UTC),
+			keys:     map[rulePeriod]transactionDate{rulePeriodQuarter: "2001-Q3"},
+		},
+	}
+
+	for _, c := range testCases {
+		for period, key := range c.keys {
+			assert.Equal(t, key, periodKey(period, c.time), c.caseName)
+		}
+	}
+}
+
+func TestPeriodChecker(t *testing.T) {
+	account := newCustomerAccount("1")
+	for _, day := range []int{1, 15, 31} {
+		transaction := newTestTransaction(t, "1", "1", "$20000.00", time.Date(2021, 1, day, 0, 0, 0, 0, time.UTC))
+		account.apply(transaction, calendarPeriods)
+	}
+
+	testCases := []struct {
+		caseName string
+		checker  *periodChecker
+		time     time.Time
+		err      error
+	}{
+		{
+			caseName: "The monthly cap is reached",
+			checker:  newPeriodFundsChecker(rulePeriodMonth, 6000000, "exceeds maximum monthly load funds ($60000.00)"),
+			time:     time.Date(2021, 1, 31, 12, 0, 0, 0, time.UTC),
+			err: newDeclineError(reasonMonthlyAmount,
+				"exceeds maximum monthly load funds ($60000.00) in month 2021-1"),
+		},
+		{
+			caseName: "The monthly cap is reset in the next month",
+			checker:  newPeriodFundsChecker(rulePeriodMonth, 6000000, "exceeds maximum monthly load funds ($60000.00)"),
+			time:     time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			caseName: "The quarterly count is reached",
+			checker:  newPeriodLoadTimeChecker(rulePeriodQuarter, 3, "too many this quarter"),
+			time:     time.Date(2021, 3, 31, 0, 0, 0, 0, time.UTC),
+			err:      newDeclineError(reasonQuarterlyCount, "too many this quarter in quarter 2021-Q1"),
+		},
+		{
+			caseName: "The yearly cap is not reached",
+			checker:  newPeriodFundsChecker(rulePeriodYear, 6000100, "exceeds maximum yearly load funds ($60001.00)"),
+			time:     time.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			caseName: "The yearly cap is reached",
+			checker:  newPeriodFundsChecker(rulePeriodYear, 6000099, "exceeds maximum yearly load funds ($60000.99)"),
+			time:     time.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC),
+			err: newDeclineError(reasonYearlyAmount,
+				"exceeds maximum yearly load funds ($60000.99) in year 2021"),
+		},
+	}
+
+	for _, c := range testCases {
+		transaction := newTestTransaction(t, "2", "1", "$1.00", c.time)
+		assert.Equal(t, c.err, c.checker.check(account, transaction), c.caseName)
+	}
+}
+
+func TestProcessMonthlyCap(t *testing.T) {
+	rules, err := parseRules([]byte(`
+rules:
+  - kind: amount
+    period: month
+    amount: 50000
+`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$30000.00","time":"2000-01-03T00:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$20000.01","time":"2000-01-31T00:00:00Z"}`,
+		`{"id":"3","customer_id":"1","type":"reversal","original_id":"1","time":"2000-02-01T00:00:00Z"}`,
+		`{"id":"4","customer_id":"1","load_amount":"$20000.01","time":"2000-01-31T01:00:00Z"}`,
+		`{"id":"5","customer_id":"1","load_amount":"$50000.00","time":"2000-02-01T01:00:00Z"}`,
+	}
+	output := runManager(t, NewManager(WithRules(rules), WithOutputFormat(OutputFormatDetailed)), input)
+	assert.Equal(t, []string{
+		`{"id":"1","customer_id":"1","accepted":true,"headroom":{"monthly_amount":"$20000.00"},` +
+			`"balance":"$30000.00"}`,
+		`{"id":"2","customer_id":"1","accepted":false,"reason_code":"MONTHLY_AMOUNT",` +
+			`"message":"exceeds maximum monthly load funds ($50000.00) in month 2000-1",` +
+			`"headroom":{"monthly_amount":"$20000.00"},"balance":"$30000.00"}`,
+		`{"id":"3","customer_id":"1","type":"reversal","original_id":"1","accepted":true,"balance":"$0.00"}`,
+		`{"id":"4","customer_id":"1","accepted":true,"headroom":{"monthly_amount":"$29999.99"},` +
+			`"balance":"$20000.01"}`,
+		`{"id":"5","customer_id":"1","accepted":true,"headroom":{"monthly_amount":"$0.00"},"balance":"$70000.01"}`,
+	}, output)
+}
+
+func TestPeriodKeyBefore(t *testing.T) {
+	assert.True(t, periodKeyBefore("2000-1-31", "2000-2-1"))
+	assert.True(t, periodKeyBefore("2000-9-30", "2000-10-1"))
+	assert.True(t, periodKeyBefore("1999-12-27", "2000-1-3"))
+	assert.True(t, periodKeyBefore("2000-Q4", "2001-Q1"))
+	assert.True(t, periodKeyBefore("1999", "2000"))
+	assert.False(t, periodKeyBefore("2000-10", "2000-9"))
+	assert.False(t, periodKeyBefore("2000-1-3", "2000-1-3"))
+}
+
+func TestCountPeriods(t *testing.T) {
+	rules, err := parseRules([]byte(`
+rules:
+  - kind: amount
+    period: day
+    amount: 500000
+  - type: withdrawal
+    kind: expression
+    expression: count(quarter) >= 3 || sum(amount, week) > 1000
+  - type: withdrawal
+    kind: count
+    period: day
+    count: 3
+`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, map[transactionType][]rulePeriod{
+		transactionTypeLoad:       {rulePeriodDay},
+		transactionTypeWithdrawal: {rulePeriodDay, rulePeriodWeek, rulePeriodQuarter},
+	}, rules.periods)
+
+	// Transactions are only counted in the periods that the rules of their type limit, and the counters of the
+	// periods before the one of the latest transaction are dropped.
+	account := newCustomerAccount("1")
+	for _, day := range []int{3, 4, 11} {
+		transaction := newTestTransaction(t, "1", "1", "$100.00", time.Date(2000, 1, day, 0, 0, 0, 0, time.UTC))
+		account.apply(transaction, rules.periods[transactionTypeLoad])
+		transaction.Type = transactionTypeWithdrawal
+		account.apply(transaction, rules.periods[transactionTypeWithdrawal])
+	}
+	assert.Equal(t, map[transactionDate]money{"2000-1-11": 10000}, account.DailyLoadedFunds)
+	assert.Equal(t, map[transactionDate]uint{"2000-1-11": 1}, account.DailyLoadedTime)
+	assert.Empty(t, account.WeeklyLoadedFunds)
+	assert.Nil(t, account.PeriodLoadedFunds)
+
+	withdrawals := account.Withdrawals
+	assert.Equal(t, map[transactionDate]uint{"2000-1-11": 1}, withdrawals.DailyLoadedTime)
+	assert.Equal(t, map[transactionDate]money{"2000-1-10": 10000}, withdrawals.WeeklyLoadedFunds)
+	assert.Equal(t, map[rulePeriod]map[transactionDate]uint{rulePeriodQuarter: {"2000-Q1": 3}},
+		withdrawals.PeriodLoadedTime)
+}
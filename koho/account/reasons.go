@@ -0,0 +1,225 @@
+package account
+
+import (
+	"errors"
+	"fmt"
+)
+
+// reasonCode - a stable, machine-readable reason why a transaction is declined.
+type reasonCode string
+
+const (
+	reasonDailyAmount       reasonCode = "DAILY_AMOUNT"
+	reasonWeeklyAmount      reasonCode = "WEEKLY_AMOUNT"
+	reasonDailyCount        reasonCode = "DAILY_COUNT"
+	reasonWeeklyCount       reasonCode = "WEEKLY_COUNT"
+	reasonMonthlyAmount     reasonCode = "MONTHLY_AMOUNT"
+	reasonMonthlyCount      reasonCode = "MONTHLY_COUNT"
+	reasonQuarterlyAmount   reasonCode = "QUARTERLY_AMOUNT"
+	reasonQuarterlyCount    reasonCode = "QUARTERLY_COUNT"
+	reasonYearlyAmount      reasonCode = "YEARLY_AMOUNT"
+	reasonYearlyCount       reasonCode = "YEARLY_COUNT"
+	reasonRollingAmount     reasonCode = "ROLLING_AMOUNT"
+	reasonRollingCount      reasonCode = "ROLLING_COUNT"
+	reasonBurst             reasonCode = "BURST"
+	reasonCoolingOff        reasonCode = "COOLING_OFF"
+	reasonInsufficientFunds reasonCode = "INSUFFICIENT_FUNDS"
+	reasonMaxBalance        reasonCode = "MAX_BALANCE"
+	reasonUnknownOriginal   reasonCode = "UNKNOWN_ORIGINAL"
+	reasonAlreadyReversed   reasonCode = "ALREADY_REVERSED"
+	reasonCustomRule        reasonCode = "CUSTOM_RULE"
+	reasonInvalidInput      reasonCode = "INVALID_INPUT"
+	reasonLate              reasonCode = "LATE"
+	reasonDuplicate         reasonCode = "DUPLICATE"
+	reasonConflict          reasonCode = "CONFLICT"
+	reasonInternalError     reasonCode = "INTERNAL_ERROR"
+)
+
+// declineError - the reason why a transaction is declined.
+type declineError struct {
+	code    reasonCode
+	message string
+	rule    string // The name of the rule that declined the transaction, if a rule did.
+}
+
+// newDeclineError - create a decline error with the given reason code and a formatted message.
+func newDeclineError(code reasonCode, format string, args ...interface{}) *declineError {
+	return &declineError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// Error - return the human-readable message of the decline error.
+func (e *declineError) Error() string {
+	return e.message
+}
+
+// reasonCodeOf - return the reason code of the given error. An error that is not a decline error means
+// the transaction could not be processed, e.g. because its decision could not be persisted.
+func reasonCodeOf(err error) reasonCode {
+	if err == nil {
+		return ""
+	}
+	var declineErr *declineError
+	if errors.As(err, &declineErr) {
+		return declineErr.code
+	}
+	return reasonInternalError
+}
+
+// ruleOf - return the name of the rule that declined a transaction with the given error, or an empty string if
+// no rule did, e.g. because the wallet has insufficient funds.
+func ruleOf(err error) string {
+	var declineErr *declineError
+	if errors.As(err, &declineErr) {
+		return declineErr.rule
+	}
+	return ""
+}
+
+/****************************************************************************************/
+
+// OutputFormat - the format of transaction results.
+type OutputFormat string
+
+const (
+	// OutputFormatKOHO - the original KOHO format, which only tells whether a transaction is accepted.
+	OutputFormatKOHO OutputFormat = "koho"
+	// OutputFormatDetailed - the KOHO format plus the reason code and message of a declined transaction and
+	// the remaining headroom of the customer after the decision.
+	OutputFormatDetailed OutputFormat = "detailed"
+)
+
+// ParseOutputFormat - parse the given output format name.
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	switch format := OutputFormat(s); format {
+	case OutputFormatKOHO, OutputFormatDetailed:
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid output format %q: must be one of %q, %q",
+			s, OutputFormatKOHO, OutputFormatDetailed)
+	}
+}
+
+// headroom - how much a customer can still load after a decision, according to the calendar limits.
+// A field is omitted if there is no limit of its kind and period.
+type headroom struct {
+	DailyAmount     string `json:"daily_amount,omitempty"`
+	WeeklyAmount    string `json:"weekly_amount,omitempty"`
+	MonthlyAmount   string `json:"monthly_amount,omitempty"`
+	QuarterlyAmount string `json:"quarterly_amount,omitempty"`
+	YearlyAmount    string `json:"yearly_amount,omitempty"`
+	DailyCount      *uint  `json:"daily_count,omitempty"`
+	WeeklyCount     *uint  `json:"weekly_count,omitempty"`
+	MonthlyCount    *uint  `json:"monthly_count,omitempty"`
+	QuarterlyCount  *uint  `json:"quarterly_count,omitempty"`
+	YearlyCount     *uint  `json:"yearly_count,omitempty"`
+}
+
+// headroomReporter - a checker that limits a calendar period and can tell the remaining headroom of the period.
+type headroomReporter interface {
+	reportHeadroom(a *customerAccount, t *loadTransaction, h *headroomTotals)
+}
+
+// headroomTotals - the smallest remaining headroom of each kind and period among the limits.
+type headroomTotals struct {
+	amounts map[rulePeriod]*money
+	counts  map[rulePeriod]*uint
+}
+
+// minMoney - keep the smaller remaining amount in `current`, where a negative amount counts as zero.
+func minMoney(current **money, limit, used money) {
+	remaining := limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	if *current == nil || remaining < **current {
+		*current = &remaining
+	}
+}
+
+// minCount - keep the smaller remaining count in `current`, where a negative count counts as zero.
+func minCount(current **uint, limit, used uint) {
+	remaining := uint(0)
+	if limit > used {
+		remaining = limit - used
+	}
+	if *current == nil || remaining < **current {
+		*current = &remaining
+	}
+}
+
+func (c *periodChecker) reportHeadroom(a *customerAccount, t *loadTransaction, h *headroomTotals) {
+	key := t.periodKey(c.period)
+	counters := a.counters(t.Type)
+	if c.kind == ruleKindAmount {
+		current := h.amounts[c.period]
+		minMoney(&current, c.maxFunds, counters.loadedFunds(c.period)[key])
+		h.amounts[c.period] = current
+	} else {
+		current := h.counts[c.period]
+		minCount(&current, c.maxTimes, counters.loadedTime(c.period)[key])
+		h.counts[c.period] = current
+	}
+}
+
+// headroom - return the remaining headroom of the customer in the calendar periods of the given transaction,
+// according to the limits of the transaction's type. It is nil if the type has no such limits.
+// The caller must hold the lock of the account.
+func (m *ManagerDefault) headroom(a *customerAccount, t *loadTransaction) *headroom {
+	totals := &headroomTotals{amounts: make(map[rulePeriod]*money, 0), counts: make(map[rulePeriod]*uint, 0)}
+	reported := false
+	for _, checker := range m.transactionCheckers[t.Type] {
+		if reporter, ok := checker.(headroomReporter); ok {
+			reporter.reportHeadroom(a, t, totals)
+			reported = true
+		}
+	}
+	if !reported {
+		return nil
+	}
+
+	amount := func(period rulePeriod) string {
+		if totals.amounts[period] == nil {
+			return ""
+		}
+		return totals.amounts[period].String()
+	}
+	return &headroom{
+		DailyAmount:     amount(rulePeriodDay),
+		WeeklyAmount:    amount(rulePeriodWeek),
+		MonthlyAmount:   amount(rulePeriodMonth),
+		QuarterlyAmount: amount(rulePeriodQuarter),
+		YearlyAmount:    amount(rulePeriodYear),
+		DailyCount:      totals.counts[rulePeriodDay],
+		WeeklyCount:     totals.counts[rulePeriodWeek],
+		MonthlyCount:    totals.counts[rulePeriodMonth],
+		QuarterlyCount:  totals.counts[rulePeriodQuarter],
+		YearlyCount:     totals.counts[rulePeriodYear],
+	}
+}
+
+// detailedTransactionResult - a transaction result in the detailed output format.
+// Balance is the balance of the customer's wallet after the decision.
+type detailedTransactionResult struct {
+	*loadTransactionResult
+	ReasonCode reasonCode `json:"reason_code,omitempty"`
+	Message    string     `json:"message,omitempty"`
+	Headroom   *headroom  `json:"headroom,omitempty"`
+	Balance    string     `json:"balance,omitempty"`
+}
+
+// output - return the given result in the manager's output format.
+func (m *ManagerDefault) output(result *loadTransactionResult) interface{} {
+	if m.outputFormat != OutputFormatDetailed {
+		return result
+	}
+	detailed := &detailedTransactionResult{
+		loadTransactionResult: result,
+		ReasonCode:            reasonCodeOf(result.Error),
+		Headroom:              result.headroom,
+		Balance:               result.balance,
+	}
+	if result.Error != nil {
+		detailed.Message = result.Error.Error()
+	}
+	return detailed
+}
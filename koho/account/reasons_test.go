@@ -0,0 +1,60 @@
+package account
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetailedOutputFormat(t *testing.T) {
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$4000.00","time":"2000-01-03T01:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$1000.01","time":"2000-01-03T02:00:00Z"}`,
+		`{"id":"1","customer_id":"1","load_amount":"$4000.00","time":"2000-01-03T01:00:00Z"}`,
+		`{"id":"4","customer_id":"1","load_amount":"$1000.00","time":"2000-01-03T04:00:00Z"}`,
+		`{"id":"5","customer_id":"1","load_amount":"$1.00","time":"2000-01-03T05:00:00Z"}`,
+	}
+
+	output := runManager(t, NewManager(WithOutputFormat(OutputFormatDetailed)), input)
+	assert.Equal(t, []string{
+		`{"id":"1","customer_id":"1","accepted":true,"headroom":` +
+			`{"daily_amount":"$1000.00","weekly_amount":"$16000.00","daily_count":2},"balance":"$4000.00"}`,
+		`{"id":"2","customer_id":"1","accepted":false,"reason_code":"DAILY_AMOUNT",` +
+			`"message":"exceeds maximum daily load funds ($5,000) on date 2000-1-3","headroom":` +
+			`{"daily_amount":"$1000.00","weekly_amount":"$16000.00","daily_count":2},"balance":"$4000.00"}`,
+		`{"id":"1","customer_id":"1","accepted":true,"outcome":"duplicate","headroom":` +
+			`{"daily_amount":"$1000.00","weekly_amount":"$16000.00","daily_count":2},"balance":"$4000.00"}`,
+		`{"id":"4","customer_id":"1","accepted":true,"headroom":` +
+			`{"daily_amount":"$0.00","weekly_amount":"$15000.00","daily_count":1},"balance":"$5000.00"}`,
+		`{"id":"5","customer_id":"1","accepted":false,"reason_code":"DAILY_AMOUNT",` +
+			`"message":"exceeds maximum daily load funds ($5,000) on date 2000-1-3","headroom":` +
+			`{"daily_amount":"$0.00","weekly_amount":"$15000.00","daily_count":1},"balance":"$5000.00"}`,
+	}, output)
+
+	// An invalid transaction is declined without being checked, and the KOHO format only tells it is declined.
+	invalid := []string{`{"id":"3","customer_id":"1","load_amount":"1000.00","time":"2000-01-03T03:00:00Z"}`}
+	output = runManager(t, NewManager(WithOutputFormat(OutputFormatDetailed)), invalid)
+	assert.Equal(t, []string{
+		`{"id":"3","customer_id":"1","accepted":false,"reason_code":"INVALID_INPUT",` +
+			`"message":"invalid transaction: transaction's load amount is not valid: ` +
+			`money \"1000.00\" must start with '$'"}`,
+	}, output)
+	output = runManager(t, NewManager(), invalid)
+	assert.Equal(t, []string{`{"id":"3","customer_id":"1","accepted":false}`}, output)
+}
+
+func TestReasonCodeOf(t *testing.T) {
+	assert.Equal(t, reasonCode(""), reasonCodeOf(nil))
+	assert.Equal(t, reasonWeeklyCount, reasonCodeOf(newDeclineError(reasonWeeklyCount, "too many loads")))
+	assert.Equal(t, reasonInternalError, reasonCodeOf(fmt.Errorf("error persisting the decision")))
+}
+
+func TestParseOutputFormat(t *testing.T) {
+	format, err := ParseOutputFormat("detailed")
+	assert.NoError(t, err)
+	assert.Equal(t, OutputFormatDetailed, format)
+
+	_, err = ParseOutputFormat("csv")
+	assert.Equal(t, fmt.Errorf(`invalid output format "csv": must be one of "koho", "detailed"`), err)
+}
@@ -0,0 +1,31 @@
+package account
+
+// reorderBuffer - a buffer that holds transaction results until the results of all the transactions read before
+// them are released, so that results are released in the order of their transactions in the input.
+// It does not need its own limit, as every result in it holds a pending slot.
+type reorderBuffer struct {
+	next    uint64
+	pending map[uint64]*loadTransactionResult
+}
+
+func newReorderBuffer() *reorderBuffer {
+	return &reorderBuffer{
+		pending: make(map[uint64]*loadTransactionResult, 0),
+	}
+}
+
+// push - hold the given result until it is its turn to be released.
+func (b *reorderBuffer) push(result *loadTransactionResult) {
+	b.pending[result.seq] = result
+}
+
+// pop - release the next result in input order, or return nil if it is not ready yet.
+func (b *reorderBuffer) pop() *loadTransactionResult {
+	result := b.pending[b.next]
+	if result == nil {
+		return nil
+	}
+	delete(b.pending, b.next)
+	b.next++
+	return result
+}
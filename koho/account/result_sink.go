@@ -0,0 +1,388 @@
+package account
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// ResultEncoding - the encoding of the transaction results written to an output file.
+type ResultEncoding string
+
+const (
+	// ResultEncodingAuto - tell the encoding by the extension of the output file: CSV for `.csv` and NDJSON otherwise.
+	ResultEncodingAuto ResultEncoding = ""
+	// ResultEncodingNDJSON - a JSON result per line, e.g. `{"id":"1","customer_id":"1","accepted":true}`.
+	ResultEncodingNDJSON ResultEncoding = "ndjson"
+	// ResultEncodingCSV - a header row that names the columns, then a result per row.
+	ResultEncodingCSV ResultEncoding = "csv"
+)
+
+// ParseResultEncoding - parse the given result encoding name. An empty name tells the encoding by the file extension.
+func ParseResultEncoding(s string) (ResultEncoding, error) {
+	switch encoding := ResultEncoding(s); encoding {
+	case ResultEncodingAuto, ResultEncodingNDJSON, ResultEncodingCSV:
+		return encoding, nil
+	default:
+		return "", fmt.Errorf("invalid output encoding %q: must be one of %q, %q",
+			s, ResultEncodingNDJSON, ResultEncodingCSV)
+	}
+}
+
+// SummaryFormat - the format of the summary of the results of a run.
+type SummaryFormat string
+
+const (
+	// SummaryText - a report meant to be read by people.
+	SummaryText SummaryFormat = "text"
+	// SummaryJSON - a JSON object meant to be read by other programs.
+	SummaryJSON SummaryFormat = "json"
+)
+
+// ParseSummaryFormat - parse the given summary format name.
+func ParseSummaryFormat(s string) (SummaryFormat, error) {
+	switch format := SummaryFormat(s); format {
+	case SummaryText, SummaryJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid summary format %q: must be one of %q, %q", s, SummaryText, SummaryJSON)
+	}
+}
+
+// topDeclinedCustomers - the number of customers with the most declined transactions listed by a summary.
+const topDeclinedCustomers = 10
+
+// resultSink - a destination of transaction results, e.g. an output file. Results are written one by one, by a single
+// routine, in the order they are ready to be written.
+type resultSink interface {
+	// write - write the given result.
+	write(result *loadTransactionResult) error
+	// flush - emit the results written so far, so that they are emitted incrementally.
+	flush() error
+	// close - emit the results written so far and release the resources of the sink.
+	close() error
+}
+
+// openResultSink - open the sink of the results of a run that writes them to the given output file.
+// Params:
+//	outputFile: The file that results are written to, in the manager's result encoding or in the encoding told by its
+//		extension. If the output is split, accepted and declined results are written to two files named after it
+//		instead, e.g. `output.accepted.txt` and `output.declined.txt` for `output.txt`.
+// Returns:
+//	resultSink: The sink of the results, including the summary of the run if the manager has one.
+//	error: Any error that occurred during creating the output files.
+func (m *ManagerDefault) openResultSink(outputFile string) (resultSink, error) {
+	sinks := make(multiResultSink, 0, 3)
+	create := func(file string) error {
+		sink, err := m.createResultFile(file)
+		if err != nil {
+			_ = sinks.close()
+			return fmt.Errorf("error openning output file %s: %s", file, err.Error())
+		}
+		sinks = append(sinks, sink)
+		return nil
+	}
+
+	if !m.splitOutput {
+		if err := create(outputFile); err != nil {
+			return nil, err
+		}
+	} else {
+		ext := filepath.Ext(outputFile)
+		base := strings.TrimSuffix(outputFile, ext)
+		if err := create(base + ".accepted" + ext); err != nil {
+			return nil, err
+		}
+		if err := create(base + ".declined" + ext); err != nil {
+			return nil, err
+		}
+		sinks = multiResultSink{&splitResultSink{accepted: sinks[0], declined: sinks[1]}}
+	}
+
+	if m.summaryOutput != nil {
+		sinks = append(sinks, newSummaryResultSink(m.summaryOutput, m.summaryFormat))
+	}
+	return sinks, nil
+}
+
+// createResultFile - create the given output file, or open it to append to it if the processing is resumed, and
+// a sink that writes results to it.
+func (m *ManagerDefault) createResultFile(outputFile string) (resultSink, error) {
+	encoding := m.resultEncoding
+	if encoding == ResultEncodingAuto {
+		encoding = ResultEncodingNDJSON
+		if filepath.Ext(outputFile) == ".csv" {
+			encoding = ResultEncodingCSV
+		}
+	}
+
+	file, err := createOutputFile(outputFile, m.resume)
+	if err != nil {
+		return nil, err
+	}
+	if encoding == ResultEncodingCSV {
+		// The header is already written if the processing is resumed.
+		info, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		return newCSVResultSink(file, m.outputFormat == OutputFormatDetailed, info.Size() == 0), nil
+	}
+	return newNDJSONResultSink(file, m.output), nil
+}
+
+/****************************************************************************************/
+
+// ndjsonResultSink - a sink of results that writes a JSON object per line.
+type ndjsonResultSink struct {
+	output *bufio.Writer
+	enc    *json.Encoder
+	format func(result *loadTransactionResult) interface{} // Return the result in the output format.
+	closer io.Closer                                       // Nil if the output is not closed with the sink.
+}
+
+// newNDJSONResultSink - create a sink that writes results to the given output in the given format. The output is
+// closed with the sink if it is an io.Closer.
+func newNDJSONResultSink(output io.Writer, format func(result *loadTransactionResult) interface{}) *ndjsonResultSink {
+	buffered := bufio.NewWriter(output)
+	closer, _ := output.(io.Closer)
+	return &ndjsonResultSink{output: buffered, enc: json.NewEncoder(buffered), format: format, closer: closer}
+}
+
+func (s *ndjsonResultSink) write(result *loadTransactionResult) error {
+	return s.enc.Encode(s.format(result))
+}
+
+func (s *ndjsonResultSink) flush() error {
+	return s.output.Flush()
+}
+
+func (s *ndjsonResultSink) close() error {
+	return closeResultOutput(s.flush(), s.closer)
+}
+
+/****************************************************************************************/
+
+// csvResultSink - a sink of results that writes a header row, then a row per result. The detailed output format
+// adds the reason code, message and balance columns, but not the headroom.
+type csvResultSink struct {
+	output   *csv.Writer
+	detailed bool
+	closer   io.Closer // Nil if the output is not closed with the sink.
+}
+
+// newCSVResultSink - create a sink that writes results to the given output, after the header row if `header` is true.
+// The output is closed with the sink if it is an io.Closer.
+func newCSVResultSink(output io.Writer, detailed, header bool) *csvResultSink {
+	closer, _ := output.(io.Closer)
+	s := &csvResultSink{output: csv.NewWriter(output), detailed: detailed, closer: closer}
+	if header {
+		columns := []string{"id", "customer_id", "type", "original_id", "accepted", "outcome"}
+		if detailed {
+			columns = append(columns, "reason_code", "message", "balance")
+		}
+		_ = s.output.Write(columns)
+	}
+	return s
+}
+
+func (s *csvResultSink) write(result *loadTransactionResult) error {
+	row := []string{result.ID.String(), result.CustomerID.String(), string(result.Type), result.OriginalID.String(),
+		strconv.FormatBool(result.Accepted), string(result.Outcome)}
+	if s.detailed {
+		message := ""
+		if result.Error != nil {
+			message = result.Error.Error()
+		}
+		row = append(row, string(reasonCodeOf(result.Error)), message, result.balance)
+	}
+	return s.output.Write(row)
+}
+
+func (s *csvResultSink) flush() error {
+	s.output.Flush()
+	return s.output.Error()
+}
+
+func (s *csvResultSink) close() error {
+	return closeResultOutput(s.flush(), s.closer)
+}
+
+// closeResultOutput - close the given output, if any, after it is flushed with the given error.
+func closeResultOutput(flushErr error, closer io.Closer) error {
+	if closer == nil {
+		return flushErr
+	}
+	if err := closer.Close(); flushErr == nil {
+		return err
+	}
+	return flushErr
+}
+
+/****************************************************************************************/
+
+// splitResultSink - a sink that writes accepted and declined results to different sinks.
+type splitResultSink struct {
+	accepted resultSink
+	declined resultSink
+}
+
+func (s *splitResultSink) write(result *loadTransactionResult) error {
+	if result.Accepted {
+		return s.accepted.write(result)
+	}
+	return s.declined.write(result)
+}
+
+func (s *splitResultSink) flush() error {
+	return multiResultSink{s.accepted, s.declined}.flush()
+}
+
+func (s *splitResultSink) close() error {
+	return multiResultSink{s.accepted, s.declined}.close()
+}
+
+/****************************************************************************************/
+
+// multiResultSink - a sink that writes every result to all of the given sinks.
+type multiResultSink []resultSink
+
+func (s multiResultSink) write(result *loadTransactionResult) error {
+	var firstErr error
+	for _, sink := range s {
+		if err := sink.write(result); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s multiResultSink) flush() error {
+	var firstErr error
+	for _, sink := range s {
+		if err := sink.flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s multiResultSink) close() error {
+	var firstErr error
+	for _, sink := range s {
+		if err := sink.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+/****************************************************************************************/
+
+// resultSummary - the summary of the results of a run.
+type resultSummary struct {
+	Total                int                `json:"total"`
+	Accepted             int                `json:"accepted"`
+	Declined             int                `json:"declined"`
+	DeclineReasons       map[reasonCode]int `json:"decline_reasons"`
+	TopDeclinedCustomers []customerDeclines `json:"top_declined_customers"` // The most declined customers first.
+}
+
+// customerDeclines - the number of declined transactions of a customer.
+type customerDeclines struct {
+	CustomerID identifier `json:"customer_id"`
+	Declined   int        `json:"declined"`
+}
+
+// summaryResultSink - a sink that counts results and writes their summary to its output once it is closed.
+// The output is not closed with the sink.
+type summaryResultSink struct {
+	output    io.Writer
+	format    SummaryFormat
+	summary   resultSummary
+	customers map[identifier]int // The number of declined transactions of each customer.
+}
+
+func newSummaryResultSink(output io.Writer, format SummaryFormat) *summaryResultSink {
+	return &summaryResultSink{
+		output:    output,
+		format:    format,
+		summary:   resultSummary{DeclineReasons: make(map[reasonCode]int)},
+		customers: make(map[identifier]int),
+	}
+}
+
+func (s *summaryResultSink) write(result *loadTransactionResult) error {
+	s.summary.Total++
+	if result.Accepted {
+		s.summary.Accepted++
+		return nil
+	}
+	s.summary.Declined++
+	s.summary.DeclineReasons[reasonCodeOf(result.Error)]++
+	s.customers[result.CustomerID]++
+	return nil
+}
+
+func (s *summaryResultSink) flush() error {
+	return nil
+}
+
+func (s *summaryResultSink) close() error {
+	summary := s.summary
+	summary.TopDeclinedCustomers = make([]customerDeclines, 0, len(s.customers))
+	for customerID, declined := range s.customers {
+		summary.TopDeclinedCustomers = append(summary.TopDeclinedCustomers, customerDeclines{customerID, declined})
+	}
+	sort.Slice(summary.TopDeclinedCustomers, func(i, j int) bool {
+		a, b := summary.TopDeclinedCustomers[i], summary.TopDeclinedCustomers[j]
+		if a.Declined != b.Declined {
+			return a.Declined > b.Declined
+		}
+		return a.CustomerID < b.CustomerID
+	})
+	if len(summary.TopDeclinedCustomers) > topDeclinedCustomers {
+		summary.TopDeclinedCustomers = summary.TopDeclinedCustomers[:topDeclinedCustomers]
+	}
+
+	if s.format == SummaryJSON {
+		return json.NewEncoder(s.output).Encode(&summary)
+	}
+	return writeSummaryReport(s.output, &summary)
+}
+
+// writeSummaryReport - write the given summary as a report meant to be read by people.
+func writeSummaryReport(w io.Writer, summary *resultSummary) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "Transactions:\t%d\n", summary.Total)
+	_, _ = fmt.Fprintf(tw, "Accepted:\t%d\n", summary.Accepted)
+	_, _ = fmt.Fprintf(tw, "Declined:\t%d\n", summary.Declined)
+
+	if len(summary.DeclineReasons) > 0 {
+		reasons := make([]string, 0, len(summary.DeclineReasons))
+		for reason := range summary.DeclineReasons {
+			reasons = append(reasons, string(reason))
+		}
+		sort.Strings(reasons)
+		_, _ = fmt.Fprintf(tw, "\nDecline reasons:\n")
+		for _, reason := range reasons {
+			_, _ = fmt.Fprintf(tw, "  %s\t%d\n", reason, summary.DeclineReasons[reasonCode(reason)])
+		}
+	}
+
+	if len(summary.TopDeclinedCustomers) > 0 {
+		_, _ = fmt.Fprintf(tw, "\nTop declined customers:\n")
+		for _, customer := range summary.TopDeclinedCustomers {
+			_, _ = fmt.Fprintf(tw, "  %s\t%d\n", customer.CustomerID, customer.Declined)
+		}
+	}
+	return tw.Flush()
+}
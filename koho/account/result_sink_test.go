@@ -0,0 +1,166 @@
+package account
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "koho-result-sink-test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	inputFile := filepath.Join(dir, "input.txt")
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$4000.00","time":"2000-01-01T00:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$2000.00","time":"2000-01-01T00:01:00Z"}`,
+		`{"id":"3","customer_id":"2","type":"withdrawal","load_amount":"$1.00","time":"2000-01-01T00:02:00Z"}`,
+		`{"id":"4","customer_id":"1","load_amount":"$1000.00","time":"2000-01-01T00:03:00Z"}`,
+		`{"id":"5","customer_id":"1","load_amount":"$1.00","time":"2000-01-01T00:04:00Z"}`,
+	}
+	if !assert.NoError(t, ioutil.WriteFile(inputFile, []byte(strings.Join(input, "\n")), 0644)) {
+		t.FailNow()
+	}
+
+	testCases := []struct {
+		caseName   string
+		outputFile string
+		options    []ManagerOption
+		outputs    map[string][]string // The lines of each output file.
+	}{
+		{
+			caseName:   "NDJSON",
+			outputFile: "output.txt",
+			outputs: map[string][]string{
+				"output.txt": {
+					`{"id":"1","customer_id":"1","accepted":true}`,
+					`{"id":"2","customer_id":"1","accepted":false}`,
+					`{"id":"3","customer_id":"2","type":"withdrawal","accepted":false}`,
+					`{"id":"4","customer_id":"1","accepted":true}`,
+					`{"id":"5","customer_id":"1","accepted":false}`,
+				},
+			},
+		},
+		{
+			caseName:   "CSV told by the extension",
+			outputFile: "output.csv",
+			outputs: map[string][]string{
+				"output.csv": {
+					"id,customer_id,type,original_id,accepted,outcome",
+					"1,1,,,true,",
+					"2,1,,,false,",
+					"3,2,withdrawal,,false,",
+					"4,1,,,true,",
+					"5,1,,,false,",
+				},
+			},
+		},
+		{
+			caseName:   "CSV in the detailed format",
+			outputFile: "output.txt",
+			options:    []ManagerOption{WithResultEncoding(ResultEncodingCSV), WithOutputFormat(OutputFormatDetailed)},
+			outputs: map[string][]string{
+				"output.txt": {
+					"id,customer_id,type,original_id,accepted,outcome,reason_code,message,balance",
+					"1,1,,,true,,,,$4000.00",
+					`2,1,,,false,,DAILY_AMOUNT,"exceeds maximum daily load funds ($5,000) on date 2000-1-1",$4000.00`,
+					"3,2,withdrawal,,false,,INSUFFICIENT_FUNDS,insufficient funds ($0.00) in customer:2,$0.00",
+					"4,1,,,true,,,,$5000.00",
+					`5,1,,,false,,DAILY_AMOUNT,"exceeds maximum daily load funds ($5,000) on date 2000-1-1",$5000.00`,
+				},
+			},
+		},
+		{
+			caseName:   "Accepted and declined results in separate files",
+			outputFile: "output.txt",
+			options:    []ManagerOption{WithSplitOutput(true)},
+			outputs: map[string][]string{
+				"output.accepted.txt": {
+					`{"id":"1","customer_id":"1","accepted":true}`,
+					`{"id":"4","customer_id":"1","accepted":true}`,
+				},
+				"output.declined.txt": {
+					`{"id":"2","customer_id":"1","accepted":false}`,
+					`{"id":"3","customer_id":"2","type":"withdrawal","accepted":false}`,
+					`{"id":"5","customer_id":"1","accepted":false}`,
+				},
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		caseDir := filepath.Join(dir, strings.Replace(c.caseName, " ", "-", -1))
+		if !assert.NoError(t, os.Mkdir(caseDir, 0755), c.caseName) {
+			continue
+		}
+		options := append([]ManagerOption{WithWorkers(2)}, c.options...)
+		err := NewManager(options...).ProcessLoadTransactions(context.Background(), inputFile,
+			filepath.Join(caseDir, c.outputFile))
+		if !assert.NoError(t, err, c.caseName) {
+			continue
+		}
+
+		outputs := make(map[string][]string)
+		files, err := ioutil.ReadDir(caseDir)
+		assert.NoError(t, err, c.caseName)
+		for _, file := range files {
+			content, err := ioutil.ReadFile(filepath.Join(caseDir, file.Name()))
+			assert.NoError(t, err, c.caseName)
+			outputs[file.Name()] = strings.Split(strings.TrimSpace(string(content)), "\n")
+		}
+		assert.Equal(t, c.outputs, outputs, c.caseName)
+	}
+}
+
+func TestResultSummary(t *testing.T) {
+	results := []*loadTransactionResult{
+		{ID: "1", CustomerID: "1", Accepted: true},
+		{ID: "2", CustomerID: "1", Error: newDeclineError(reasonDailyAmount, "")},
+		{ID: "3", CustomerID: "2", Error: newDeclineError(reasonInsufficientFunds, "")},
+		{ID: "4", CustomerID: "2", Error: newDeclineError(reasonDailyAmount, "")},
+		{ID: "5", CustomerID: "3", Error: newDeclineError(reasonDailyCount, "")},
+		{ID: "6", CustomerID: "1", Error: newDeclineError(reasonDailyAmount, "")},
+	}
+	summarize := func(format SummaryFormat) string {
+		var b bytes.Buffer
+		sink := newSummaryResultSink(&b, format)
+		for _, result := range results {
+			assert.NoError(t, sink.write(result))
+		}
+		assert.NoError(t, sink.close())
+		return b.String()
+	}
+
+	assert.Equal(t, strings.Join([]string{
+		"Transactions:  6",
+		"Accepted:      1",
+		"Declined:      5",
+		"",
+		"Decline reasons:",
+		"  DAILY_AMOUNT        3",
+		"  DAILY_COUNT         1",
+		"  INSUFFICIENT_FUNDS  1",
+		"",
+		"Top declined customers:",
+		"  1  2",
+		"  2  2",
+		"  3  1",
+		"",
+	}, "\n"), summarize(SummaryText))
+
+	assert.Equal(t, `{"total":6,"accepted":1,"declined":5,`+
+		`"decline_reasons":{"DAILY_AMOUNT":3,"DAILY_COUNT":1,"INSUFFICIENT_FUNDS":1},`+
+		`"top_declined_customers":[{"customer_id":"1","declined":2},{"customer_id":"2","declined":2},`+
+		`{"customer_id":"3","declined":1}]}`+"\n", summarize(SummaryJSON))
+}
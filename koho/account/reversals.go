@@ -0,0 +1,57 @@
+package account
+
+import "time"
+
+// resolveReversal - find the transaction rolled back by the given reversal among the customer's transactions.
+// A reversal can only roll back an accepted load, withdrawal or transfer of the same customer, only once, and only
+// within the given window after it. The caller must hold the lock of the account.
+func (a *customerAccount) resolveReversal(t *loadTransaction, window time.Duration) error {
+	original := a.Transactions[t.OriginalID]
+	if original != nil && original.Time != nil && t.Time.Sub(*original.Time) > window {
+		return newDeclineError(reasonUnknownOriginal, "transaction %s is too old to reverse: it was processed at %s",
+			t.OriginalID.String(), original.Time.Format(time.RFC3339))
+	}
+	if original == nil || !original.Accepted || original.Type == "" {
+		return newDeclineError(reasonUnknownOriginal, "no accepted transaction %s to reverse", t.OriginalID.String())
+	}
+	if original.Reversed {
+		return newDeclineError(reasonAlreadyReversed, "transaction %s has already been reversed", t.OriginalID.String())
+	}
+	t.original = original
+	t.loadAmount = original.Amount
+	return nil
+}
+
+// revert - roll back the given accepted transaction of the customer. Its amount and count are taken out of
+// the calendar periods it was counted in, even if they are in the past, as well as out of the history for
+// rolling windows.
+func (a *customerAccount) revert(original *transactionRecord) {
+	counters := a.counters(original.Type)
+	for _, period := range calendarPeriods {
+		key := original.periodKey(period)
+		if counters.loadedTime(period)[key] == 0 {
+			// The period was not counted when the transaction was accepted.
+			continue
+		}
+		counters.loadedFunds(period)[key] -= original.Amount
+		counters.loadedTime(period)[key] -= 1
+	}
+	counters.removeHistory(*original.Time, original.Amount)
+	original.Reversed = true
+}
+
+// reversalLedgerEntry - return the entry that moves the funds of the reversed transaction back, i.e. the entry of
+// the transaction with its debits and credits swapped.
+func (t *loadTransaction) reversalLedgerEntry() *ledgerEntry {
+	original := &loadTransaction{
+		CustomerID:  t.CustomerID,
+		Type:        t.original.Type,
+		RecipientID: t.original.RecipientID,
+		loadAmount:  t.original.Amount,
+	}
+	entry := original.ledgerEntry()
+	for i, p := range entry.postings {
+		entry.postings[i] = posting{account: p.account, debit: p.credit, credit: p.debit}
+	}
+	return entry
+}
@@ -0,0 +1,92 @@
+package account
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessReversals(t *testing.T) {
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$5000.00","time":"2000-01-03T01:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$0.01","time":"2000-01-03T02:00:00Z"}`,
+		`{"id":"3","customer_id":"1","type":"reversal","original_id":"1","time":"2000-01-10T01:00:00Z"}`,
+		`{"id":"4","customer_id":"1","load_amount":"$5000.00","time":"2000-01-03T03:00:00Z"}`,
+		`{"id":"5","customer_id":"1","type":"reversal","original_id":"1","time":"2000-01-10T02:00:00Z"}`,
+		`{"id":"6","customer_id":"1","type":"reversal","original_id":"2","time":"2000-01-10T03:00:00Z"}`,
+		`{"id":"7","customer_id":"1","type":"reversal","original_id":"3","time":"2000-01-10T04:00:00Z"}`,
+		`{"id":"8","customer_id":"2","type":"reversal","original_id":"4","time":"2000-01-10T05:00:00Z"}`,
+		`{"id":"9","customer_id":"1","type":"withdrawal","load_amount":"$5000.00","time":"2000-01-10T06:00:00Z"}`,
+		`{"id":"10","customer_id":"1","type":"reversal","original_id":"4","time":"2000-01-10T07:00:00Z"}`,
+	}
+	output := runManager(t, NewManager(WithOutputFormat(OutputFormatDetailed), WithWorkers(1)), input)
+	assert.Equal(t, []string{
+		`{"id":"1","customer_id":"1","accepted":true,"headroom":` +
+			`{"daily_amount":"$0.00","weekly_amount":"$15000.00","daily_count":2},"balance":"$5000.00"}`,
+		`{"id":"2","customer_id":"1","accepted":false,"reason_code":"DAILY_AMOUNT",` +
+			`"message":"exceeds maximum daily load funds ($5,000) on date 2000-1-3","headroom":` +
+			`{"daily_amount":"$0.00","weekly_amount":"$15000.00","daily_count":2},"balance":"$5000.00"}`,
+		`{"id":"3","customer_id":"1","type":"reversal","original_id":"1","accepted":true,"balance":"$0.00"}`,
+		`{"id":"4","customer_id":"1","accepted":true,"headroom":` +
+			`{"daily_amount":"$0.00","weekly_amount":"$15000.00","daily_count":2},"balance":"$5000.00"}`,
+		`{"id":"5","customer_id":"1","type":"reversal","original_id":"1","accepted":false,` +
+			`"reason_code":"ALREADY_REVERSED","message":"transaction 1 has already been reversed","balance":"$5000.00"}`,
+		`{"id":"6","customer_id":"1","type":"reversal","original_id":"2","accepted":false,` +
+			`"reason_code":"UNKNOWN_ORIGINAL","message":"no accepted transaction 2 to reverse","balance":"$5000.00"}`,
+		`{"id":"7","customer_id":"1","type":"reversal","original_id":"3","accepted":false,` +
+			`"reason_code":"UNKNOWN_ORIGINAL","message":"no accepted transaction 3 to reverse","balance":"$5000.00"}`,
+		`{"id":"8","customer_id":"2","type":"reversal","original_id":"4","accepted":false,` +
+			`"reason_code":"UNKNOWN_ORIGINAL","message":"no accepted transaction 4 to reverse","balance":"$0.00"}`,
+		`{"id":"9","customer_id":"1","type":"withdrawal","accepted":true,"balance":"$0.00"}`,
+		`{"id":"10","customer_id":"1","type":"reversal","original_id":"4","accepted":true,"balance":"-$5000.00"}`,
+	}, output)
+}
+
+func TestFileAccountStoreReplaysReversals(t *testing.T) {
+	dir := newTestStoreDir(t)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	input := []string{
+		`{"id":"1","customer_id":"1","type":"transfer","recipient_id":"2","load_amount":"$10.00",` +
+			`"time":"2000-01-03T01:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$30.00","time":"2000-01-03T00:00:00Z"}`,
+		`{"id":"3","customer_id":"1","type":"transfer","recipient_id":"2","load_amount":"$10.00",` +
+			`"time":"2000-01-03T02:00:00Z"}`,
+		`{"id":"4","customer_id":"1","type":"reversal","original_id":"3","time":"2000-01-04T00:00:00Z"}`,
+	}
+	store := openTestStore(t, dir, 0)
+	output := runManager(t, NewManager(WithAccountStore(store)), input)
+	assert.Equal(t, []string{
+		`{"id":"1","customer_id":"1","type":"transfer","accepted":false}`,
+		`{"id":"2","customer_id":"1","accepted":true}`,
+		`{"id":"3","customer_id":"1","type":"transfer","accepted":true}`,
+		`{"id":"4","customer_id":"1","type":"reversal","original_id":"3","accepted":true}`,
+	}, output)
+
+	// Crash without closing the store, so that the reversal is replayed from the log.
+	store = openTestStore(t, dir, 0)
+	day := dateFromTime(time.Date(2000, 1, 3, 0, 0, 0, 0, time.UTC))
+	transfers := store.get("1").Transfers
+	if assert.NotNil(t, transfers) {
+		assert.Equal(t, money(0), transfers.DailyLoadedFunds[day])
+		assert.Equal(t, uint(0), transfers.DailyLoadedTime[day])
+		assert.Empty(t, transfers.History)
+	}
+	assert.True(t, store.get("1").Transactions["3"].Reversed)
+	assert.Equal(t, money(3000), store.ledger().balance("1"))
+	assert.Equal(t, money(0), store.ledger().balance("2"))
+	commitTestTransactions(t, store, newTestTransaction(t, "5", "2", "$1.00", time.Date(2000, 1, 4, 0, 0, 0, 0,
+		time.UTC)))
+	assert.NoError(t, store.Close())
+
+	// The reversal is restored from the snapshot.
+	store = openTestStore(t, dir, 0)
+	assert.True(t, store.get("1").Transactions["3"].Reversed)
+	assert.Equal(t, money(3000), store.ledger().balance("1"))
+	assert.Equal(t, money(100), store.ledger().balance("2"))
+	assert.NoError(t, store.Close())
+}
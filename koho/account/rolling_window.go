@@ -0,0 +1,175 @@
+package account
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultHistoryRetention - the minimum period that an account keeps its history of transactions for.
+const defaultHistoryRetention = 7 * 24 * time.Hour
+
+// loadRecord - an accepted transaction in a customer's history of a type of transactions.
+type loadRecord struct {
+	Time   time.Time
+	Amount money
+}
+
+// addHistory - insert the given accepted transaction into the history, which is ordered by time.
+func (a *activityCounters) addHistory(t *loadTransaction) {
+	i := sort.Search(len(a.History), func(i int) bool {
+		return a.History[i].Time.After(t.Time)
+	})
+	a.History = append(a.History, loadRecord{})
+	copy(a.History[i+1:], a.History[i:])
+	a.History[i] = loadRecord{Time: t.Time, Amount: t.loadAmount}
+}
+
+// pruneHistory - remove the transactions before the given time from the history.
+func (a *activityCounters) pruneHistory(before time.Time) {
+	i := sort.Search(len(a.History), func(i int) bool {
+		return !a.History[i].Time.Before(before)
+	})
+	if i > 0 {
+		a.History = append(a.History[:0:0], a.History[i:]...)
+	}
+}
+
+// removeHistory - remove a transaction with the given time and amount from the history, if it has not been pruned.
+func (a *activityCounters) removeHistory(at time.Time, amount money) {
+	i := sort.Search(len(a.History), func(i int) bool {
+		return !a.History[i].Time.Before(at)
+	})
+	for ; i < len(a.History) && a.History[i].Time.Equal(at); i++ {
+		if a.History[i].Amount == amount {
+			a.History = append(a.History[:i], a.History[i+1:]...)
+			return
+		}
+	}
+}
+
+// maxWindowTotals - return the maximum funds and the maximum number of transactions among all the windows of
+// the given length that contain the given transaction, including the transaction itself.
+// A window [start, start+window) containing the transaction has the highest totals when it starts at the time of
+// a transaction in the history or the given transaction, so only these windows need to be checked. They are checked
+// from the earliest, sliding the window over the history, which is ordered by time, in a single pass.
+func (a *activityCounters) maxWindowTotals(t *loadTransaction, window time.Duration) (money, uint) {
+	from := sort.Search(len(a.History), func(i int) bool {
+		return a.History[i].Time.After(t.Time.Add(-window))
+	})
+	to := sort.Search(len(a.History), func(i int) bool {
+		return !a.History[i].Time.Before(t.Time.Add(window))
+	})
+	records := a.History[from:to]
+
+	// The totals of records[first:last], which are the records in the window being checked.
+	maxFunds, maxTimes := money(0), uint(0)
+	funds, times := money(0), uint(0)
+	first, last := 0, 0
+	checkWindow := func(start time.Time) {
+		for ; last < len(records) && records[last].Time.Before(start.Add(window)); last++ {
+			funds += records[last].Amount
+			times++
+		}
+		for ; first < last && records[first].Time.Before(start); first++ {
+			funds -= records[first].Amount
+			times--
+		}
+		if funds+t.loadAmount > maxFunds {
+			maxFunds = funds + t.loadAmount
+		}
+		if times+1 > maxTimes {
+			maxTimes = times + 1
+		}
+	}
+	for _, record := range records {
+		if record.Time.After(t.Time) {
+			break
+		}
+		checkWindow(record.Time)
+	}
+	checkWindow(t.Time)
+	return maxFunds, maxTimes
+}
+
+// rollingFundsChecker - check whether given transaction hit the load fund limit of any rolling window.
+type rollingFundsChecker struct {
+	window   time.Duration
+	maxFunds money
+	message  string
+}
+
+func newRollingFundsChecker(window time.Duration, maxFunds money, message string) *rollingFundsChecker {
+	return &rollingFundsChecker{window: window, maxFunds: maxFunds, message: message}
+}
+
+func (c *rollingFundsChecker) check(a *customerAccount, t *loadTransaction) error {
+	if funds, _ := a.counters(t.Type).maxWindowTotals(t, c.window); funds > c.maxFunds {
+		return newDeclineError(reasonRollingAmount, "%s around %s", c.message, t.Time.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// rollingLoadTimeChecker - check whether given transaction hit the load time limit of any rolling window.
+type rollingLoadTimeChecker struct {
+	window   time.Duration
+	maxTimes uint
+	message  string
+}
+
+func newRollingLoadTimeChecker(window time.Duration, maxTimes uint, message string) *rollingLoadTimeChecker {
+	return &rollingLoadTimeChecker{window: window, maxTimes: maxTimes, message: message}
+}
+
+func (c *rollingLoadTimeChecker) check(a *customerAccount, t *loadTransaction) error {
+	if _, times := a.counters(t.Type).maxWindowTotals(t, c.window); times > c.maxTimes {
+		return newDeclineError(reasonRollingCount, "%s around %s", c.message, t.Time.Format(time.RFC3339))
+	}
+	return nil
+}
+
+/****************************************************************************************/
+
+// window - the length of a rolling window in rules files, e.g. `24h`, `90m` or `7d`.
+type window time.Duration
+
+// UnmarshalYAML - decode a window from a Go duration string, or a number of days such as `7d`.
+func (w *window) UnmarshalYAML(value *yaml.Node) error {
+	d, err := parseWindow(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid window %q: %s", value.Line, value.Value, err.Error())
+	}
+	*w = window(d)
+	return nil
+}
+
+// parseWindow - parse a Go duration string, or a number of days such as `7d`.
+func parseWindow(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid number of days")
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// formatWindow - format the given window for messages, e.g. "24h" or "7d".
+func formatWindow(window time.Duration) string {
+	if window%(24*time.Hour) == 0 && window >= 48*time.Hour {
+		return fmt.Sprintf("%dd", window/(24*time.Hour))
+	}
+	s := window.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
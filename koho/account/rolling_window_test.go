@@ -0,0 +1,142 @@
+package account
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollingFundsChecker(t *testing.T) {
+	history := []loadRecord{
+		{Time: time.Date(2000, 1, 1, 23, 59, 0, 0, time.UTC), Amount: 500000},
+		{Time: time.Date(2000, 1, 3, 12, 0, 0, 0, time.UTC), Amount: 300000},
+	}
+	testCases := []struct {
+		caseName    string
+		transaction *loadTransaction
+		err         error
+	}{
+		{
+			caseName:    "A load right after midnight is in the same 24 hours as the load before midnight",
+			transaction: &loadTransaction{Time: time.Date(2000, 1, 2, 0, 1, 0, 0, time.UTC), loadAmount: 1},
+			err:         newDeclineError(reasonRollingAmount, "exceeds maximum load funds ($5000.00) in any 24h around 2000-01-02T00:01:00Z"),
+		},
+		{
+			caseName:    "A load 24 hours after another load is in a new window",
+			transaction: &loadTransaction{Time: time.Date(2000, 1, 2, 23, 59, 0, 0, time.UTC), loadAmount: 100000},
+		},
+		{
+			caseName:    "A load before a later load is in the same window as the later load",
+			transaction: &loadTransaction{Time: time.Date(2000, 1, 3, 0, 0, 0, 0, time.UTC), loadAmount: 200001},
+			err:         newDeclineError(reasonRollingAmount, "exceeds maximum load funds ($5000.00) in any 24h around 2000-01-03T00:00:00Z"),
+		},
+		{
+			caseName:    "A load that reaches the limit exactly",
+			transaction: &loadTransaction{Time: time.Date(2000, 1, 3, 0, 0, 0, 0, time.UTC), loadAmount: 200000},
+		},
+	}
+
+	checker := newRollingFundsChecker(24*time.Hour, 500000, "exceeds maximum load funds ($5000.00) in any 24h")
+	for _, c := range testCases {
+		err := checker.check(&customerAccount{activityCounters: activityCounters{History: history}}, c.transaction)
+		assert.Equal(t, c.err, err, c.caseName)
+	}
+}
+
+func TestMaxWindowTotals(t *testing.T) {
+	// The totals of the windows slid over the history are the ones of every window counted on its own.
+	naiveTotals := func(history []loadRecord, transaction *loadTransaction, window time.Duration) (money, uint) {
+		maxFunds, maxTimes := money(0), uint(0)
+		for _, start := range append([]loadRecord{{Time: transaction.Time}}, history...) {
+			if start.Time.After(transaction.Time) || !start.Time.After(transaction.Time.Add(-window)) {
+				continue
+			}
+			funds, times := transaction.loadAmount, uint(1)
+			for _, record := range history {
+				if !record.Time.Before(start.Time) && record.Time.Before(start.Time.Add(window)) {
+					funds += record.Amount
+					times++
+				}
+			}
+			if funds > maxFunds {
+				maxFunds = funds
+			}
+			if times > maxTimes {
+				maxTimes = times
+			}
+		}
+		return maxFunds, maxTimes
+	}
+
+	random := rand.New(rand.NewSource(1))
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		a := newCustomerAccount("1")
+		for j := random.Intn(50); j > 0; j-- {
+			// Some loads are at the same time, so that windows start and end at several loads at once.
+			a.addHistory(&loadTransaction{Time: start.Add(time.Duration(random.Intn(100)) * time.Hour),
+				loadAmount: money(random.Intn(100000))})
+		}
+		transaction := &loadTransaction{Time: start.Add(time.Duration(random.Intn(100)) * time.Hour),
+			loadAmount: money(random.Intn(100000))}
+		window := time.Duration(1+random.Intn(48)) * time.Hour
+
+		funds, times := a.maxWindowTotals(transaction, window)
+		expectedFunds, expectedTimes := naiveTotals(a.History, transaction, window)
+		assert.Equal(t, expectedFunds, funds, "case %d", i)
+		assert.Equal(t, expectedTimes, times, "case %d", i)
+	}
+}
+
+func TestRollingLoadTimeChecker(t *testing.T) {
+	a := newCustomerAccount("1")
+	checker := newRollingLoadTimeChecker(7*24*time.Hour, 2, "too many loads")
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Two loads are accepted six days apart.
+	for _, days := range []int{0, 6} {
+		transaction := &loadTransaction{Time: start.AddDate(0, 0, days), loadAmount: 100}
+		assert.NoError(t, checker.check(a, transaction))
+		a.apply(transaction, calendarPeriods)
+	}
+
+	// A third load within 7 days of both of them is declined, while a load 7 days after the first one is not.
+	err := checker.check(a, &loadTransaction{Time: start.AddDate(0, 0, 3), loadAmount: 100})
+	assert.Equal(t, newDeclineError(reasonRollingCount, "too many loads around 2000-01-04T00:00:00Z"), err)
+	assert.NoError(t, checker.check(a, &loadTransaction{Time: start.AddDate(0, 0, 7), loadAmount: 100}))
+
+	// Pruning forgets the first load.
+	a.counters(transactionTypeLoad).pruneHistory(start.AddDate(0, 0, 1))
+	assert.Equal(t, []loadRecord{{Time: start.AddDate(0, 0, 6), Amount: 100}}, a.History)
+}
+
+func TestRollingAndCalendarRules(t *testing.T) {
+	rules, err := parseRules([]byte(`
+rules:
+  - kind: amount
+    period: day
+    amount: 5000
+  - kind: amount
+    period: rolling
+    window: 24h
+    amount: 5000
+`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	output := runManager(t, NewManager(WithRules(rules)), []string{
+		`{"id":"1","customer_id":"1","load_amount":"$5000.00","time":"2000-01-01T23:59:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$5000.00","time":"2000-01-02T00:01:00Z"}`,
+		`{"id":"3","customer_id":"1","load_amount":"$5000.00","time":"2000-01-03T00:00:00Z"}`,
+		`{"id":"4","customer_id":"1","load_amount":"$0.01","time":"2000-01-03T00:01:00Z"}`,
+	})
+	assert.Equal(t, []string{
+		`{"id":"1","customer_id":"1","accepted":true}`,
+		`{"id":"2","customer_id":"1","accepted":false}`,
+		`{"id":"3","customer_id":"1","accepted":true}`,
+		`{"id":"4","customer_id":"1","accepted":false}`,
+	}, output)
+}
@@ -0,0 +1,407 @@
+package account
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rules - a set of velocity limit rules that every transaction is checked against.
+// Each type of transactions has its own rules.
+type Rules struct {
+	transactionCheckers map[transactionType][]transactionChecker
+	checkerNames        map[transactionType][]string // The names of the rules of the checkers, in the same order.
+	names               []string                     // The names of all the rules, in the order of the rules file.
+	historyRetention    time.Duration                // How long accounts keep their load history for rolling-window rules.
+	maxBalance          *balanceLimit                // The maximum balance of every customer's wallet, if there is one.
+
+	// The calendar periods that the rules of each type limit, which the accepted transactions are counted in.
+	periods map[transactionType][]rulePeriod
+}
+
+// ruleKind - what a rule limits: the loaded amount, the number of loads, the balance of a wallet, bursts of loads,
+// or whatever a rule expression describes.
+type ruleKind string
+
+const (
+	ruleKindAmount     ruleKind = "amount"
+	ruleKindCount      ruleKind = "count"
+	ruleKindBalance    ruleKind = "balance"
+	ruleKindBurst      ruleKind = "burst"
+	ruleKindExpression ruleKind = "expression"
+)
+
+// rulePeriod - the period a rule limit applies to: a calendar period, or a rolling window of a given length.
+// Weeks are ISO weeks, which start on Monday.
+type rulePeriod string
+
+const (
+	rulePeriodDay     rulePeriod = "day"
+	rulePeriodWeek    rulePeriod = "week"
+	rulePeriodMonth   rulePeriod = "month"
+	rulePeriodQuarter rulePeriod = "quarter"
+	rulePeriodYear    rulePeriod = "year"
+	rulePeriodRolling rulePeriod = "rolling"
+)
+
+// rulesConfig - the YAML document that describes a set of velocity limit rules.
+type rulesConfig struct {
+	Rules []ruleConfig `yaml:"rules"`
+}
+
+// ruleConfig - the YAML description of a single velocity limit rule.
+// Amount is required for `amount` rules, Count is required for `count` rules and Window is required for
+// `rolling` rules. A rule without a name is named after its position, e.g. "rule #1". A rule without a type applies
+// to loads. A `balance` rule only takes Amount and Message
+// as it applies to the wallet of every customer whatever moves funds into it. A `burst` rule takes Window, Amount
+// and/or Count, and CoolingOff, but no Period. An `expression` rule only takes Type, Expression and Message,
+// and declines the transactions that the expression is true for.
+type ruleConfig struct {
+	Name       string          `yaml:"name"`
+	Type       transactionType `yaml:"type"`
+	Kind       ruleKind        `yaml:"kind"`
+	Period     rulePeriod      `yaml:"period"`
+	Window     *window         `yaml:"window"`
+	Amount     *money          `yaml:"amount"`
+	Count      *int            `yaml:"count"`
+	CoolingOff *window         `yaml:"cooling_off"`
+	Expression string          `yaml:"expression"`
+	Message    string          `yaml:"message"`
+}
+
+// defaultRuleConfigs - the velocity limits used when no rules file is given.
+var defaultRuleConfigs = []ruleConfig{
+	{Kind: ruleKindAmount, Period: rulePeriodDay, Amount: moneyPtr(500000),
+		Message: "exceeds maximum daily load funds ($5,000)"},
+	{Kind: ruleKindAmount, Period: rulePeriodWeek, Amount: moneyPtr(2000000),
+		Message: "exceeds maximum weekly load funds ($20,000)"},
+	{Kind: ruleKindCount, Period: rulePeriodDay, Count: intPtr(3),
+		Message: "exceeds maximum daily load time (3)"},
+}
+
+// DefaultRules - return the built-in velocity limits:
+// $5,000 per day, $20,000 per week and 3 loads per day.
+func DefaultRules() *Rules {
+	rules, err := buildRules(defaultRuleConfigs)
+	if err != nil {
+		// This should never happen
+		panic(fmt.Sprintf("invalid default rules: %s", err.Error()))
+	}
+	return rules
+}
+
+// LoadRules - load velocity limit rules from the given YAML file.
+// Params:
+//	rulesFile: The YAML file that describes the rules.
+// Returns:
+//	*Rules: The rules described in the file.
+//	error: Any error that occurred during reading or validating the file.
+func LoadRules(rulesFile string) (*Rules, error) {
+	data, err := ioutil.ReadFile(rulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rules file %s: %s", rulesFile, err.Error())
+	}
+
+	rules, err := parseRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules file %s: %s", rulesFile, err.Error())
+	}
+	return rules, nil
+}
+
+// parseRules - parse and validate the given YAML rules document.
+func parseRules(data []byte) (*Rules, error) {
+	config := rulesConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&config); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("the document is empty")
+		}
+		return nil, err
+	}
+	if len(config.Rules) == 0 {
+		return nil, fmt.Errorf("at least one rule is required")
+	}
+
+	return buildRules(config.Rules)
+}
+
+// buildRules - validate the given rule configs and create a transaction checker for each of them.
+func buildRules(configs []ruleConfig) (*Rules, error) {
+	rules := &Rules{
+		transactionCheckers: make(map[transactionType][]transactionChecker, 0),
+		checkerNames:        make(map[transactionType][]string, 0),
+		historyRetention:    defaultHistoryRetention,
+		periods:             make(map[transactionType][]rulePeriod, 0),
+	}
+	for i, config := range configs {
+		name := config.Name
+		if name == "" {
+			name = fmt.Sprintf("rule #%d", i+1)
+		}
+		if containsString(rules.names, name) {
+			return nil, fmt.Errorf("rule #%d: the name %q is already used", i+1, name)
+		}
+		rules.names = append(rules.names, name)
+
+		if config.Kind == ruleKindBalance {
+			limit, err := config.balanceLimit()
+			if err != nil {
+				return nil, fmt.Errorf("rule #%d: %s", i+1, err.Error())
+			}
+			if rules.maxBalance != nil {
+				return nil, fmt.Errorf("rule #%d: at most one %q rule is allowed", i+1, ruleKindBalance)
+			}
+			limit.rule = name
+			rules.maxBalance = limit
+			continue
+		}
+
+		checker, err := config.transactionChecker()
+		if err != nil {
+			return nil, fmt.Errorf("rule #%d: %s", i+1, err.Error())
+		}
+		transactionType := config.transactionType()
+		rules.transactionCheckers[transactionType] = append(rules.transactionCheckers[transactionType], checker)
+		rules.checkerNames[transactionType] = append(rules.checkerNames[transactionType], name)
+
+		// Keep the loads in the longest rolling window.
+		if config.Window != nil && time.Duration(*config.Window) > rules.historyRetention {
+			rules.historyRetention = time.Duration(*config.Window)
+		}
+		// Count the transactions of the type in the calendar periods that the rule limits.
+		if counter, ok := checker.(periodCounter); ok {
+			rules.periods[transactionType] = mergePeriods(rules.periods[transactionType], counter.countedPeriods())
+		}
+	}
+
+	return rules, nil
+}
+
+// mergePeriods - return the calendar periods in either of the given lists, from the shortest.
+func mergePeriods(x, y []rulePeriod) []rulePeriod {
+	merged := make([]rulePeriod, 0, len(x)+len(y))
+	for _, period := range calendarPeriods {
+		if containsPeriod(x, period) || containsPeriod(y, period) {
+			merged = append(merged, period)
+		}
+	}
+	return merged
+}
+
+func containsPeriod(periods []rulePeriod, period rulePeriod) bool {
+	for _, p := range periods {
+		if p == period {
+			return true
+		}
+	}
+	return false
+}
+
+// transactionType - return the type of transactions that the rule applies to.
+func (c *ruleConfig) transactionType() transactionType {
+	if c.Type == "" {
+		return transactionTypeLoad
+	}
+	return c.Type
+}
+
+// transactionChecker - validate the rule config and create the checker it describes.
+func (c *ruleConfig) transactionChecker() (transactionChecker, error) {
+	switch c.transactionType() {
+	case transactionTypeLoad, transactionTypeWithdrawal, transactionTypeTransfer:
+	default:
+		return nil, fmt.Errorf("invalid type %q: must be one of %q, %q, %q",
+			c.Type, transactionTypeLoad, transactionTypeWithdrawal, transactionTypeTransfer)
+	}
+
+	if c.Kind == ruleKindExpression {
+		return c.expressionChecker()
+	}
+	if c.Expression != "" {
+		return nil, fmt.Errorf("'expression' is not allowed for %q rules", c.Kind)
+	}
+	if c.Kind == ruleKindBurst {
+		return c.burstChecker()
+	}
+	if c.CoolingOff != nil {
+		return nil, fmt.Errorf("'cooling_off' is not allowed for %q rules", c.Kind)
+	}
+
+	switch c.Period {
+	case rulePeriodDay, rulePeriodWeek, rulePeriodMonth, rulePeriodQuarter, rulePeriodYear:
+		if c.Window != nil {
+			return nil, fmt.Errorf("'window' is not allowed for %q rules", c.Period)
+		}
+	case rulePeriodRolling:
+		if c.Window == nil {
+			return nil, fmt.Errorf("'window' is required for %q rules", c.Period)
+		}
+		if *c.Window <= 0 {
+			return nil, fmt.Errorf("'window' must be greater than 0")
+		}
+	default:
+		return nil, fmt.Errorf("invalid period %q: must be one of %q, %q, %q, %q, %q, %q", c.Period,
+			rulePeriodDay, rulePeriodWeek, rulePeriodMonth, rulePeriodQuarter, rulePeriodYear, rulePeriodRolling)
+	}
+
+	switch c.Kind {
+	case ruleKindAmount:
+		if c.Amount == nil {
+			return nil, fmt.Errorf("'amount' is required for %q rules", c.Kind)
+		}
+		if c.Count != nil {
+			return nil, fmt.Errorf("'count' is not allowed for %q rules", c.Kind)
+		}
+		if *c.Amount <= 0 {
+			return nil, fmt.Errorf("'amount' must be greater than 0")
+		}
+		message := c.message(c.Amount.String())
+		if c.Period == rulePeriodRolling {
+			return newRollingFundsChecker(time.Duration(*c.Window), *c.Amount, message), nil
+		}
+		return newPeriodFundsChecker(c.Period, *c.Amount, message), nil
+	case ruleKindCount:
+		if c.Count == nil {
+			return nil, fmt.Errorf("'count' is required for %q rules", c.Kind)
+		}
+		if c.Amount != nil {
+			return nil, fmt.Errorf("'amount' is not allowed for %q rules", c.Kind)
+		}
+		if *c.Count <= 0 {
+			return nil, fmt.Errorf("'count' must be greater than 0")
+		}
+		message := c.message(strconv.Itoa(*c.Count))
+		if c.Period == rulePeriodRolling {
+			return newRollingLoadTimeChecker(time.Duration(*c.Window), uint(*c.Count), message), nil
+		}
+		return newPeriodLoadTimeChecker(c.Period, uint(*c.Count), message), nil
+	default:
+		return nil, fmt.Errorf("invalid kind %q: must be one of %q, %q, %q, %q, %q",
+			c.Kind, ruleKindAmount, ruleKindCount, ruleKindBalance, ruleKindBurst, ruleKindExpression)
+	}
+}
+
+// balanceLimit - validate the `balance` rule config and create the balance limit it describes.
+func (c *ruleConfig) balanceLimit() (*balanceLimit, error) {
+	switch {
+	case c.Type != "":
+		return nil, fmt.Errorf("'type' is not allowed for %q rules", c.Kind)
+	case c.Period != "":
+		return nil, fmt.Errorf("'period' is not allowed for %q rules", c.Kind)
+	case c.Window != nil:
+		return nil, fmt.Errorf("'window' is not allowed for %q rules", c.Kind)
+	case c.Count != nil:
+		return nil, fmt.Errorf("'count' is not allowed for %q rules", c.Kind)
+	case c.CoolingOff != nil:
+		return nil, fmt.Errorf("'cooling_off' is not allowed for %q rules", c.Kind)
+	case c.Expression != "":
+		return nil, fmt.Errorf("'expression' is not allowed for %q rules", c.Kind)
+	case c.Amount == nil:
+		return nil, fmt.Errorf("'amount' is required for %q rules", c.Kind)
+	case *c.Amount <= 0:
+		return nil, fmt.Errorf("'amount' must be greater than 0")
+	}
+
+	message := c.Message
+	if message == "" {
+		message = fmt.Sprintf("exceeds maximum balance (%s)", c.Amount.String())
+	}
+	return &balanceLimit{maxBalance: *c.Amount, message: message}, nil
+}
+
+// expressionChecker - validate the `expression` rule config and create the checker of its expression.
+func (c *ruleConfig) expressionChecker() (transactionChecker, error) {
+	switch {
+	case c.Period != "":
+		return nil, fmt.Errorf("'period' is not allowed for %q rules", c.Kind)
+	case c.Window != nil:
+		return nil, fmt.Errorf("'window' is not allowed for %q rules", c.Kind)
+	case c.Amount != nil:
+		return nil, fmt.Errorf("'amount' is not allowed for %q rules", c.Kind)
+	case c.Count != nil:
+		return nil, fmt.Errorf("'count' is not allowed for %q rules", c.Kind)
+	case c.CoolingOff != nil:
+		return nil, fmt.Errorf("'cooling_off' is not allowed for %q rules", c.Kind)
+	case c.Expression == "":
+		return nil, fmt.Errorf("'expression' is required for %q rules", c.Kind)
+	}
+
+	checker, err := newExpressionChecker(c.Expression, c.Message)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression: %s", err.Error())
+	}
+	return checker, nil
+}
+
+// burstChecker - validate the `burst` rule config and create the checker of its bursts.
+func (c *ruleConfig) burstChecker() (transactionChecker, error) {
+	switch {
+	case c.Period != "":
+		return nil, fmt.Errorf("'period' is not allowed for %q rules", c.Kind)
+	case c.Window == nil:
+		return nil, fmt.Errorf("'window' is required for %q rules", c.Kind)
+	case *c.Window <= 0:
+		return nil, fmt.Errorf("'window' must be greater than 0")
+	case c.Amount == nil && c.Count == nil:
+		return nil, fmt.Errorf("'amount' or 'count' is required for %q rules", c.Kind)
+	case c.Amount != nil && *c.Amount <= 0:
+		return nil, fmt.Errorf("'amount' must be greater than 0")
+	case c.Count != nil && *c.Count <= 0:
+		return nil, fmt.Errorf("'count' must be greater than 0")
+	case c.CoolingOff != nil && *c.CoolingOff <= 0:
+		return nil, fmt.Errorf("'cooling_off' must be greater than 0")
+	}
+
+	maxFunds, maxTimes, coolingOff := money(0), uint(0), time.Duration(0)
+	limits := make([]string, 0, 2)
+	if c.Count != nil {
+		maxTimes = uint(*c.Count)
+		limits = append(limits, fmt.Sprintf("%d %ss", *c.Count, c.transactionType()))
+	}
+	if c.Amount != nil {
+		maxFunds = *c.Amount
+		limits = append(limits, c.Amount.String())
+	}
+	if c.CoolingOff != nil {
+		coolingOff = time.Duration(*c.CoolingOff)
+	}
+	return newBurstChecker(time.Duration(*c.Window), maxFunds, maxTimes, coolingOff,
+		c.message(strings.Join(limits, " or "))), nil
+}
+
+// message - return the message of the rule, or a default message that describes the rule's limit.
+func (c *ruleConfig) message(limit string) string {
+	if c.Message != "" {
+		return c.Message
+	}
+
+	if c.Kind == ruleKindBurst {
+		return fmt.Sprintf("exceeds maximum %s burst (%s) in any %s",
+			c.transactionType(), limit, formatWindow(time.Duration(*c.Window)))
+	}
+	limited := "funds"
+	if c.Kind == ruleKindCount {
+		limited = "time"
+	}
+	if c.Period == rulePeriodRolling {
+		return fmt.Sprintf("exceeds maximum %s %s (%s) in any %s",
+			c.transactionType(), limited, limit, formatWindow(time.Duration(*c.Window)))
+	}
+	return fmt.Sprintf("exceeds maximum %s %s %s (%s)", periodAdjectives[c.Period], c.transactionType(), limited, limit)
+}
+
+func moneyPtr(v money) *money {
+	return &v
+}
+
+func intPtr(v int) *int {
+	return &v
+}
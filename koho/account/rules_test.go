@@ -0,0 +1,326 @@
+package account
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRules(t *testing.T) {
+	testCases := []struct {
+		caseName string
+		document string
+		checkers []transactionChecker
+		err      error
+	}{
+		{
+			caseName: "All kinds and periods of rules",
+			document: `
+rules:
+  - kind: amount
+    period: day
+    amount: 1000.5
+    message: too much today
+  - kind: amount
+    period: week
+    amount: 7000
+  - kind: count
+    period: day
+    count: 2
+  - kind: count
+    period: week
+    count: 10
+    message: too many this week
+  - kind: amount
+    period: month
+    amount: 50000
+  - kind: count
+    period: quarter
+    count: 100
+  - kind: amount
+    period: year
+    amount: 200000
+  - kind: amount
+    period: rolling
+    window: 24h
+    amount: 5000
+  - kind: count
+    period: rolling
+    window: 7d
+    count: 20
+`,
+			checkers: []transactionChecker{
+				newPeriodFundsChecker(rulePeriodDay, 100050, "too much today"),
+				newPeriodFundsChecker(rulePeriodWeek, 700000, "exceeds maximum weekly load funds ($7000.00)"),
+				newPeriodLoadTimeChecker(rulePeriodDay, 2, "exceeds maximum daily load time (2)"),
+				newPeriodLoadTimeChecker(rulePeriodWeek, 10, "too many this week"),
+				newPeriodFundsChecker(rulePeriodMonth, 5000000, "exceeds maximum monthly load funds ($50000.00)"),
+				newPeriodLoadTimeChecker(rulePeriodQuarter, 100, "exceeds maximum quarterly load time (100)"),
+				newPeriodFundsChecker(rulePeriodYear, 20000000, "exceeds maximum yearly load funds ($200000.00)"),
+				&rollingFundsChecker{window: 24 * time.Hour, maxFunds: 500000,
+					message: "exceeds maximum load funds ($5000.00) in any 24h"},
+				&rollingLoadTimeChecker{window: 7 * 24 * time.Hour, maxTimes: 20,
+					message: "exceeds maximum load time (20) in any 7d"},
+			},
+		},
+		{
+			caseName: "Empty document",
+			document: "",
+			err:      fmt.Errorf("the document is empty"),
+		},
+		{
+			caseName: "No rules",
+			document: "rules: []",
+			err:      fmt.Errorf("at least one rule is required"),
+		},
+		{
+			caseName: "Unknown kind",
+			document: "rules: [{kind: velocity, period: day, amount: 10}]",
+			err: fmt.Errorf(`rule #1: invalid kind "velocity": ` +
+				`must be one of "amount", "count", "balance", "burst", "expression"`),
+		},
+		{
+			caseName: "Balance rule with a period",
+			document: "rules: [{kind: balance, period: day, amount: 10}]",
+			err:      fmt.Errorf(`rule #1: 'period' is not allowed for "balance" rules`),
+		},
+		{
+			caseName: "Balance rule without amount",
+			document: "rules: [{kind: balance}]",
+			err:      fmt.Errorf(`rule #1: 'amount' is required for "balance" rules`),
+		},
+		{
+			caseName: "More than one balance rule",
+			document: "rules: [{kind: balance, amount: 10}, {kind: balance, amount: 20}]",
+			err:      fmt.Errorf(`rule #2: at most one "balance" rule is allowed`),
+		},
+		{
+			caseName: "Expression rule with a period",
+			document: "rules: [{kind: expression, period: day, expression: amount > 10}]",
+			err:      fmt.Errorf(`rule #1: 'period' is not allowed for "expression" rules`),
+		},
+		{
+			caseName: "Expression rule without expression",
+			document: "rules: [{kind: expression}]",
+			err:      fmt.Errorf(`rule #1: 'expression' is required for "expression" rules`),
+		},
+		{
+			caseName: "Invalid expression",
+			document: "rules: [{kind: expression, expression: amount > }]",
+			err:      fmt.Errorf(`rule #1: invalid expression: column 9: unexpected end of expression`),
+		},
+		{
+			caseName: "Amount rule with expression",
+			document: "rules: [{kind: amount, period: day, amount: 10, expression: amount > 10}]",
+			err:      fmt.Errorf(`rule #1: 'expression' is not allowed for "amount" rules`),
+		},
+		{
+			caseName: "Name used twice",
+			document: "rules: [{name: cap, kind: count, period: day, count: 1}, {name: cap, kind: balance, amount: 10}]",
+			err:      fmt.Errorf(`rule #2: the name "cap" is already used`),
+		},
+		{
+			caseName: "Unknown type",
+			document: "rules: [{type: deposit, kind: count, period: day, count: 1}]",
+			err:      fmt.Errorf(`rule #1: invalid type "deposit": must be one of "load", "withdrawal", "transfer"`),
+		},
+		{
+			caseName: "Unknown period",
+			document: "rules: [{kind: count, period: day, count: 1}, {kind: count, period: decade, count: 1}]",
+			err: fmt.Errorf(`rule #2: invalid period "decade": ` +
+				`must be one of "day", "week", "month", "quarter", "year", "rolling"`),
+		},
+		{
+			caseName: "Rolling rule without window",
+			document: "rules: [{kind: amount, period: rolling, amount: 10}]",
+			err:      fmt.Errorf(`rule #1: 'window' is required for "rolling" rules`),
+		},
+		{
+			caseName: "Calendar rule with window",
+			document: "rules: [{kind: count, period: day, window: 24h, count: 1}]",
+			err:      fmt.Errorf(`rule #1: 'window' is not allowed for "day" rules`),
+		},
+		{
+			caseName: "Invalid window",
+			document: "rules: [{kind: count, period: rolling, window: 1.5d, count: 1}]",
+			err:      fmt.Errorf(`line 1: invalid window "1.5d": invalid number of days`),
+		},
+		{
+			caseName: "Burst rules",
+			document: `
+rules:
+  - kind: burst
+    window: 90s
+    count: 5
+    amount: 1000
+    cooling_off: 1h
+  - kind: burst
+    window: 10m
+    amount: 2000
+    message: too much at once
+`,
+			checkers: []transactionChecker{
+				newBurstChecker(90*time.Second, 100000, 5, time.Hour,
+					"exceeds maximum load burst (5 loads or $1000.00) in any 1m30s"),
+				newBurstChecker(10*time.Minute, 200000, 0, 0, "too much at once"),
+			},
+		},
+		{
+			caseName: "Burst rule with period",
+			document: "rules: [{kind: burst, period: rolling, window: 90s, count: 5}]",
+			err:      fmt.Errorf(`rule #1: 'period' is not allowed for "burst" rules`),
+		},
+		{
+			caseName: "Burst rule without window",
+			document: "rules: [{kind: burst, count: 5}]",
+			err:      fmt.Errorf(`rule #1: 'window' is required for "burst" rules`),
+		},
+		{
+			caseName: "Burst rule without limit",
+			document: "rules: [{kind: burst, window: 90s, cooling_off: 1h}]",
+			err:      fmt.Errorf(`rule #1: 'amount' or 'count' is required for "burst" rules`),
+		},
+		{
+			caseName: "Burst rule with non-positive cooling-off",
+			document: "rules: [{kind: burst, window: 90s, count: 5, cooling_off: 0s}]",
+			err:      fmt.Errorf("rule #1: 'cooling_off' must be greater than 0"),
+		},
+		{
+			caseName: "Cooling-off of a rule that is not a burst rule",
+			document: "rules: [{kind: count, period: day, count: 5, cooling_off: 1h}]",
+			err:      fmt.Errorf(`rule #1: 'cooling_off' is not allowed for "count" rules`),
+		},
+		{
+			caseName: "Non-positive window",
+			document: "rules: [{kind: count, period: rolling, window: 0d, count: 1}]",
+			err:      fmt.Errorf("rule #1: 'window' must be greater than 0"),
+		},
+		{
+			caseName: "Amount rule without amount",
+			document: "rules: [{kind: amount, period: day}]",
+			err:      fmt.Errorf(`rule #1: 'amount' is required for "amount" rules`),
+		},
+		{
+			caseName: "Amount rule with count",
+			document: "rules: [{kind: amount, period: day, amount: 10, count: 1}]",
+			err:      fmt.Errorf(`rule #1: 'count' is not allowed for "amount" rules`),
+		},
+		{
+			caseName: "Count rule with non-positive count",
+			document: "rules: [{kind: count, period: week, count: 0}]",
+			err:      fmt.Errorf("rule #1: 'count' must be greater than 0"),
+		},
+		{
+			caseName: "Amount with more than two decimals",
+			document: "rules: [{kind: amount, period: week, amount: 10.001}]",
+			err:      fmt.Errorf(`line 1: invalid amount "10.001": more than two decimals`),
+		},
+		{
+			caseName: "Negative amount",
+			document: "rules: [{kind: amount, period: week, amount: -5}]",
+			err:      fmt.Errorf(`line 1: invalid amount "-5": unexpected character '-'`),
+		},
+		{
+			caseName: "Zero amount",
+			document: "rules: [{kind: amount, period: week, amount: $0}]",
+			err:      fmt.Errorf("rule #1: 'amount' must be greater than 0"),
+		},
+	}
+
+	for _, c := range testCases {
+		rules, err := parseRules([]byte(c.document))
+		if c.err != nil {
+			assert.Equal(t, c.err, err, c.caseName)
+			continue
+		}
+		assert.NoError(t, err, c.caseName)
+		assert.Equal(t, c.checkers, rules.transactionCheckers[transactionTypeLoad], c.caseName)
+	}
+}
+
+func TestParseRulesRejectsUnknownFields(t *testing.T) {
+	_, err := parseRules([]byte("rules: [{kind: count, period: day, count: 1, limit: 3}]"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "field limit not found")
+}
+
+func TestParseRulesHistoryRetention(t *testing.T) {
+	rules, err := parseRules([]byte("rules: [{kind: count, period: day, count: 1}]"))
+	assert.NoError(t, err)
+	assert.Equal(t, defaultHistoryRetention, rules.historyRetention)
+
+	rules, err = parseRules([]byte("rules: [{kind: count, period: rolling, window: 30d, count: 1}]"))
+	assert.NoError(t, err)
+	assert.Equal(t, 30*24*time.Hour, rules.historyRetention)
+}
+
+func TestParseRulesOfDifferentTypes(t *testing.T) {
+	rules, err := parseRules([]byte(`
+rules:
+  - kind: amount
+    period: day
+    amount: 5000
+  - type: withdrawal
+    kind: amount
+    period: day
+    amount: 1000
+  - type: transfer
+    kind: count
+    period: rolling
+    window: 7d
+    count: 5
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[transactionType][]transactionChecker{
+		transactionTypeLoad: {
+			newPeriodFundsChecker(rulePeriodDay, 500000, "exceeds maximum daily load funds ($5000.00)"),
+		},
+		transactionTypeWithdrawal: {
+			newPeriodFundsChecker(rulePeriodDay, 100000, "exceeds maximum daily withdrawal funds ($1000.00)"),
+		},
+		transactionTypeTransfer: {
+			&rollingLoadTimeChecker{window: 7 * 24 * time.Hour, maxTimes: 5,
+				message: "exceeds maximum transfer time (5) in any 7d"},
+		},
+	}, rules.transactionCheckers)
+}
+
+func TestParseRulesMaxBalance(t *testing.T) {
+	rules, err := parseRules([]byte("rules: [{kind: count, period: day, count: 3}]"))
+	assert.NoError(t, err)
+	assert.Nil(t, rules.maxBalance)
+
+	rules, err = parseRules([]byte("rules: [{kind: count, period: day, count: 3}, {kind: balance, amount: 10000}]"))
+	assert.NoError(t, err)
+	assert.Equal(t, &balanceLimit{maxBalance: 1000000, message: "exceeds maximum balance ($10000.00)", rule: "rule #2"},
+		rules.maxBalance)
+	assert.Len(t, rules.transactionCheckers[transactionTypeLoad], 1)
+}
+
+func TestParseRuleNames(t *testing.T) {
+	rules, err := parseRules([]byte(`
+rules:
+  - kind: amount
+    period: day
+    amount: 5000
+  - name: withdrawal cap
+    type: withdrawal
+    kind: amount
+    period: day
+    amount: 1000
+  - kind: balance
+    amount: 10000
+  - kind: count
+    period: day
+    count: 3
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"rule #1", "withdrawal cap", "rule #3", "rule #4"}, rules.names)
+	assert.Equal(t, map[transactionType][]string{
+		transactionTypeLoad:       {"rule #1", "rule #4"},
+		transactionTypeWithdrawal: {"withdrawal cap"},
+	}, rules.checkerNames)
+	assert.Equal(t, "rule #3", rules.maxBalance.rule)
+}
@@ -0,0 +1,74 @@
+package account
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// maxLoadRequestBytes - the maximum size of a load request body.
+const maxLoadRequestBytes = 1 << 20
+
+// httpError - the JSON body of an HTTP error response.
+type httpError struct {
+	Error string `json:"error"`
+}
+
+// HTTPHandler - create an HTTP handler that accepts or declines load transactions in real-time.
+// It exposes `POST /loads`, which takes a load transaction in the same JSON format as the input file and
+// returns the transaction result in the same JSON format as the output file.
+// Requests share the manager's customer accounts, so limits apply across requests.
+// A duplicate transaction always gets a response, even if the manager drops duplicates from output files.
+// A transaction that cannot be decided, e.g. because its decision cannot be persisted, gets a 500 error instead of
+// a result, so that it can be told apart from a declined one and retried.
+func (m *ManagerDefault) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/loads", m.handleLoads)
+	return mux
+}
+
+// handleLoads - handle a `POST /loads` request.
+func (m *ManagerDefault) handleLoads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, &httpError{Error: fmt.Sprintf("method %s is not allowed", r.Method)})
+		return
+	}
+
+	transaction := &loadTransaction{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxLoadRequestBytes)).Decode(transaction); err != nil {
+		m.metrics.recordParseError()
+		writeJSON(w, http.StatusBadRequest, &httpError{Error: fmt.Sprintf("invalid load transaction: %s", err.Error())})
+		return
+	}
+	if err := transaction.transformAndValidate(m.customerLocation(transaction.CustomerID)); err != nil {
+		result := transaction.newResult()
+		result.Error = newDeclineError(reasonInvalidInput, "invalid transaction: %s", err.Error())
+		m.metrics.recordResult(result)
+		m.audit(newAuditRecord(transaction), result)
+		writeJSON(w, http.StatusBadRequest, &httpError{Error: err.Error()})
+		return
+	}
+
+	result := m.processLoadTransaction(r.Context(), transaction, m.accountStore.get(transaction.CustomerID))
+	m.metrics.recordResult(result)
+	if result.Error != nil {
+		log.Printf("error processing transaction %s for customer %s: %s",
+			result.ID.String(), result.CustomerID.String(), result.Error.Error())
+		if reasonCodeOf(result.Error) == reasonInternalError {
+			writeJSON(w, http.StatusInternalServerError, &httpError{Error: result.Error.Error()})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, m.output(result))
+}
+
+// writeJSON - write the given value as the JSON body of a response with the given status code.
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error writing HTTP response: %s", err.Error())
+	}
+}
@@ -0,0 +1,125 @@
+package account
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPHandlerLoads(t *testing.T) {
+	handler := NewManager().HTTPHandler()
+
+	testCases := []struct {
+		caseName   string
+		method     string
+		body       string
+		statusCode int
+		response   string
+	}{
+		{
+			caseName:   "Accepted load",
+			method:     http.MethodPost,
+			body:       `{"id":"1","customer_id":"1","load_amount":"$4000.00","time":"2000-01-01T00:00:00Z"}`,
+			statusCode: http.StatusOK,
+			response:   `{"id":"1","customer_id":"1","accepted":true}`,
+		},
+		{
+			caseName:   "Declined load shares the account with previous requests",
+			method:     http.MethodPost,
+			body:       `{"id":"2","customer_id":"1","load_amount":"$1000.01","time":"2000-01-01T01:00:00Z"}`,
+			statusCode: http.StatusOK,
+			response:   `{"id":"2","customer_id":"1","accepted":false}`,
+		},
+		{
+			caseName:   "Malformed JSON",
+			method:     http.MethodPost,
+			body:       `{"id":`,
+			statusCode: http.StatusBadRequest,
+			response:   `{"error":"invalid load transaction: unexpected EOF"}`,
+		},
+		{
+			caseName:   "Invalid transaction",
+			method:     http.MethodPost,
+			body:       `{"id":"3","load_amount":"$1.00","time":"2000-01-01T01:00:00Z"}`,
+			statusCode: http.StatusBadRequest,
+			response:   `{"error":"transaction's customer ID is empty"}`,
+		},
+		{
+			caseName:   "Wrong method",
+			method:     http.MethodGet,
+			statusCode: http.StatusMethodNotAllowed,
+			response:   `{"error":"method GET is not allowed"}`,
+		},
+	}
+
+	for _, c := range testCases {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(c.method, "/loads", strings.NewReader(c.body)))
+		assert.Equal(t, c.statusCode, recorder.Code, c.caseName)
+		assert.JSONEq(t, c.response, recorder.Body.String(), c.caseName)
+	}
+}
+
+func TestHTTPHandlerConcurrentLoads(t *testing.T) {
+	handler := NewManager().HTTPHandler()
+
+	// 10 concurrent loads of $1,000 on the same day: exactly 3 of them fit the daily load time limit.
+	accepted := make(chan bool, 10)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := `{"id":"` + string(rune('a'+i)) + `","customer_id":"1","load_amount":"$1000.00",` +
+				`"time":"2000-01-01T00:00:00Z"}`
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/loads", strings.NewReader(body)))
+			accepted <- strings.Contains(recorder.Body.String(), `"accepted":true`)
+		}(i)
+	}
+	wg.Wait()
+	close(accepted)
+
+	count := 0
+	for ok := range accepted {
+		if ok {
+			count++
+		}
+	}
+	assert.Equal(t, 3, count)
+}
+
+// failingAccountStore - an account store that fails to persist any decision.
+type failingAccountStore struct {
+	*memoryAccountStore
+}
+
+func (s *failingAccountStore) commit(a *customerAccount, t *loadTransaction, entry *ledgerEntry) (func() error,
+	error) {
+
+	return nil, fmt.Errorf("disk full")
+}
+
+func TestHTTPHandlerPersistenceFailure(t *testing.T) {
+	store := &failingAccountStore{memoryAccountStore: newMemoryAccountStore()}
+	handler := NewManager(WithAccountStore(store)).HTTPHandler()
+
+	// A transaction whose decision cannot be persisted is not declined, so that the client retries it.
+	body := `{"id":"1","customer_id":"1","load_amount":"$1.00","time":"2000-01-01T00:00:00Z"}`
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/loads", strings.NewReader(body)))
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.JSONEq(t, `{"error":"error persisting the decision: disk full"}`, recorder.Body.String())
+	assert.Equal(t, money(0), store.ledger().balance("1"))
+
+	// So does a transaction that would be declined, as its decision is not persisted either.
+	body = `{"id":"2","customer_id":"1","load_amount":"$5000.01","time":"2000-01-01T00:00:00Z"}`
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/loads", strings.NewReader(body)))
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+}
@@ -0,0 +1,220 @@
+package account
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// simulatedDecision - the decision made for a transaction during a simulation.
+type simulatedDecision struct {
+	id         identifier
+	customerID identifier
+	accepted   bool
+	dropped    bool
+	decliner   string // The name of the rule that declined the transaction, or its reason code if no rule did.
+}
+
+// describe - describe the decision for the report of a simulation.
+func (d *simulatedDecision) describe() string {
+	switch {
+	case d.dropped:
+		return "dropped"
+	case d.accepted:
+		return "accepted"
+	default:
+		return "declined by " + d.decliner
+	}
+}
+
+// Simulate - process the transactions in the given input file with the current rules and with the candidate rules,
+// and write a report of the decisions that the candidate rules would change to the given writer. Each run starts with
+// empty accounts kept in memory and processes transactions exactly like ProcessLoadTransactions does.
+// Rules are matched by name in the report, so rules that are kept in the candidate rules should keep their names.
+// Params:
+//	inputFile: The file that contains the transactions to simulate, e.g. the transactions of last month. It cannot be
+//		the standard input as it is read twice.
+//	current: The rules in use.
+//	candidate: The rules to compare with the current ones.
+//	w: The writer that the report is written to.
+//	opts: The options of both runs, e.g. customer profiles. The rules, account store and output format are replaced.
+// Returns:
+//	error: Any error that occurred during reading the input file or writing the report.
+func Simulate(ctx context.Context, inputFile string, current, candidate *Rules, w io.Writer,
+	opts ...ManagerOption) error {
+
+	if inputFile == StdinInput {
+		return fmt.Errorf("cannot simulate the standard input: the input is read once for each set of rules")
+	}
+	currentDecisions, err := simulate(ctx, inputFile, current, opts)
+	if err != nil {
+		return err
+	}
+	candidateDecisions, err := simulate(ctx, inputFile, candidate, opts)
+	if err != nil {
+		return err
+	}
+	if len(currentDecisions) != len(candidateDecisions) {
+		// This should never happen as both runs read the same input.
+		return fmt.Errorf("the current and candidate rules decided on %d and %d transactions",
+			len(currentDecisions), len(candidateDecisions))
+	}
+
+	return writeSimulationReport(w, current, candidate, currentDecisions, candidateDecisions)
+}
+
+// simulate - process the transactions in the given input file with the given rules and return the decisions in
+// input order.
+func simulate(ctx context.Context, inputFile string, rules *Rules, opts []ManagerOption) ([]simulatedDecision, error) {
+	opts = append(append([]ManagerOption{}, opts...), WithRules(rules), WithAccountStore(newMemoryAccountStore()),
+		WithOutputFormat(OutputFormatKOHO), WithInputOrder(true))
+	m := NewManager(opts...)
+
+	inFile, err := openInput(inputFile)
+	if err != nil {
+		return nil, fmt.Errorf("error openning file %s: %s", inputFile, err.Error())
+	}
+	defer func() {
+		_ = inFile.Close()
+	}()
+	transactions, err := m.newTransactionReader(inFile, inputFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading transactions from file %s: %s", inputFile, err.Error())
+	}
+
+	// Simulated decisions are neither measured nor audited.
+	m.metrics = nil
+	m.auditLog = nil
+	decisions := make([]simulatedDecision, 0)
+	m.resultObserver = func(result *loadTransactionResult) {
+		decision := simulatedDecision{
+			id:         result.ID,
+			customerID: result.CustomerID,
+			accepted:   result.Accepted,
+			dropped:    result.dropped,
+		}
+		if !result.Accepted {
+			if decision.decliner = ruleOf(result.Error); decision.decliner == "" {
+				decision.decliner = string(reasonCodeOf(result.Error))
+			}
+		}
+		decisions = append(decisions, decision)
+	}
+
+	// Decisions are observed rather than written.
+	sink := newNDJSONResultSink(ioutil.Discard, m.output)
+	if err := m.processLoadTransactionStream(ctx, transactions, m.newLatenessBuffer(), sink,
+		newDeadLetterWriter(nil)); err != nil {
+		return nil, fmt.Errorf("error loading transactions from file %s: %s", inputFile, err.Error())
+	}
+	return decisions, nil
+}
+
+// writeSimulationReport - write the report of a simulation: the number of decisions of each kind, the number of
+// declines of each rule, the transactions whose decisions changed and the customers affected by the changes.
+func writeSimulationReport(w io.Writer, current, candidate *Rules,
+	currentDecisions, candidateDecisions []simulatedDecision) error {
+
+	// Totals
+	type totals struct {
+		accepted, declined, dropped int
+		declines                    map[string]int
+	}
+	count := func(decisions []simulatedDecision) *totals {
+		t := &totals{declines: make(map[string]int, 0)}
+		for _, d := range decisions {
+			switch {
+			case d.dropped:
+				t.dropped++
+			case d.accepted:
+				t.accepted++
+			default:
+				t.declined++
+				t.declines[d.decliner]++
+			}
+		}
+		return t
+	}
+	currentTotals, candidateTotals := count(currentDecisions), count(candidateDecisions)
+
+	fmt.Fprintf(w, "Simulated %d transactions\n\n", len(currentDecisions))
+	rows := [][]string{
+		{"Decision", "Current", "Candidate"},
+		{"Accepted", strconv.Itoa(currentTotals.accepted), strconv.Itoa(candidateTotals.accepted)},
+		{"Declined", strconv.Itoa(currentTotals.declined), strconv.Itoa(candidateTotals.declined)},
+	}
+	if currentTotals.dropped > 0 || candidateTotals.dropped > 0 {
+		rows = append(rows, []string{"Dropped", strconv.Itoa(currentTotals.dropped), strconv.Itoa(candidateTotals.dropped)})
+	}
+	if err := writeTable(w, rows, 1); err != nil {
+		return err
+	}
+
+	// Declines per rule: the current rules, then the new candidate rules, then the other reasons.
+	decliners := append([]string{}, current.names...)
+	for _, name := range candidate.names {
+		if !containsString(decliners, name) {
+			decliners = append(decliners, name)
+		}
+	}
+	reasons := make([]string, 0)
+	for _, t := range []*totals{currentTotals, candidateTotals} {
+		for decliner := range t.declines {
+			if !containsString(decliners, decliner) && !containsString(reasons, decliner) {
+				reasons = append(reasons, decliner)
+			}
+		}
+	}
+	sort.Strings(reasons)
+	decliners = append(decliners, reasons...)
+
+	fmt.Fprintf(w, "\nDeclines per rule\n\n")
+	rows = [][]string{{"Rule", "Current", "Candidate"}}
+	for _, decliner := range decliners {
+		rows = append(rows, []string{
+			decliner, strconv.Itoa(currentTotals.declines[decliner]), strconv.Itoa(candidateTotals.declines[decliner]),
+		})
+	}
+	if err := writeTable(w, rows, 1); err != nil {
+		return err
+	}
+
+	// Changed decisions and affected customers
+	rows = [][]string{{"ID", "Customer", "Current", "Candidate"}}
+	affected := make(map[identifier]bool, 0)
+	for i := range currentDecisions {
+		currentDecision, candidateDecision := &currentDecisions[i], &candidateDecisions[i]
+		if currentDecision.accepted == candidateDecision.accepted {
+			continue
+		}
+		rows = append(rows, []string{
+			currentDecision.id.String(), currentDecision.customerID.String(),
+			currentDecision.describe(), candidateDecision.describe(),
+		})
+		affected[currentDecision.customerID] = true
+	}
+	customers := make([]string, 0, len(affected))
+	for customerID := range affected {
+		customers = append(customers, customerID.String())
+	}
+	sort.Strings(customers)
+
+	fmt.Fprintf(w, "\nChanged decisions (%d)\n", len(rows)-1)
+	if len(rows) > 1 {
+		fmt.Fprintln(w)
+		if err := writeTable(w, rows, len(rows[0])); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(w, "\nAffected customers (%d)", len(customers))
+	if len(customers) > 0 {
+		fmt.Fprintf(w, ": %s", strings.Join(customers, ", "))
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
@@ -0,0 +1,98 @@
+package account
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulate(t *testing.T) {
+	current, err := parseRules([]byte(`
+rules:
+  - kind: amount
+    period: day
+    amount: 5000
+  - name: daily count
+    kind: count
+    period: day
+    count: 3
+`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	candidate, err := parseRules([]byte(`
+rules:
+  - name: daily count
+    kind: count
+    period: day
+    count: 2
+  - name: max balance
+    kind: balance
+    amount: 5000
+`))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	dir, err := ioutil.TempDir("", "koho-simulation-test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	inputFile := filepath.Join(dir, "input.txt")
+	input := []string{
+		`{"id":"1","customer_id":"1","load_amount":"$3000.00","time":"2000-01-01T00:00:00Z"}`,
+		`{"id":"2","customer_id":"1","load_amount":"$3000.00","time":"2000-01-01T01:00:00Z"}`,
+		`{"id":"3","customer_id":"2","load_amount":"$100.00","time":"2000-01-01T00:00:00Z"}`,
+		`{"id":"4","customer_id":"2","load_amount":"$100.00","time":"2000-01-01T01:00:00Z"}`,
+		`{"id":"5","customer_id":"2","load_amount":"$100.00","time":"2000-01-01T02:00:00Z"}`,
+		`{"id":"6","customer_id":"3","load_amount":"$6000.00","time":"2000-01-01T00:00:00Z"}`,
+		`{"id":"7","customer_id":"3","type":"withdrawal","load_amount":"$10.00","time":"2000-01-01T01:00:00Z"}`,
+		`{"id":"8","customer_id":"4","load_amount":"$4000.00","time":"2000-01-01T00:00:00Z"}`,
+		`{"id":"9","customer_id":"4","type":"withdrawal","load_amount":"$3000.00","time":"2000-01-01T01:00:00Z"}`,
+		`{"id":"10","customer_id":"4","load_amount":"$2000.00","time":"2000-01-01T02:00:00Z"}`,
+	}
+	if !assert.NoError(t, ioutil.WriteFile(inputFile, []byte(strings.Join(input, "\n")), 0644)) {
+		t.FailNow()
+	}
+
+	report := &bytes.Buffer{}
+	assert.NoError(t, Simulate(context.Background(), inputFile, current, candidate, report, WithWorkers(2)))
+	assert.Equal(t, `Simulated 10 transactions
+
+Decision  Current  Candidate
+Accepted        6          6
+Declined        4          4
+
+Declines per rule
+
+Rule                Current  Candidate
+rule #1                   3          0
+daily count               0          1
+max balance               0          2
+INSUFFICIENT_FUNDS        1          1
+
+Changed decisions (2)
+
+ID  Customer  Current              Candidate
+5   2         accepted             declined by daily count
+10  4         declined by rule #1  accepted
+
+Affected customers (2): 2, 4
+`, report.String())
+
+	// Simulating the same rules changes nothing.
+	report.Reset()
+	assert.NoError(t, Simulate(context.Background(), inputFile, current, current, report))
+	assert.Contains(t, report.String(), "Changed decisions (0)\n\nAffected customers (0)\n")
+
+	assert.Error(t, Simulate(context.Background(), filepath.Join(dir, "missing.txt"), current, candidate, report))
+}
@@ -0,0 +1,82 @@
+package account
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"github.com/azhuox/code-interviews/koho/metrics"
+)
+
+// workerPool - a fixed pool of workers, each of which owns a shard of customers.
+// A customer is always hashed to the same shard and a worker processes the transactions of its shard in sequence,
+// so the transactions of a customer are processed in the order they are dispatched.
+type workerPool struct {
+	shards  []chan *loadTransaction
+	depths  []*metrics.Gauge // The gauges of the queue depths of the shards, or nil if no metrics are recorded.
+	workers *sync.WaitGroup
+}
+
+// startWorkerPool - start a pool of the manager's number of workers that write transaction results to the given channel.
+// Params:
+//	transactionResultCh: A channel buffer for saving transaction results.
+// Returns:
+//	*workerPool: The started pool, which must be stopped after all the transactions are dispatched.
+func (m *ManagerDefault) startWorkerPool(ctx context.Context,
+	transactionResultCh chan<- *loadTransactionResult) *workerPool {
+
+	pool := &workerPool{
+		shards:  make([]chan *loadTransaction, m.workers),
+		depths:  m.metrics.shardQueueDepths(m.workers),
+		workers: &sync.WaitGroup{},
+	}
+	for i := range pool.shards {
+		// A shard never blocks the dispatcher, as the number of pending transactions is bounded by `pendingSlots`.
+		pool.shards[i] = make(chan *loadTransaction, m.pendingCapacity())
+		pool.workers.Add(1)
+		var depth *metrics.Gauge
+		if pool.depths != nil {
+			depth = pool.depths[i]
+		}
+		go m.processShard(ctx, pool.shards[i], depth, transactionResultCh, pool.workers)
+	}
+	return pool
+}
+
+// dispatch - send the given transaction to the shard of its customer.
+func (p *workerPool) dispatch(t *loadTransaction) {
+	shard := shardOf(t.CustomerID, len(p.shards))
+	if p.depths != nil {
+		p.depths[shard].Inc()
+	}
+	p.shards[shard] <- t
+}
+
+// stop - wait for the workers to process all the dispatched transactions and stop them.
+func (p *workerPool) stop() {
+	for _, shard := range p.shards {
+		close(shard)
+	}
+	p.workers.Wait()
+}
+
+// shardOf - return the shard that the given customer is hashed to.
+func shardOf(customerID identifier, shards int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(customerID))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// processShard - a worker routine that processes the transactions in the given shard in sequence
+// until the shard is closed and drained. The given gauge of the queue depth of the shard is optional.
+func (m *ManagerDefault) processShard(ctx context.Context, shard <-chan *loadTransaction, depth *metrics.Gauge,
+	transactionResultCh chan<- *loadTransactionResult, workers *sync.WaitGroup) {
+
+	defer workers.Done()
+	for transaction := range shard {
+		if depth != nil {
+			depth.Dec()
+		}
+		transactionResultCh <- m.processLoadTransaction(ctx, transaction, m.accountStore.get(transaction.CustomerID))
+	}
+}
@@ -0,0 +1,23 @@
+package account
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardOf(t *testing.T) {
+	counts := make([]int, 8)
+	for i := 0; i < 8000; i++ {
+		customerID := identifier(strconv.Itoa(i))
+		shard := shardOf(customerID, len(counts))
+		assert.Equal(t, shard, shardOf(customerID, len(counts)), "a customer is always hashed to the same shard")
+		counts[shard]++
+	}
+
+	// Customers are spread across all the shards.
+	for shard, count := range counts {
+		assert.InDelta(t, 1000, count, 200, "shard %d", shard)
+	}
+}
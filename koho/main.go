@@ -4,28 +4,557 @@ import (
 	"context"
 	"flag"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/azhuox/code-interviews/koho/account"
+	"github.com/azhuox/code-interviews/koho/metrics"
 )
 
 func main() {
+	// Run the given command. Processing an input file is the default command.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			serve(os.Args[2:])
+			return
+		case "simulate":
+			simulate(os.Args[2:])
+			return
+		case "verify-audit":
+			verifyAudit(os.Args[2:])
+			return
+		}
+	}
+	if err := process(os.Args[1:]); err != nil {
+		os.Exit(exitCodeOf(err))
+	}
+}
+
+const (
+	// exitCodeInvalidRecords - the exit code when the input file has more invalid records than allowed.
+	exitCodeInvalidRecords = 2
+	// exitCodeInterrupted - the exit code when the processing is interrupted by SIGINT or SIGTERM, as a shell reports
+	// a process killed by SIGINT.
+	exitCodeInterrupted = 130
+)
+
+// exitCodeOf - return the exit code for the given error returned by a command.
+func exitCodeOf(err error) int {
+	switch err.(type) {
+	case *account.InvalidRecordsError:
+		return exitCodeInvalidRecords
+	case *account.InterruptedError:
+		return exitCodeInterrupted
+	default:
+		return 1
+	}
+}
+
+// process - process the transactions in an input file and write the results to the output file. An error is logged
+// before it is returned, once the output files are closed, so that the caller only has to exit with its code.
+func process(args []string) error {
 	// Parse args
-	inputFile := flag.String("input_file", "", "Input file")
-	flag.Parse()
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	inputFile := flags.String("input_file", "",
+		"Input file, or - for the standard input; files with the .gz extension are decompressed")
+	inputOrder := flags.Bool("input_order", true,
+		"Write results in the order of their transactions in the input file, otherwise as soon as they are ready")
+	workers := flags.Int("workers", runtime.GOMAXPROCS(0), "Number of workers that customers are sharded across")
+	trialBalance := flags.Bool("trial_balance", false,
+		"Print the trial balance of the ledger, i.e. the balance of every wallet, after processing the input file")
+	deadLetterFile := flags.String("dead_letter_file", "",
+		"File that the records of the input file that are not valid transactions are written to (optional)")
+	maxInvalidRecords := flags.Int("max_invalid_records", -1,
+		"Exit with code 2 if more records of the input file than this are not valid transactions "+
+			"(optional, no limit if negative)")
+	checkpointFile := flags.String("checkpoint_file", "./checkpoint.json",
+		"File that the position in the input file and the accounts are written to if the processing is interrupted "+
+			"by SIGINT or SIGTERM")
+	resume := flags.Bool("resume", false,
+		"Resume the processing of the input file from the checkpoint file, appending to the output files")
+	inputFlags := defineInputFlags(flags)
+	outputFlags := defineOutputFlags(flags)
+	latenessFlags := defineLatenessFlags(flags)
+	managerFlags := defineManagerFlags(flags)
+	_ = flags.Parse(args)
 	if *inputFile == "" {
 		log.Fatalln("The arg 'input_file' is required")
 	}
 
-	var accountManager account.Manager
-	accountManager = account.NewManager()
+	// The flags that are only validated come first, so that no resource is open if they are invalid. The output
+	// options are validated before the summary file is created, which comes before the account store, the audit log
+	// and the metrics listener are open.
+	latenessOptions := latenessFlags.options()
+	inputOptions := inputFlags.options()
+	outputOptions, closeSummary := outputFlags.options()
+	defer closeSummary()
+	options, closeResources := managerFlags.options()
+	defer closeResources()
+	options = append(options, outputOptions...)
+	options = append(options, account.WithInputOrder(*inputOrder), account.WithWorkers(*workers))
+	options = append(options, latenessOptions...)
+	options = append(options, inputOptions...)
+	options = append(options, account.WithDeadLetterFile(*deadLetterFile),
+		account.WithMaxInvalidRecords(*maxInvalidRecords))
+	options = append(options, account.WithCheckpointFile(*checkpointFile), account.WithResume(*resume))
+
+	accountManager := account.NewManager(options...)
 
 	log.Printf("Start processing transactions in the given input file...\n")
 
-	err := accountManager.ProcessLoadTransactions(context.Background(), *inputFile, "./output.txt")
+	// Stop reading the input file on SIGINT and SIGTERM, so that the transactions read so far are decided, their
+	// results are written and a checkpoint is written to resume from.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			log.Printf("Interrupted, stopping processing transactions...\n")
+			cancel()
+		case <-ctx.Done():
+		}
+		// Let a second signal kill the process.
+		signal.Stop(signals)
+	}()
+
+	err := accountManager.ProcessLoadTransactions(ctx, *inputFile, *outputFlags.file)
+	if interruptedErr, ok := err.(*account.InterruptedError); ok {
+		log.Printf("Stopped processing transactions in the given input file: %s\n", interruptedErr.Error())
+		log.Printf("Run again with the arg 'resume' to continue from the checkpoint file %s\n", *checkpointFile)
+		return err
+	}
+	cancel()
+	if invalidErr, ok := err.(*account.InvalidRecordsError); ok {
+		// Every result is written, but the input file is too broken to be trusted.
+		log.Printf("Processed transactions in the given input file, but %s\n", invalidErr.Error())
+		return err
+	}
 	if err != nil {
-		log.Fatalf("Error processing transactions in the given input file: %s\n", err.Error())
+		log.Printf("Error processing transactions in the given input file: %s\n", err.Error())
+		return err
 	}
 
 	log.Printf("Sucessfully process transactions in the given input file. " +
 		"Please check output file for results.\n")
+
+	if *trialBalance {
+		if err := accountManager.WriteTrialBalance(os.Stdout); err != nil {
+			log.Printf("Error printing the trial balance: %s\n", err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// serve - run an HTTP service that accepts or declines load transactions in real-time.
+func serve(args []string) {
+	// Parse args
+	flags := flag.NewFlagSet(os.Args[0]+" serve", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "Address that the HTTP service listens on")
+	managerFlags := defineManagerFlags(flags)
+	_ = flags.Parse(args)
+
+	options, closeResources := managerFlags.options()
+	defer closeResources()
+
+	accountManager := account.NewManager(options...)
+	server := &http.Server{
+		Addr:    *addr,
+		Handler: accountManager.HTTPHandler(),
+	}
+
+	// Shutdown the server gracefully on SIGINT and SIGTERM.
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down the HTTP service: %s\n", err.Error())
+		}
+		close(stopped)
+	}()
+
+	log.Printf("Start serving load transactions on %s...\n", *addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatalf("Error serving load transactions: %s\n", err.Error())
+	}
+	<-stopped
+	log.Printf("Stopped serving load transactions.\n")
+}
+
+// simulate - process the transactions in an input file with the current rules and with candidate rules, and print
+// how the decisions would change.
+func simulate(args []string) {
+	// Parse args
+	flags := flag.NewFlagSet(os.Args[0]+" simulate", flag.ExitOnError)
+	inputFile := flags.String("input_file", "",
+		"Input file, e.g. historical transactions; files with the .gz extension are decompressed")
+	candidateRulesFile := flags.String("candidate_rules_file", "",
+		"YAML file that describes the candidate velocity limit rules to compare with the current ones")
+	workers := flags.Int("workers", runtime.GOMAXPROCS(0), "Number of workers that customers are sharded across")
+	inputFlags := defineInputFlags(flags)
+	latenessFlags := defineLatenessFlags(flags)
+	managerFlags := defineManagerFlags(flags)
+	_ = flags.Parse(args)
+	if *inputFile == "" {
+		log.Fatalln("The arg 'input_file' is required")
+	}
+	if *candidateRulesFile == "" {
+		log.Fatalln("The arg 'candidate_rules_file' is required")
+	}
+	if *managerFlags.stateDir != "" {
+		log.Fatalln("The arg 'state_dir' is not supported: simulations start with empty accounts")
+	}
+	if *managerFlags.auditLog != "" {
+		log.Fatalln("The arg 'audit_log' is not supported: simulated decisions are not audited")
+	}
+	if *managerFlags.metricsAddr != "" {
+		log.Fatalln("The arg 'metrics_addr' is not supported: simulated decisions are not counted in metrics")
+	}
+
+	candidateRules, err := account.LoadRules(*candidateRulesFile)
+	if err != nil {
+		log.Fatalf("Error loading candidate rules: %s\n", err.Error())
+	}
+	options, closeResources := managerFlags.options()
+	defer closeResources()
+	options = append(options, account.WithWorkers(*workers))
+	options = append(options, latenessFlags.options()...)
+	options = append(options, inputFlags.options()...)
+
+	log.Printf("Start simulating the transactions in the given input file...\n")
+
+	err = account.Simulate(context.Background(), *inputFile, managerFlags.rules(), candidateRules, os.Stdout, options...)
+	if err != nil {
+		log.Fatalf("Error simulating the transactions in the given input file: %s\n", err.Error())
+	}
+}
+
+// verifyAudit - check that an audit log has not been modified and has no gap.
+func verifyAudit(args []string) {
+	// Parse args
+	flags := flag.NewFlagSet(os.Args[0]+" verify-audit", flag.ExitOnError)
+	auditLog := flags.String("audit_log", "", "Audit log file to verify")
+	_ = flags.Parse(args)
+	if *auditLog == "" {
+		log.Fatalln("The arg 'audit_log' is required")
+	}
+
+	summary, err := account.VerifyAuditLog(*auditLog)
+	if err != nil {
+		log.Fatalf("The audit log is not valid: %s\n", err.Error())
+	}
+	log.Printf("The audit log is valid: %d records, head hash %s\n", summary.Records, summary.Head)
+}
+
+// inputFlags - the flags for reading the transactions of an input file.
+type inputFlags struct {
+	format     *string
+	csvColumns *string
+}
+
+// defineInputFlags - define the flags for reading the transactions of an input file.
+func defineInputFlags(flags *flag.FlagSet) *inputFlags {
+	return &inputFlags{
+		format: flags.String("input_format", "",
+			"Format of the input file: ndjson or csv (optional, told by the file extension by default)"),
+		csvColumns: flags.String("csv_columns", "",
+			"CSV columns that transaction fields are read from, e.g. load_amount=amount,time=created_at "+
+				"(optional, a field is read from the column with its name by default)"),
+	}
+}
+
+// options - create the account manager options described by the flags.
+func (f *inputFlags) options() []account.ManagerOption {
+	format, err := account.ParseInputFormat(*f.format)
+	if err != nil {
+		log.Fatalf("Invalid arg 'input_format': %s\n", err.Error())
+	}
+	columns, err := account.ParseCSVColumns(*f.csvColumns)
+	if err != nil {
+		log.Fatalf("Invalid arg 'csv_columns': %s\n", err.Error())
+	}
+	return []account.ManagerOption{account.WithInputFormat(format), account.WithCSVColumns(columns)}
+}
+
+// outputFlags - the flags for writing the results of transactions.
+type outputFlags struct {
+	file        *string
+	encoding    *string
+	split       *bool
+	summary     *string
+	summaryFile *string
+}
+
+// defineOutputFlags - define the flags for writing the results of transactions.
+func defineOutputFlags(flags *flag.FlagSet) *outputFlags {
+	return &outputFlags{
+		file: flags.String("output_file", "./output.txt", "Output file that the results are written to"),
+		encoding: flags.String("output_encoding", "",
+			"Encoding of the output file: ndjson or csv (optional, told by the file extension by default)"),
+		split: flags.Bool("split_output", false,
+			"Write accepted and declined results to two files named after the output file, "+
+				"e.g. output.accepted.txt and output.declined.txt"),
+		summary: flags.String("summary", "",
+			"Write a summary of the results once they are all written: text or json (optional)"),
+		summaryFile: flags.String("summary_file", "",
+			"File that the summary is written to (optional, the summary is printed by default)"),
+	}
+}
+
+// options - create the account manager options described by the flags, and a function that closes the summary file.
+func (f *outputFlags) options() ([]account.ManagerOption, func()) {
+	encoding, err := account.ParseResultEncoding(*f.encoding)
+	if err != nil {
+		log.Fatalf("Invalid arg 'output_encoding': %s\n", err.Error())
+	}
+	options := []account.ManagerOption{account.WithResultEncoding(encoding), account.WithSplitOutput(*f.split)}
+	if *f.summary == "" {
+		if *f.summaryFile != "" {
+			log.Fatalln("The arg 'summary_file' requires the arg 'summary'")
+		}
+		return options, func() {}
+	}
+
+	format, err := account.ParseSummaryFormat(*f.summary)
+	if err != nil {
+		log.Fatalf("Invalid arg 'summary': %s\n", err.Error())
+	}
+	if *f.summaryFile == "" {
+		return append(options, account.WithSummary(os.Stdout, format)), func() {}
+	}
+	summaryFile, err := os.Create(*f.summaryFile)
+	if err != nil {
+		log.Fatalf("Error creating the summary file: %s\n", err.Error())
+	}
+	return append(options, account.WithSummary(summaryFile, format)), func() {
+		if err := summaryFile.Close(); err != nil {
+			log.Printf("Error closing the summary file: %s\n", err.Error())
+		}
+	}
+}
+
+// latenessFlags - the flags for processing the transactions of an input file in time order.
+type latenessFlags struct {
+	lateness   *time.Duration
+	latePolicy *string
+	bufferSize *int
+}
+
+// defineLatenessFlags - define the flags for processing the transactions of an input file in time order.
+func defineLatenessFlags(flags *flag.FlagSet) *latenessFlags {
+	return &latenessFlags{
+		lateness: flags.Duration("lateness", 0,
+			"How much older than the latest transaction read a transaction can be and still be processed in time order, "+
+				"e.g. 1h (optional, transactions are processed in input order by default)"),
+		latePolicy: flags.String("late_policy", string(account.LateDecline),
+			"What to do with a transaction that arrives later than the lateness allows: decline, "+
+				"or flag to process it anyway and flag its result as late"),
+		bufferSize: flags.Int("lateness_buffer", account.DefaultLatenessBufferSize,
+			"How many records a transaction can be held for before it is released regardless of the lateness"),
+	}
+}
+
+// options - create the account manager options described by the flags.
+func (f *latenessFlags) options() []account.ManagerOption {
+	policy, err := account.ParseLatePolicy(*f.latePolicy)
+	if err != nil {
+		log.Fatalf("Invalid arg 'late_policy': %s\n", err.Error())
+	}
+	if *f.lateness < 0 {
+		log.Fatalln("Invalid arg 'lateness': must not be negative")
+	}
+	if *f.bufferSize <= 0 {
+		log.Fatalln("Invalid arg 'lateness_buffer': must be positive")
+	}
+	return []account.ManagerOption{
+		account.WithLateness(*f.lateness, policy),
+		account.WithLatenessBufferSize(*f.bufferSize),
+	}
+}
+
+// managerFlags - the flags shared by the commands that run an account manager.
+type managerFlags struct {
+	rulesFile          *string
+	customersFile      *string
+	timeZone           *string
+	stateDir           *string
+	snapshotInterval   *int
+	onDuplicate        *string
+	onConflict         *string
+	duplicateRetention *time.Duration
+	reversalWindow     *time.Duration
+	outputFormat       *string
+	metricsAddr        *string
+	auditLog           *string
+}
+
+// defineManagerFlags - define the flags for configuring an account manager.
+func defineManagerFlags(flags *flag.FlagSet) *managerFlags {
+	return &managerFlags{
+		rulesFile: flags.String("rules_file", "", "YAML file that describes velocity limit rules (optional)"),
+		customersFile: flags.String("customers_file", "",
+			"YAML file that describes customer profiles, e.g. their time zones (optional)"),
+		timeZone: flags.String("time_zone", "",
+			"IANA time zone that days and weeks are based on for customers without their own time zone "+
+				"(optional, the offset of each transaction's time is used by default)"),
+		stateDir: flags.String("state_dir", "",
+			"Directory that persists customer accounts across runs (optional, accounts are kept in memory by default)"),
+		snapshotInterval: flags.Int("snapshot_interval", account.DefaultSnapshotInterval,
+			"Number of decisions logged to the state directory between two snapshots"),
+		onDuplicate: flags.String("on_duplicate", string(account.DuplicateReplay),
+			"What to do with a transaction identical to a processed one with the same ID: replay, decline or drop"),
+		onConflict: flags.String("on_conflict", string(account.DuplicateDecline),
+			"What to do with a transaction that reuses the ID of a processed one with a different payload: "+
+				"replay, decline or drop"),
+		duplicateRetention: flags.Duration("duplicate_retention", 30*24*time.Hour,
+			"How long after a transaction, in transaction time, its duplicates are detected, e.g. 720h"),
+		reversalWindow: flags.Duration("reversal_window", 120*24*time.Hour,
+			"How long after an accepted transaction, in transaction time, it can be reversed, e.g. 2880h"),
+		outputFormat: flags.String("output_format", string(account.OutputFormatKOHO),
+			"Format of transaction results: koho, or detailed to add decline reasons and remaining headroom"),
+		metricsAddr: flags.String("metrics_addr", "",
+			"Address that metrics are served on at /metrics in the Prometheus text format, e.g. localhost:9090 (optional)"),
+		auditLog: flags.String("audit_log", "",
+			"File that every decision is appended to as a hash-chained, tamper-evident record (optional)"),
+	}
+}
+
+// options - create the account manager options described by the flags.
+// It also returns a function that closes the account store and the audit log used by the options after use.
+func (f *managerFlags) options() ([]account.ManagerOption, func()) {
+	options := make([]account.ManagerOption, 0)
+
+	// Rules
+	options = append(options, account.WithRules(f.rules()))
+
+	// Customers and time zones
+	if *f.customersFile != "" {
+		customers, err := account.LoadCustomers(*f.customersFile)
+		if err != nil {
+			log.Fatalf("Error loading customers: %s\n", err.Error())
+		}
+		options = append(options, account.WithCustomers(customers))
+	}
+	if *f.timeZone != "" {
+		location, err := account.LoadTimeZone(*f.timeZone)
+		if err != nil {
+			log.Fatalf("Invalid arg 'time_zone': %s\n", err.Error())
+		}
+		options = append(options, account.WithTimeZone(location))
+	}
+
+	// Duplicate policies
+	identicalPolicy, err := account.ParseDuplicatePolicy(*f.onDuplicate)
+	if err != nil {
+		log.Fatalf("Invalid arg 'on_duplicate': %s\n", err.Error())
+	}
+	conflictingPolicy, err := account.ParseDuplicatePolicy(*f.onConflict)
+	if err != nil {
+		log.Fatalf("Invalid arg 'on_conflict': %s\n", err.Error())
+	}
+	options = append(options, account.WithDuplicatePolicies(identicalPolicy, conflictingPolicy))
+	if *f.duplicateRetention <= 0 || *f.reversalWindow <= 0 {
+		log.Fatalln("Invalid arg 'duplicate_retention' or 'reversal_window': must be greater than 0")
+	}
+	options = append(options, account.WithDuplicateRetention(*f.duplicateRetention),
+		account.WithReversalWindow(*f.reversalWindow))
+
+	// Output format
+	outputFormat, err := account.ParseOutputFormat(*f.outputFormat)
+	if err != nil {
+		log.Fatalf("Invalid arg 'output_format': %s\n", err.Error())
+	}
+	options = append(options, account.WithOutputFormat(outputFormat))
+
+	// Metrics
+	if *f.metricsAddr != "" {
+		registry := metrics.NewRegistry()
+		serveMetrics(*f.metricsAddr, registry)
+		options = append(options, account.WithMetrics(registry))
+	}
+
+	// Account store
+	accountStore := account.NewMemoryAccountStore()
+	if *f.stateDir != "" {
+		if accountStore, err = account.OpenFileAccountStore(*f.stateDir, *f.snapshotInterval); err != nil {
+			log.Fatalf("Error opening account store: %s\n", err.Error())
+		}
+	}
+	options = append(options, account.WithAccountStore(accountStore))
+
+	// Audit log
+	var auditLog *account.AuditLog
+	if *f.auditLog != "" {
+		if auditLog, err = account.OpenAuditLog(*f.auditLog); err != nil {
+			log.Fatalf("Error opening audit log: %s\n", err.Error())
+		}
+		options = append(options, account.WithAuditLog(auditLog))
+	}
+
+	return options, func() {
+		closeAccountStore(accountStore)
+		if auditLog != nil {
+			closeAuditLog(auditLog)
+		}
+	}
+}
+
+// rules - load the rules described by the flags, which are the default rules if there is no rules file.
+func (f *managerFlags) rules() *account.Rules {
+	if *f.rulesFile == "" {
+		return account.DefaultRules()
+	}
+	rules, err := account.LoadRules(*f.rulesFile)
+	if err != nil {
+		log.Fatalf("Error loading rules: %s\n", err.Error())
+	}
+	return rules
+}
+
+// serveMetrics - serve the metrics of the given registry at /metrics on the given address in the background.
+func serveMetrics(addr string, registry *metrics.Registry) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Error listening on the metrics address %s: %s\n", addr, err.Error())
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry.Handler())
+
+	log.Printf("Start serving metrics on %s...\n", listener.Addr().String())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Error serving metrics: %s\n", err.Error())
+		}
+	}()
+}
+
+// closeAccountStore - close the given account store and log the error if there is one.
+func closeAccountStore(store account.AccountStore) {
+	if err := store.Close(); err != nil {
+		log.Printf("Error closing account store: %s\n", err.Error())
+	}
+}
+
+// closeAuditLog - close the given audit log and log its head, which can be kept elsewhere to detect that records are
+// removed from the end of the log later.
+func closeAuditLog(auditLog *account.AuditLog) {
+	head := auditLog.Head()
+	if err := auditLog.Close(); err != nil {
+		log.Printf("Error closing audit log: %s\n", err.Error())
+		return
+	}
+	log.Printf("Audit log head: %d records, hash %s\n", head.Records, head.Head)
 }
@@ -0,0 +1,341 @@
+// Package metrics - an in-process registry of counters, gauges and histograms exposed in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metricType - the type of a metric in the Prometheus text format.
+type metricType string
+
+const (
+	typeCounter   metricType = "counter"
+	typeGauge     metricType = "gauge"
+	typeHistogram metricType = "histogram"
+)
+
+// DefaultDurationBuckets - the upper bounds in seconds of the histogram buckets of fast operations,
+// from 1 microsecond to 100 milliseconds.
+var DefaultDurationBuckets = []float64{1e-6, 5e-6, 1e-5, 5e-5, 1e-4, 5e-4, 1e-3, 5e-3, 1e-2, 1e-1}
+
+// Registry - a set of metrics. It is safe for concurrent use.
+type Registry struct {
+	families map[string]*family
+	mutex    *sync.Mutex
+}
+
+// NewRegistry - create an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]*family, 0),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// family - the metrics with the same name, one per combination of label values.
+type family struct {
+	name       string
+	help       string
+	typ        metricType
+	labelNames []string
+	buckets    []float64 // The upper bounds of histogram buckets, in increasing order.
+	metrics    map[string]interface{}
+	mutex      *sync.RWMutex
+}
+
+// register - add a family of metrics to the registry, or return the family with the same name if it has the same
+// type and labels. It panics otherwise, as metrics are registered by code.
+func (r *Registry) register(name, help string, typ metricType, buckets []float64, labelNames []string) *family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if f := r.families[name]; f != nil {
+		if f.typ != typ || strings.Join(f.labelNames, ",") != strings.Join(labelNames, ",") {
+			panic(fmt.Sprintf("metric %s is already registered with another type or other labels", name))
+		}
+		return f
+	}
+	f := &family{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+		metrics:    make(map[string]interface{}, 0),
+		mutex:      &sync.RWMutex{},
+	}
+	r.families[name] = f
+	return f
+}
+
+// with - return the metric with the given label values, creating it with `create` if it does not exist.
+func (f *family) with(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s has %d labels but got %d values", f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	f.mutex.RLock()
+	metric := f.metrics[key]
+	f.mutex.RUnlock()
+	if metric != nil {
+		return metric
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.metrics[key] == nil {
+		f.metrics[key] = create()
+	}
+	return f.metrics[key]
+}
+
+/****************************************************************************************/
+
+// Counter - a value that only goes up, e.g. the number of requests.
+type Counter struct {
+	value uint64
+}
+
+// Inc - add 1 to the counter.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add - add the given number to the counter.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value - return the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// CounterVec - a family of counters partitioned by labels.
+type CounterVec struct {
+	family *family
+}
+
+// NewCounterVec - register a family of counters with the given name, help text and label names.
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{family: r.register(name, help, typeCounter, nil, labelNames)}
+}
+
+// With - return the counter with the given label values, in the order of the label names.
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	return v.family.with(labelValues, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+// Gauge - a value that goes up and down, e.g. the length of a queue.
+type Gauge struct {
+	value int64
+}
+
+// Inc - add 1 to the gauge.
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.value, 1)
+}
+
+// Dec - subtract 1 from the gauge.
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.value, -1)
+}
+
+// Set - set the gauge to the given value.
+func (g *Gauge) Set(value int64) {
+	atomic.StoreInt64(&g.value, value)
+}
+
+// Value - return the current value of the gauge.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// GaugeVec - a family of gauges partitioned by labels.
+type GaugeVec struct {
+	family *family
+}
+
+// NewGaugeVec - register a family of gauges with the given name, help text and label names.
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{family: r.register(name, help, typeGauge, nil, labelNames)}
+}
+
+// With - return the gauge with the given label values, in the order of the label names.
+func (v *GaugeVec) With(labelValues ...string) *Gauge {
+	return v.family.with(labelValues, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+// Histogram - the distribution of observed values, e.g. latencies, in buckets.
+type Histogram struct {
+	buckets []float64
+	counts  []uint64 // The number of observations in each bucket, not cumulated.
+	count   uint64
+	sum     float64
+	mutex   *sync.Mutex
+}
+
+// Observe - add the given value to the histogram.
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	h.mutex.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+	h.mutex.Unlock()
+}
+
+// Count - return the number of observations of the histogram.
+func (h *Histogram) Count() uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.count
+}
+
+// HistogramVec - a family of histograms with the same buckets partitioned by labels.
+type HistogramVec struct {
+	family *family
+}
+
+// NewHistogramVec - register a family of histograms with the given name, help text, bucket upper bounds and
+// label names. The bucket upper bounds must be in increasing order.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("the buckets of metric %s are not in increasing order", name))
+	}
+	return &HistogramVec{family: r.register(name, help, typeHistogram, buckets, labelNames)}
+}
+
+// With - return the histogram with the given label values, in the order of the label names.
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	buckets := v.family.buckets
+	return v.family.with(labelValues, func() interface{} {
+		return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)), mutex: &sync.Mutex{}}
+	}).(*Histogram)
+}
+
+/****************************************************************************************/
+
+// WriteText - write all the metrics to the given writer in the Prometheus text format. Families are sorted by name
+// and metrics by label values, so the output is stable.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mutex.Unlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	output := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(output)
+	}
+	return output.Flush()
+}
+
+// write - write the help text, the type and the metrics of the family.
+func (f *family) write(w *bufio.Writer) {
+	f.mutex.RLock()
+	keys := make([]string, 0, len(f.metrics))
+	metrics := make(map[string]interface{}, len(f.metrics))
+	for key, metric := range f.metrics {
+		keys = append(keys, key)
+		metrics[key] = metric
+	}
+	f.mutex.RUnlock()
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	for _, key := range keys {
+		var labelValues []string
+		if len(f.labelNames) > 0 {
+			labelValues = strings.Split(key, "\xff")
+		}
+		switch metric := metrics[key].(type) {
+		case *Counter:
+			fmt.Fprintf(w, "%s%s %d\n", f.name, formatLabels(f.labelNames, labelValues), metric.Value())
+		case *Gauge:
+			fmt.Fprintf(w, "%s%s %d\n", f.name, formatLabels(f.labelNames, labelValues), metric.Value())
+		case *Histogram:
+			metric.mutex.Lock()
+			counts := append([]uint64{}, metric.counts...)
+			count, sum := metric.count, metric.sum
+			metric.mutex.Unlock()
+
+			labelNames := append(append([]string{}, f.labelNames...), "le")
+			cumulated := uint64(0)
+			for i, bound := range f.buckets {
+				cumulated += counts[i]
+				labels := formatLabels(labelNames, append(append([]string{}, labelValues...), formatFloat(bound)))
+				fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, labels, cumulated)
+			}
+			labels := formatLabels(labelNames, append(append([]string{}, labelValues...), "+Inf"))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, labels, count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labelNames, labelValues), formatFloat(sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labelNames, labelValues), count)
+		}
+	}
+}
+
+// formatLabels - format the given labels as `{name="value",...}`, or an empty string if there is no label.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var labels strings.Builder
+	labels.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			labels.WriteString(",")
+		}
+		fmt.Fprintf(&labels, `%s="%s"`, name, escapeLabelValue(values[i]))
+	}
+	labels.WriteString("}")
+	return labels.String()
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+// Handler - create an HTTP handler that serves the metrics of the registry in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.WriteText(w); err != nil {
+			log.Printf("error writing metrics: %s", err.Error())
+		}
+	})
+}
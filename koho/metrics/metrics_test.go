@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteText(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.NewCounterVec("requests_total", "Number of requests.", "path", "code")
+	requests.With("/loads", "200").Add(3)
+	requests.With("/loads", "400").Inc()
+	requests.With(`/a"b\c`, "200").Inc()
+	registry.NewGaugeVec("queue_depth", "Length of\nthe queue.").With().Set(-2)
+	latency := registry.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "path")
+	latency.With("/loads").Observe(0.1)
+	latency.With("/loads").Observe(0.5)
+	latency.With("/loads").Observe(2)
+
+	output := &bytes.Buffer{}
+	assert.NoError(t, registry.WriteText(output))
+	assert.Equal(t, `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="/loads",le="0.1"} 1
+latency_seconds_bucket{path="/loads",le="1"} 2
+latency_seconds_bucket{path="/loads",le="+Inf"} 3
+latency_seconds_sum{path="/loads"} 2.6
+latency_seconds_count{path="/loads"} 3
+# HELP queue_depth Length of\nthe queue.
+# TYPE queue_depth gauge
+queue_depth -2
+# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{path="/a\"b\\c",code="200"} 1
+requests_total{path="/loads",code="200"} 3
+requests_total{path="/loads",code="400"} 1
+`, output.String())
+}
+
+func TestRegister(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounterVec("requests_total", "Number of requests.", "path")
+	counter.With("/loads").Inc()
+
+	// Registering the same metric again returns the same metrics.
+	assert.Equal(t, uint64(1), registry.NewCounterVec("requests_total", "Number of requests.", "path").
+		With("/loads").Value())
+
+	assert.Panics(t, func() { registry.NewGaugeVec("requests_total", "Number of requests.", "path") })
+	assert.Panics(t, func() { registry.NewCounterVec("requests_total", "Number of requests.", "code") })
+	assert.Panics(t, func() { counter.With("/loads", "200") })
+	assert.Panics(t, func() { registry.NewHistogramVec("latency_seconds", "Latency.", []float64{1, 0.1}) })
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	registry := NewRegistry()
+	counters := registry.NewCounterVec("requests_total", "Number of requests.", "path")
+	histograms := registry.NewHistogramVec("latency_seconds", "Latency.", DefaultDurationBuckets, "path")
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				counters.With("/loads").Inc()
+				histograms.With("/loads").Observe(0.001)
+				_ = registry.WriteText(&bytes.Buffer{})
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, uint64(8000), counters.With("/loads").Value())
+	assert.Equal(t, uint64(8000), histograms.With("/loads").Count())
+}
+
+func TestHandler(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounterVec("requests_total", "Number of requests.").With().Inc()
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), "requests_total 1\n")
+}